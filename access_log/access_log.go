@@ -0,0 +1,194 @@
+package access_log
+
+import (
+	"http"
+	"io"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"falcore"
+)
+
+// Apache common log format
+const CommonFormat = `$remote_addr - - [$time] "$method $uri $proto" $status $bytes`
+
+// Apache combined log format
+const CombinedFormat = CommonFormat + ` "$referer" "$user_agent"`
+
+// Combined plus the request duration and ID
+const DefaultFormat = CombinedFormat + ` $duration $id`
+
+// falcore/access_log.Filter writes a line for every completed request.
+// Set it as (or call it from) the Pipeline's RequestDoneCallback.
+//
+// Lines are built from a format string with $ prefixed fields:
+//
+//   $remote_addr  client address without the port
+//   $time         request start time
+//   $method       request method
+//   $uri          raw request URI
+//   $path         URL path
+//   $proto        request protocol
+//   $host         Host header
+//   $status       response status code
+//   $bytes        response body length ("-" if unknown)
+//   $bytes_in     bytes read for the request, headers included
+//   $bytes_out    bytes written for the response, headers included
+//   $duration     total request time in seconds
+//   $id           request ID
+//   $signature    pipeline signature
+//   $referer      Referer header
+//   $user_agent   User-Agent header
+//
+// Anything else is copied to the output as is.
+type Filter struct {
+	Output io.Writer
+	// Requests it returns true for aren't logged, like health.IsCheck
+	Skip     func(request *falcore.Request) bool
+	segments []segment
+	mutex    *sync.Mutex
+}
+
+type segment struct {
+	literal string
+	field   func(*entry) string
+}
+
+// Everything we log, copied out of the request before the
+// connection can be cleaned up underneath us.
+type entry struct {
+	remoteAddr string
+	start      int64
+	method     string
+	uri        string
+	path       string
+	proto      string
+	host       string
+	status     int
+	bytes      int64
+	bytesIn    int64
+	bytesOut   int64
+	duration   float32
+	id         string
+	signature  string
+	referer    string
+	userAgent  string
+}
+
+var fields = map[string]func(*entry) string{
+	"remote_addr": func(e *entry) string { return e.remoteAddr },
+	"time": func(e *entry) string {
+		return time.SecondsToLocalTime(e.start / 1e9).Format("02/Jan/2006:15:04:05 -0700")
+	},
+	"method": func(e *entry) string { return e.method },
+	"uri":    func(e *entry) string { return e.uri },
+	"path":   func(e *entry) string { return e.path },
+	"proto":  func(e *entry) string { return e.proto },
+	"host":   func(e *entry) string { return e.host },
+	"status": func(e *entry) string { return fmt.Sprintf("%d", e.status) },
+	"bytes": func(e *entry) string {
+		if e.bytes < 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%d", e.bytes)
+	},
+	"bytes_in":   func(e *entry) string { return fmt.Sprintf("%d", e.bytesIn) },
+	"bytes_out":  func(e *entry) string { return fmt.Sprintf("%d", e.bytesOut) },
+	"duration":   func(e *entry) string { return fmt.Sprintf("%.4f", e.duration) },
+	"id":         func(e *entry) string { return e.id },
+	"signature":  func(e *entry) string { return e.signature },
+	"referer":    func(e *entry) string { return e.referer },
+	"user_agent": func(e *entry) string { return e.userAgent },
+}
+
+// Create a Filter writing lines in format to out.  Uses DefaultFormat if
+// format is empty.
+func NewFilter(format string, out io.Writer) *Filter {
+	f := new(Filter)
+	f.Output = out
+	f.mutex = new(sync.Mutex)
+	if format == "" {
+		format = DefaultFormat
+	}
+	f.segments = parseFormat(format)
+	return f
+}
+
+func parseFormat(format string) (segments []segment) {
+	literal := ""
+	for i := 0; i < len(format); i++ {
+		if format[i] == '$' {
+			j := i + 1
+			for j < len(format) && (format[j] == '_' || (format[j] >= 'a' && format[j] <= 'z')) {
+				j++
+			}
+			if field, ok := fields[format[i+1:j]]; ok {
+				if literal != "" {
+					segments = append(segments, segment{literal: literal})
+					literal = ""
+				}
+				segments = append(segments, segment{field: field})
+				i = j - 1
+				continue
+			}
+		}
+		literal += format[i : i+1]
+	}
+	if literal != "" {
+		segments = append(segments, segment{literal: literal})
+	}
+	return
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	if f.Skip != nil && f.Skip(request) {
+		return nil
+	}
+	e := newEntry(request)
+	line := make([]string, len(f.segments))
+	for i, s := range f.segments {
+		if s.field != nil {
+			line[i] = s.field(e)
+		} else {
+			line[i] = s.literal
+		}
+	}
+
+	f.mutex.Lock()
+	io.WriteString(f.Output, strings.Join(line, "")+"\n")
+	f.mutex.Unlock()
+	return nil
+}
+
+func newEntry(request *falcore.Request) *entry {
+	req := request.HttpRequest
+	e := &entry{
+		remoteAddr: req.RemoteAddr,
+		start:      request.StartTime,
+		method:     req.Method,
+		uri:        req.RawURL,
+		proto:      req.Proto,
+		host:       req.Host,
+		status:     request.ResponseStatus,
+		bytes:      request.ResponseLength,
+		bytesIn:    request.BytesIn(),
+		bytesOut:   request.BytesOut(),
+		duration:   falcore.TimeDiff(request.StartTime, request.EndTime),
+		id:         request.ID,
+		signature:  request.Signature(),
+		referer:    req.Referer,
+		userAgent:  req.UserAgent,
+	}
+	if req.URL != nil {
+		e.path = req.URL.Path
+	}
+	if host, _, err := net.SplitHostPort(e.remoteAddr); err == nil {
+		e.remoteAddr = host
+	}
+	if e.remoteAddr == "" {
+		e.remoteAddr = "-"
+	}
+	return e
+}
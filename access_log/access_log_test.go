@@ -0,0 +1,90 @@
+package access_log
+
+import (
+	"falcore"
+	"http"
+	"testing"
+	"fmt"
+	"os"
+	"time"
+	"strings"
+)
+
+// Sends each log line to a channel
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, os.Error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+var lines = make(lineWriter, 10)
+
+var srv *falcore.Server
+
+func init() {
+	go func() {
+		pipeline := falcore.NewPipeline()
+		pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+			return falcore.SimpleResponse(req.HttpRequest, 201, nil, "created")
+		}))
+		pipeline.RequestDoneCallback = NewFilter(`$remote_addr "$method $uri $proto" $status $bytes $id $unknown`, lines)
+
+		srv = falcore.NewServer(0, pipeline)
+		if err := srv.ListenAndServe(); err != nil {
+			panic("Could not start falcore")
+		}
+	}()
+}
+
+func port() int {
+	for srv == nil || srv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+	return srv.Port()
+}
+
+func TestAccessLog(t *testing.T) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%v/logged?a=b", port()), nil)
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("HTTP Error %v", err)
+	}
+	res.Body.Close()
+
+	var line string
+	select {
+	case line = <-lines:
+	case <-time.After(2e9):
+		t.Fatalf("No access log line written")
+	}
+	if !strings.HasPrefix(line, `127.0.0.1 "GET /logged?a=b HTTP/1.1" 201 7 `) {
+		t.Errorf("Unexpected log line: %q", line)
+	}
+	if !strings.HasSuffix(line, " $unknown\n") {
+		t.Errorf("Unknown fields should be left alone: %q", line)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	segments := parseFormat("[$status] $$ $bytes")
+	if len(segments) != 4 {
+		t.Fatalf("Wrong number of segments: %v", len(segments))
+	}
+	if segments[0].literal != "[" || segments[1].field == nil || segments[2].literal != "] $$ " || segments[3].field == nil {
+		t.Errorf("Format parsed incorrectly")
+	}
+}
+
+func TestSkip(t *testing.T) {
+	out := make(lineWriter, 1)
+	f := NewFilter("", out)
+	f.Skip = func(request *falcore.Request) bool { return true }
+	tmp, _ := http.NewRequest("GET", "/healthz", nil)
+	f.FilterRequest(&falcore.Request{HttpRequest: tmp})
+	select {
+	case line := <-out:
+		t.Errorf("Skipped request was logged: %q", line)
+	default:
+	}
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"http"
+	"os"
+	"strings"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"falcore"
+)
+
+// The Request.Context key for the authenticated principal
+const PrincipalKey = "auth.principal"
+
+// Checks a Basic username and password.  Return the principal for valid
+// credentials or nil if they're wrong.  Validators are called on the
+// request's goroutine so they can block on a remote service.  Return an
+// error if the check itself couldn't be done.
+type BasicValidator func(request *falcore.Request, user, password string) (principal interface{}, err os.Error)
+
+// Checks a Bearer token.  Works like BasicValidator.
+type TokenValidator func(request *falcore.Request, token string) (principal interface{}, err os.Error)
+
+// falcore/auth.Filter requires requests to be authenticated with HTTP
+// Basic or Bearer credentials.  Set Basic, Bearer or both.
+//
+// Requests without valid credentials get a '401 Unauthorized' with a
+// WWW-Authenticate challenge for each enabled scheme.  If a validator
+// returns an error the request gets a 503.  On success the principal
+// is stored in the Request.Context under PrincipalKey.
+type Filter struct {
+	Realm  string
+	Basic  BasicValidator
+	Bearer TokenValidator
+}
+
+func NewBasicFilter(realm string, validator BasicValidator) *Filter {
+	return &Filter{Realm: realm, Basic: validator}
+}
+
+func NewBearerFilter(realm string, validator TokenValidator) *Filter {
+	return &Filter{Realm: realm, Bearer: validator}
+}
+
+// A BasicValidator for a fixed set of users.  Passwords are
+// compared in constant time.  The principal is the username.
+func StaticCredentials(users map[string]string) BasicValidator {
+	// comparing digests keeps the time independent of the password
+	// lengths
+	digests := make(map[string][]byte, len(users))
+	for user, password := range users {
+		digests[user] = digest(password)
+	}
+	unknown := digest("")
+	return func(request *falcore.Request, user, password string) (interface{}, os.Error) {
+		expected, ok := digests[user]
+		if !ok {
+			// still do the compare so unknown users take as long
+			expected = unknown
+		}
+		if subtle.ConstantTimeCompare(expected, digest(password)) == 1 && ok {
+			return user, nil
+		}
+		return nil, nil
+	}
+}
+
+func digest(s string) []byte {
+	h := sha256.New()
+	h.Write([]byte(s))
+	return h.Sum()
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	var principal interface{}
+	var err os.Error
+
+	scheme, credentials := splitAuthorization(req.Header.Get("Authorization"))
+	switch {
+	case scheme == "basic" && f.Basic != nil:
+		if user, password, ok := parseBasic(credentials); ok {
+			principal, err = f.Basic(request, user, password)
+		}
+	case scheme == "bearer" && f.Bearer != nil:
+		if credentials != "" {
+			principal, err = f.Bearer(request, credentials)
+		}
+	}
+
+	if err != nil {
+		falcore.Error("%s Auth error: %v", request.ID, err)
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.SimpleResponse(req, 503, nil, "Service Unavailable\n")
+	}
+	if principal == nil {
+		request.CurrentStage.Status = 2 // Fail
+		return f.unauthorized(req)
+	}
+	request.Context[PrincipalKey] = principal
+	return nil
+}
+
+func (f *Filter) unauthorized(req *http.Request) *http.Response {
+	h := make(http.Header)
+	if f.Basic != nil {
+		h.Add("Www-Authenticate", "Basic realm=\""+f.Realm+"\"")
+	}
+	if f.Bearer != nil {
+		h.Add("Www-Authenticate", "Bearer realm=\""+f.Realm+"\"")
+	}
+	return falcore.SimpleResponse(req, 401, h, "Unauthorized\n")
+}
+
+// Returns the lowercased scheme and the credentials
+func splitAuthorization(value string) (scheme, credentials string) {
+	value = strings.TrimSpace(value)
+	i := strings.Index(value, " ")
+	if i < 0 {
+		return strings.ToLower(value), ""
+	}
+	return strings.ToLower(value[0:i]), strings.TrimSpace(value[i+1:])
+}
+
+func parseBasic(credentials string) (user, password string, ok bool) {
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(credentials)))
+	n, err := base64.StdEncoding.Decode(buf, []byte(credentials))
+	if err != nil {
+		return
+	}
+	pair := string(buf[0:n])
+	i := strings.Index(pair, ":")
+	if i < 0 {
+		return
+	}
+	return pair[0:i], pair[i+1:], true
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"falcore"
+	"http"
+	"os"
+	"testing"
+	"encoding/base64"
+)
+
+func authRequest(authorization string) *falcore.Request {
+	tmp, _ := http.NewRequest("GET", "/private", nil)
+	if authorization != "" {
+		tmp.Header.Set("Authorization", authorization)
+	}
+	return &falcore.Request{
+		HttpRequest:  tmp,
+		CurrentStage: falcore.NewPiplineStage("test"),
+		Context:      make(map[string]interface{}),
+	}
+}
+
+func basic(user, password string) string {
+	pair := []byte(user + ":" + password)
+	buf := make([]byte, base64.StdEncoding.EncodedLen(len(pair)))
+	base64.StdEncoding.Encode(buf, pair)
+	return "Basic " + string(buf)
+}
+
+func TestBasic(t *testing.T) {
+	f := NewBasicFilter("test", StaticCredentials(map[string]string{"alice": "secret"}))
+
+	req := authRequest(basic("alice", "secret"))
+	if res := f.FilterRequest(req); res != nil {
+		t.Fatalf("Valid credentials rejected: %v", res.StatusCode)
+	}
+	if req.Context[PrincipalKey] != "alice" {
+		t.Errorf("Expected principal alice, got %v", req.Context[PrincipalKey])
+	}
+
+	for _, authorization := range []string{
+		"",
+		basic("alice", "wrong"),
+		basic("bob", "secret"),
+		// matches the digest unknown users are compared against
+		basic("bob", ""),
+		basic("alice", "secretx"),
+		"Basic !!!notbase64",
+		"Bearer secret",
+	} {
+		req = authRequest(authorization)
+		res := f.FilterRequest(req)
+		if res == nil || res.StatusCode != 401 {
+			t.Errorf("'%v' should be unauthorized", authorization)
+			continue
+		}
+		if res.Header.Get("Www-Authenticate") != "Basic realm=\"test\"" {
+			t.Errorf("Wrong challenge: %v", res.Header.Get("Www-Authenticate"))
+		}
+		if _, ok := req.Context[PrincipalKey]; ok {
+			t.Errorf("Principal set for a rejected request")
+		}
+	}
+}
+
+func TestBearer(t *testing.T) {
+	f := NewBearerFilter("api", func(request *falcore.Request, token string) (interface{}, os.Error) {
+		switch token {
+		case "good":
+			return "service", nil
+		case "broken":
+			return nil, os.NewError("token service is down")
+		}
+		return nil, nil
+	})
+	f.Basic = StaticCredentials(map[string]string{})
+
+	req := authRequest("Bearer good")
+	if res := f.FilterRequest(req); res != nil {
+		t.Fatalf("Valid token rejected: %v", res.StatusCode)
+	}
+	if req.Context[PrincipalKey] != "service" {
+		t.Errorf("Expected principal service, got %v", req.Context[PrincipalKey])
+	}
+
+	res := f.FilterRequest(authRequest("Bearer bad"))
+	if res == nil || res.StatusCode != 401 {
+		t.Fatalf("Bad token should be unauthorized")
+	}
+	if len(res.Header["Www-Authenticate"]) != 2 {
+		t.Errorf("Expected a challenge for both schemes, got %v", res.Header["Www-Authenticate"])
+	}
+
+	if res := f.FilterRequest(authRequest("Bearer broken")); res == nil || res.StatusCode != 503 {
+		t.Errorf("Validator errors should be a 503")
+	}
+}
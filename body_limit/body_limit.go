@@ -0,0 +1,97 @@
+package body_limit
+
+import (
+	"http"
+	"io"
+	"os"
+	"falcore"
+)
+
+// Returned by reads of a request body once it's over the limit.  The
+// same error as falcore.ErrBodyTooLarge.
+var ErrBodyTooLarge = falcore.ErrBodyTooLarge
+
+// falcore/body_limit.Filter caps the size of request bodies.
+//
+// Requests that declare a Content-Length over MaxBytes are rejected
+// with a '413 Request Entity Too Large' before the body is read.  If
+// the client sent 'Expect: 100-continue' and is still waiting to send
+// the body it gets a '417 Expectation Failed' instead and never sends
+// it at all.
+// Bodies without a Content-Length (chunked) are cut off once MaxBytes
+// have been read and further reads return ErrBodyTooLarge.
+//
+// To turn a cut off body into a 413 response, add the same Filter to
+// the Downstream list as well.  It will replace whatever response the
+// pipeline produced.
+type Filter struct {
+	MaxBytes int64
+}
+
+func NewFilter(maxBytes int64) *Filter {
+	f := new(Filter)
+	f.MaxBytes = maxBytes
+	return f
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	if req.ContentLength > f.MaxBytes {
+		request.CurrentStage.Status = 2 // Fail
+		if request.ExpectsContinue() {
+			return falcore.SimpleResponse(req, 417, nil, "Expectation Failed\n")
+		}
+		return tooLarge(req)
+	}
+	if req.Body != nil {
+		req.Body = &limitedBody{body: req.Body, remaining: f.MaxBytes}
+	}
+	return nil
+}
+
+func (f *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
+	request.CurrentStage.Status = 1 // Skip
+	if lb, ok := request.HttpRequest.Body.(*limitedBody); ok && lb.exceeded {
+		if res.Body != nil {
+			res.Body.Close()
+		}
+		*res = *tooLarge(request.HttpRequest)
+		request.CurrentStage.Status = 2 // Fail
+	}
+}
+
+func tooLarge(req *http.Request) *http.Response {
+	res := falcore.SimpleResponse(req, 413, nil, "Request Entity Too Large\n")
+	// the rest of the body is still on the wire
+	res.Close = true
+	return res
+}
+
+// Wraps the request body and fails reads once the limit is passed
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (n int, err os.Error) {
+	if b.exceeded {
+		return 0, ErrBodyTooLarge
+	}
+	// read one extra byte so we can tell when the limit is passed
+	if int64(len(p)) > b.remaining+1 {
+		p = p[0 : b.remaining+1]
+	}
+	n, err = b.body.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.exceeded = true
+		err = ErrBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return
+}
+
+func (b *limitedBody) Close() os.Error {
+	return b.body.Close()
+}
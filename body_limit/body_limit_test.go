@@ -0,0 +1,102 @@
+package body_limit
+
+import (
+	"falcore"
+	"http"
+	"testing"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+func limitRequest(body string, contentLength int64) *falcore.Request {
+	tmp, _ := http.NewRequest("POST", "/upload", bytes.NewBufferString(body))
+	tmp.ContentLength = contentLength
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestContentLengthRejected(t *testing.T) {
+	f := NewFilter(10)
+	req := limitRequest(strings.Repeat("x", 20), 20)
+	res := f.FilterRequest(req)
+	if res == nil || res.StatusCode != 413 {
+		t.Errorf("Oversized Content-Length should get a 413")
+	}
+
+	req = limitRequest("small", 5)
+	if res = f.FilterRequest(req); res != nil {
+		t.Errorf("Small body shouldn't be rejected: %v", res.StatusCode)
+	}
+	if data, err := ioutil.ReadAll(req.HttpRequest.Body); err != nil || string(data) != "small" {
+		t.Errorf("Small body not readable: %q %v", data, err)
+	}
+}
+
+func TestChunkedLimit(t *testing.T) {
+	f := NewFilter(10)
+	// no Content-Length, like a chunked upload
+	req := limitRequest(strings.Repeat("x", 20), -1)
+	if res := f.FilterRequest(req); res != nil {
+		t.Fatalf("Unknown length body shouldn't be rejected before reading")
+	}
+	data, err := ioutil.ReadAll(req.HttpRequest.Body)
+	if err != ErrBodyTooLarge {
+		t.Errorf("Expected ErrBodyTooLarge, got %v", err)
+	}
+	if len(data) != 10 {
+		t.Errorf("Read %v bytes past the limit", len(data))
+	}
+
+	res := falcore.SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	f.FilterResponse(req, res)
+	if res.StatusCode != 413 {
+		t.Errorf("Response for an oversized body should be a 413, got %v", res.StatusCode)
+	}
+}
+
+func TestPerInstanceLimit(t *testing.T) {
+	small := NewFilter(5)
+	large := NewFilter(50)
+	if small.FilterRequest(limitRequest(strings.Repeat("x", 20), 20)) == nil {
+		t.Errorf("Small limit not enforced")
+	}
+	if large.FilterRequest(limitRequest(strings.Repeat("x", 20), 20)) != nil {
+		t.Errorf("Large limit shouldn't reject")
+	}
+}
+
+func TestExpectContinueRejected(t *testing.T) {
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(NewFilter(10))
+	pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		body, _ := ioutil.ReadAll(req.HttpRequest.Body)
+		return falcore.SimpleResponse(req.HttpRequest, 200, nil, string(body))
+	}))
+	srv := falcore.NewServer(0, pipeline)
+	go srv.ListenAndServe()
+	for srv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+	defer srv.StopAccepting()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	// the body is never sent
+	conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n"))
+	req, _ := http.NewRequest("POST", "/upload", nil)
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+	if res.StatusCode != 417 {
+		t.Errorf("Expected a 417 before the body was sent, got %v", res.StatusCode)
+	}
+}
@@ -0,0 +1,78 @@
+package falcore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Returned by Request.BufferBody when the body is over the limit, and
+// by reads of bodies cut off by falcore/body_limit or
+// falcore/compression, so one comparison catches them all.  Filters
+// usually answer with a 413.
+var ErrBodyTooLarge = os.NewError("falcore: request body too large")
+
+// A request body kept in memory so it can be read more than once.
+// Like StringBody, closing it starts it over from the beginning.
+type BufferedBody struct {
+	data   []byte
+	reader *bytes.Buffer
+}
+
+func (b *BufferedBody) Read(p []byte) (int, os.Error) {
+	return b.reader.Read(p)
+}
+
+func (b *BufferedBody) Close() os.Error {
+	// start over
+	b.reader = bytes.NewBuffer(b.data)
+	return nil
+}
+
+// The whole body
+func (b *BufferedBody) Bytes() []byte {
+	return b.data
+}
+
+// Reads the request body into memory (up to maxBytes) and replaces
+// HttpRequest.Body with a BufferedBody so several filters can read it,
+// like checking a signature and then proxying the request.  Close the
+// body after reading it to leave it ready for the next filter, or use
+// Bytes.  Calling BufferBody again just starts the body over.
+//
+// Bodies over maxBytes return ErrBodyTooLarge and the body is left as
+// it was so nothing is lost.
+func (fReq *Request) BufferBody(maxBytes int) os.Error {
+	req := fReq.HttpRequest
+	if body, ok := req.Body.(*BufferedBody); ok {
+		return body.Close()
+	}
+	if req.Body == nil {
+		req.Body = &BufferedBody{reader: bytes.NewBuffer(nil)}
+		return nil
+	}
+	original := req.Body
+	data, err := ioutil.ReadAll(io.LimitReader(original, int64(maxBytes)+1))
+	if err != nil || len(data) > maxBytes {
+		// put back what we took
+		req.Body = &partialBody{io.MultiReader(bytes.NewBuffer(data), original), original}
+		if err == nil {
+			err = ErrBodyTooLarge
+		}
+		return err
+	}
+	original.Close()
+	req.Body = &BufferedBody{data, bytes.NewBuffer(data)}
+	req.ContentLength = int64(len(data))
+	return nil
+}
+
+type partialBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *partialBody) Close() os.Error {
+	return b.closer.Close()
+}
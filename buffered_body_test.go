@@ -0,0 +1,51 @@
+package falcore
+
+import (
+	"http"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bodyRequest(body string) *Request {
+	tmp, _ := http.NewRequest("POST", "/hello", strings.NewReader(body))
+	return newRequest(tmp, nil, time.Nanoseconds())
+}
+
+func TestBufferBody(t *testing.T) {
+	req := bodyRequest("signed payload")
+	if err := req.BufferBody(1024); err != nil {
+		t.Fatalf("BufferBody failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		body, _ := ioutil.ReadAll(req.HttpRequest.Body)
+		if string(body) != "signed payload" {
+			t.Errorf("Read %v got %q", i, body)
+		}
+		req.HttpRequest.Body.Close()
+	}
+	if req.HttpRequest.ContentLength != 14 {
+		t.Errorf("Expected ContentLength 14, got %v", req.HttpRequest.ContentLength)
+	}
+
+	// again is fine and starts over
+	ioutil.ReadAll(req.HttpRequest.Body)
+	if err := req.BufferBody(1024); err != nil {
+		t.Errorf("Second BufferBody failed: %v", err)
+	}
+	if body, _ := ioutil.ReadAll(req.HttpRequest.Body); string(body) != "signed payload" {
+		t.Errorf("Body wasn't started over: %q", body)
+	}
+}
+
+func TestBufferBodyTooLarge(t *testing.T) {
+	req := bodyRequest("0123456789")
+	if err := req.BufferBody(5); err != ErrBodyTooLarge {
+		t.Errorf("Expected ErrBodyTooLarge, got %v", err)
+	}
+	// nothing was lost
+	if body, _ := ioutil.ReadAll(req.HttpRequest.Body); string(body) != "0123456789" {
+		t.Errorf("Expected the whole body, got %q", body)
+	}
+}
@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"http"
+	"io"
+	"io/ioutil"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"falcore"
+)
+
+const (
+	hitKey          = "cache.hit"
+	revalidatingKey = "cache.revalidating"
+)
+
+// falcore/cache.Filter caches GET and HEAD responses.
+//
+// Add the Filter to the Upstream list (early) to answer from the cache
+// and to the Downstream list to store new responses.
+//
+// Responses are stored for their max-age / s-maxage or until Expires.
+// Responses marked no-store or private, with a Set-Cookie header or
+// for requests with an Authorization header aren't stored.  Entries
+// are keyed on the host and URL plus the request headers named in
+// the response's Vary header.  Hits get an Age header.  Put the
+// Downstream Filter after filters that add to Vary (see
+// falcore.AddVary), like compression and cors, so a gzipped response
+// is never served to a client that didn't ask for one.
+//
+// Once an entry goes stale (or for no-cache responses) the request is
+// sent on with an If-None-Match for the stored ETag.  A 304 from the
+// pipeline refreshes the entry and the stored response is sent instead.
+type Filter struct {
+	Store Store
+	// Largest body that's stored.  Default 1MB
+	MaxEntrySize int64
+}
+
+// Create a Filter with a MemoryStore holding up to maxBytes
+func NewFilter(maxBytes int64) *Filter {
+	f := new(Filter)
+	f.Store = NewMemoryStore(maxBytes)
+	f.MaxEntrySize = 1 << 20
+	return f
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	if !cacheableRequest(req) || directives(req.Header)["no-cache"] != nil {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	key := f.entryKey(req)
+	entry := f.Store.Get(key)
+	if entry == nil {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+
+	now := time.Nanoseconds()
+	if now < entry.Expires {
+		request.Context[hitKey] = true
+		if etag := entry.Header.Get("Etag"); etag != "" && req.Header.Get("If-None-Match") == etag {
+			res := falcore.SimpleResponse(req, 304, copyHeader(entry.Header), "")
+			res.Header.Set("Age", age(entry, now))
+			return res
+		}
+		return entryResponse(req, entry, now)
+	}
+
+	// stale.  ask the pipeline if it's still good
+	if etag := entry.Header.Get("Etag"); etag != "" && req.Header.Get("If-None-Match") == "" {
+		req.Header.Set("If-None-Match", etag)
+		request.Context[revalidatingKey] = key
+	}
+	request.CurrentStage.Status = 2 // Fail
+	return nil
+}
+
+func (f *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
+	req := request.HttpRequest
+	if _, hit := request.Context[hitKey]; hit {
+		request.CurrentStage.Status = 1 // Skip
+		return
+	}
+	now := time.Nanoseconds()
+
+	if key, ok := request.Context[revalidatingKey].(string); ok {
+		req.Header.Del("If-None-Match")
+		if entry := f.Store.Get(key); entry != nil && res.StatusCode == 304 {
+			// still good.  send the stored copy with updated freshness
+			if res.Body != nil {
+				res.Body.Close()
+			}
+			refreshed := *entry
+			refreshed.Stored = now
+			refreshed.Expires = now + freshness(res.Header, now)
+			f.Store.Set(key, &refreshed)
+			*res = *entryResponse(req, &refreshed, now)
+			return
+		}
+	}
+
+	if !f.cacheableResponse(req, res) {
+		request.CurrentStage.Status = 1 // Skip
+		return
+	}
+	lifetime := int64(0)
+	if directives(res.Header)["no-cache"] == nil {
+		lifetime = freshness(res.Header, now)
+	}
+	if lifetime <= 0 && res.Header.Get("Etag") == "" {
+		// nothing to revalidate with
+		request.CurrentStage.Status = 1 // Skip
+		return
+	}
+
+	body, ok := bufferBody(res, f.MaxEntrySize)
+	if !ok {
+		request.CurrentStage.Status = 1 // Skip
+		return
+	}
+	entry := &Entry{
+		StatusCode: res.StatusCode,
+		Header:     copyHeader(res.Header),
+		Body:       body,
+		Stored:     now,
+		Expires:    now + lifetime,
+	}
+
+	if vary := falcore.VaryHeaders(res.Header); len(vary) > 0 {
+		f.Store.Set(baseKey(req), &Entry{Vary: vary, Expires: entry.Expires})
+		f.Store.Set(variantKey(req, vary), entry)
+	} else {
+		f.Store.Set(baseKey(req), entry)
+	}
+}
+
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		return false
+	}
+	return directives(req.Header)["no-store"] == nil
+}
+
+func (f *Filter) cacheableResponse(req *http.Request, res *http.Response) bool {
+	if req.Method != "GET" || !cacheableRequest(req) {
+		return false
+	}
+	if res.StatusCode != 200 || res.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := directives(res.Header)
+	if cc["no-store"] != nil || cc["private"] != nil {
+		return false
+	}
+	for _, v := range falcore.VaryHeaders(res.Header) {
+		if v == "*" {
+			return false
+		}
+	}
+	return res.ContentLength <= f.MaxEntrySize
+}
+
+// The key for req, following the index entry if the response Varies
+func (f *Filter) entryKey(req *http.Request) string {
+	key := baseKey(req)
+	if index := f.Store.Get(key); index != nil && len(index.Vary) > 0 {
+		return variantKey(req, index.Vary)
+	}
+	return key
+}
+
+func baseKey(req *http.Request) string {
+	return req.Host + req.RawURL
+}
+
+func variantKey(req *http.Request, vary []string) string {
+	key := baseKey(req)
+	for _, name := range vary {
+		key += "\x00" + name + ":" + req.Header.Get(name)
+	}
+	return key
+}
+
+// Cache-Control directives.  Values are "" for directives without one.
+func directives(h http.Header) map[string]*string {
+	d := make(map[string]*string)
+	for _, v := range h["Cache-Control"] {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, value = part[0:i], strings.Trim(part[i+1:], "\"")
+			}
+			d[strings.ToLower(name)] = &value
+		}
+	}
+	return d
+}
+
+// How long (nanoseconds) a response can be served from the cache
+func freshness(h http.Header, now int64) int64 {
+	cc := directives(h)
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v := cc[name]; v != nil {
+			if secs, err := strconv.Atoi64(*v); err == nil {
+				return secs * 1e9
+			}
+			return 0
+		}
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		t, err := time.Parse(http.TimeFormat, expires)
+		if err != nil {
+			// invalid dates mean already expired
+			return 0
+		}
+		return t.Seconds()*1e9 - now
+	}
+	return 0
+}
+
+// Reads the body so it can be stored, putting it back on the response.
+// Returns false if it's larger than max.
+func bufferBody(res *http.Response, max int64) ([]byte, bool) {
+	if res.Body == nil {
+		return []byte{}, true
+	}
+	original := res.Body
+	body, err := ioutil.ReadAll(io.LimitReader(original, max+1))
+	if err != nil {
+		// pass on what we got along with the error
+		res.Body = &readCloser{io.MultiReader(bytes.NewBuffer(body), &errReader{err}), original}
+		return nil, false
+	}
+	if int64(len(body)) > max {
+		res.Body = &readCloser{io.MultiReader(bytes.NewBuffer(body), original), original}
+		return nil, false
+	}
+	res.Body = &readCloser{bytes.NewBuffer(body), original}
+	return body, true
+}
+
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (rc *readCloser) Close() os.Error {
+	return rc.closer.Close()
+}
+
+type errReader struct {
+	err os.Error
+}
+
+func (r *errReader) Read(p []byte) (int, os.Error) {
+	return 0, r.err
+}
+
+func entryResponse(req *http.Request, entry *Entry, now int64) *http.Response {
+	res := falcore.SimpleResponse(req, entry.StatusCode, copyHeader(entry.Header), string(entry.Body))
+	res.Header.Set("Age", age(entry, now))
+	return res
+}
+
+func age(entry *Entry, now int64) string {
+	return fmt.Sprintf("%d", (now-entry.Stored)/1e9)
+}
+
+func copyHeader(h http.Header) http.Header {
+	c := make(http.Header)
+	for k, vs := range h {
+		c[k] = append([]string(nil), vs...)
+	}
+	return c
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"falcore"
+	"http"
+	"testing"
+	"io/ioutil"
+	"strings"
+)
+
+// A backend that counts how often it's called
+type backend struct {
+	calls  int
+	header http.Header
+	body   string
+}
+
+func (b *backend) FilterRequest(request *falcore.Request) *http.Response {
+	b.calls++
+	h := make(http.Header)
+	for k, v := range b.header {
+		h[k] = v
+	}
+	if etag := h.Get("Etag"); etag != "" && request.HttpRequest.Header.Get("If-None-Match") == etag {
+		return falcore.SimpleResponse(request.HttpRequest, 304, h, "")
+	}
+	return falcore.SimpleResponse(request.HttpRequest, 200, h, b.body)
+}
+
+// Does what the pipeline would with the filter on both ends
+func run(f *Filter, b *backend, path string, headers map[string]string) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	req.RawURL = path
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	request := &falcore.Request{
+		HttpRequest:  req,
+		CurrentStage: falcore.NewPiplineStage("test"),
+		Context:      make(map[string]interface{}),
+	}
+	res := f.FilterRequest(request)
+	if res == nil {
+		res = b.FilterRequest(request)
+	}
+	f.FilterResponse(request, res)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestCacheHit(t *testing.T) {
+	f := NewFilter(1 << 20)
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}}, body: "hello"}
+
+	res, body := run(f, b, "/", nil)
+	if res.StatusCode != 200 || body != "hello" {
+		t.Fatalf("First request failed: %v %q", res.StatusCode, body)
+	}
+	res, body = run(f, b, "/", nil)
+	if b.calls != 1 {
+		t.Errorf("Expected the second request to be served from cache, backend called %v times", b.calls)
+	}
+	if body != "hello" || res.Header.Get("Age") != "0" {
+		t.Errorf("Bad cached response: %q Age: '%v'", body, res.Header.Get("Age"))
+	}
+
+	// other URLs are separate
+	run(f, b, "/other", nil)
+	if b.calls != 2 {
+		t.Errorf("Different URL shouldn't hit the cache")
+	}
+}
+
+func TestNotCacheable(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		request map[string]string
+	}{
+		{"no-store", http.Header{"Cache-Control": {"no-store, max-age=60"}}, nil},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, nil},
+		{"no lifetime", http.Header{}, nil},
+		{"cookie", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, nil},
+		{"vary star", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, nil},
+		{"authorized", http.Header{"Cache-Control": {"max-age=60"}}, map[string]string{"Authorization": "Basic Zm9vOmJhcg=="}},
+	}
+	for _, test := range tests {
+		f := NewFilter(1 << 20)
+		b := &backend{header: test.header, body: "hello"}
+		run(f, b, "/", test.request)
+		run(f, b, "/", test.request)
+		if b.calls != 2 {
+			t.Errorf("%v Response shouldn't have been cached", test.name)
+		}
+	}
+}
+
+func TestVary(t *testing.T) {
+	f := NewFilter(1 << 20)
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}, body: "hello"}
+
+	run(f, b, "/", map[string]string{"Accept-Language": "en"})
+	run(f, b, "/", map[string]string{"Accept-Language": "en"})
+	if b.calls != 1 {
+		t.Errorf("Same variant should hit the cache")
+	}
+	run(f, b, "/", map[string]string{"Accept-Language": "fr"})
+	if b.calls != 2 {
+		t.Errorf("Different variant shouldn't hit the cache")
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	f := NewFilter(1 << 20)
+	b := &backend{header: http.Header{"Cache-Control": {"no-cache"}, "Etag": {"\"v1\""}}, body: "hello"}
+
+	run(f, b, "/", nil)
+	res, body := run(f, b, "/", nil)
+	if b.calls != 2 {
+		t.Errorf("no-cache responses should always be revalidated")
+	}
+	if res.StatusCode != 200 || body != "hello" {
+		t.Errorf("Revalidated response should be the stored copy, got %v %q", res.StatusCode, body)
+	}
+
+	// changed on the backend
+	b.header.Set("Etag", "\"v2\"")
+	b.body = "goodbye"
+	if _, body = run(f, b, "/", nil); body != "goodbye" {
+		t.Errorf("Expected the new response, got %q", body)
+	}
+}
+
+func TestConditionalHit(t *testing.T) {
+	f := NewFilter(1 << 20)
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {"\"v1\""}}, body: "hello"}
+
+	run(f, b, "/", nil)
+	res, _ := run(f, b, "/", map[string]string{"If-None-Match": "\"v1\""})
+	if res.StatusCode != 304 || b.calls != 1 {
+		t.Errorf("Expected a 304 from the cache, got %v with %v backend calls", res.StatusCode, b.calls)
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	s := NewMemoryStore(1000)
+	big := []byte(strings.Repeat("x", 400))
+	s.Set("a", &Entry{Body: big})
+	s.Set("b", &Entry{Body: big})
+	s.Get("a") // a is now the most recently used
+	s.Set("c", &Entry{Body: big})
+
+	if s.Get("b") != nil {
+		t.Errorf("Least recently used entry should have been evicted")
+	}
+	if s.Get("a") == nil || s.Get("c") == nil {
+		t.Errorf("Recently used entries shouldn't be evicted")
+	}
+	if s.Bytes() > s.MaxBytes {
+		t.Errorf("Store is over its limit: %v", s.Bytes())
+	}
+
+	s.Set("huge", &Entry{Body: make([]byte, 2000)})
+	if s.Get("huge") != nil || s.Len() != 2 {
+		t.Errorf("Entries over MaxBytes shouldn't be stored")
+	}
+}
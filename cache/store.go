@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"http"
+	"container/list"
+	"sync"
+)
+
+// A stored response
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// When the entry was stored and when it goes stale (nanoseconds)
+	Stored  int64
+	Expires int64
+	// Set on the index entry for responses that Vary.  These entries
+	// have no body and point at the variants.
+	Vary []string
+}
+
+// Rough memory use of the entry for eviction
+func (e *Entry) Size() int64 {
+	size := int64(len(e.Body)) + 64
+	for k, vs := range e.Header {
+		size += int64(len(k))
+		for _, v := range vs {
+			size += int64(len(v))
+		}
+	}
+	for _, v := range e.Vary {
+		size += int64(len(v))
+	}
+	return size
+}
+
+// Holds the cached responses.  Implementations must be safe to use
+// from multiple goroutines.
+type Store interface {
+	// nil if there's nothing stored for key
+	Get(key string) *Entry
+	Set(key string, e *Entry)
+	Remove(key string)
+}
+
+// The default in memory Store.  Least recently used entries are
+// evicted once the entries add up to more than MaxBytes.
+type MemoryStore struct {
+	MaxBytes int64
+
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	mutex   *sync.Mutex
+}
+
+type storeItem struct {
+	key   string
+	entry *Entry
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	s := new(MemoryStore)
+	s.MaxBytes = maxBytes
+	s.entries = make(map[string]*list.Element)
+	s.lru = list.New()
+	s.mutex = new(sync.Mutex)
+	return s
+}
+
+func (s *MemoryStore) Get(key string) *Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(el)
+		return el.Value.(*storeItem).entry
+	}
+	return nil
+}
+
+func (s *MemoryStore) Set(key string, e *Entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remove(key)
+	if e.Size() > s.MaxBytes {
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&storeItem{key, e})
+	s.size += e.Size()
+	for s.size > s.MaxBytes {
+		s.remove(s.lru.Back().Value.(*storeItem).key)
+	}
+}
+
+func (s *MemoryStore) Remove(key string) {
+	s.mutex.Lock()
+	s.remove(key)
+	s.mutex.Unlock()
+}
+
+func (s *MemoryStore) remove(key string) {
+	if el, ok := s.entries[key]; ok {
+		s.size -= el.Value.(*storeItem).entry.Size()
+		s.lru.Remove(el)
+		s.entries[key] = nil, false
+	}
+}
+
+// Number of entries stored
+func (s *MemoryStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lru.Len()
+}
+
+// Total Size of the stored entries
+func (s *MemoryStore) Bytes() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size
+}
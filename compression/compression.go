@@ -6,15 +6,28 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"strconv"
 	"compress/gzip"
 	"compress/flate"
 	"falcore"
 )
 
-var DefaultTypes = []string{"text/plain", "test/html", "application/json", "text/xml"}
+var DefaultTypes = []string{"text/plain", "text/html", "application/json", "text/xml"}
+
+// Content type prefixes that are already compressed and never worth
+// compressing again.
+var DefaultSkipTypes = []string{"image/", "video/", "audio/", "application/zip", "application/x-gzip"}
 
 type Filter struct {
 	types []string
+	// Content type prefixes that are never compressed
+	SkipTypes []string
+	// Responses with a known length below this many bytes aren't compressed
+	MinSize int64
+	// If set, decides instead of the type and size checks.  Returning
+	// false leaves the response exactly as it was.  Responses that
+	// already have a Content-Encoding are never compressed again.
+	ShouldCompress func(req *falcore.Request, res *http.Response) bool
 }
 
 func NewFilter(types []string) *Filter {
@@ -24,74 +37,129 @@ func NewFilter(types []string) *Filter {
 	} else {
 		f.types = DefaultTypes
 	}
+	f.SkipTypes = DefaultSkipTypes
 	return f
 }
 
 func (c *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
 	req := request.HttpRequest
-	if accept := req.Header.Get("Accept-Encoding"); accept != "" {
-
-		// Is content an acceptable type for encoding?
-		var compress = false
-		var content_type = res.Header.Get("Content-Type")
-		for _, t := range c.types {
-			if content_type == t {
-				compress = true
-				break
-			}
-		}
 
-		// Is the content already compressed
-		if res.Header.Get("Content-Encoding") != "" {
-			compress = false
-		}
-
-		if !compress {
-			request.CurrentStage.Status = 1 // Skip
-			return
-		}
+	if !c.shouldCompress(request, res) {
+		request.CurrentStage.Status = 1 // Skip
+		return
+	}
+	// The response depends on Accept-Encoding whether we compress this one or not
+	falcore.AddVary(res.Header, "Accept-Encoding")
 
+	if accept := req.Header.Get("Accept-Encoding"); accept != "" {
 		// Figure out which encoding to use
 		options := strings.Split(accept, ",")
 		var mode string
 		for _, opt := range options {
-			if m := strings.TrimSpace(opt); m == "gzip" || m == "deflate" {
+			parts := strings.Split(opt, ";")
+			if m := strings.TrimSpace(parts[0]); (m == "gzip" || m == "deflate") && !refused(parts[1:]) {
 				mode = m
 				break
 			}
 		}
 
-		var compressor io.WriteCloser
-		var buf = bytes.NewBuffer(make([]byte, 0, 1024))
-		switch mode {
-		case "gzip":
-			compressor, _ = gzip.NewWriter(buf)
-		case "deflate":
-			compressor = flate.NewWriter(buf, -1)
-		default:
+		if mode == "" {
 			request.CurrentStage.Status = 1 // Skip
 			return
 		}
 
-		// Perform compression
-		r := make([]byte, 1024)
-		var err os.Error
-		var i int
-		for err == nil {
-			i, err = res.Body.Read(r)
-			compressor.Write(r[0:i])
+		res.Header.Set("Content-Encoding", mode)
+		res.Header.Del("Content-Length")
+		if res.ContentLength < 0 {
+			// Unknown length.  Compress as it's sent rather than buffering it all.
+			res.Body = streamCompressed(res.Body, mode)
+			res.TransferEncoding = []string{"chunked"}
+			return
 		}
+
+		// Perform compression
+		var buf = bytes.NewBuffer(make([]byte, 0, 1024))
+		compressor := newCompressor(buf, mode)
+		io.Copy(compressor, res.Body)
 		compressor.Close()
 		res.Body.Close()
 
 		res.ContentLength = int64(buf.Len())
 		res.Body = (*filteredBody)(buf)
-		res.Header.Set("Content-Encoding", mode)
 	} else {
 		request.CurrentStage.Status = 1 // Skip
 	}
 }
 
+func (c *Filter) shouldCompress(request *falcore.Request, res *http.Response) bool {
+	if res.Body == nil {
+		return false
+	}
+	// Is the content already compressed
+	if res.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if c.ShouldCompress != nil {
+		return c.ShouldCompress(request, res)
+	}
+	return c.compressible(res)
+}
+
+// Is the response a type and size worth compressing
+func (c *Filter) compressible(res *http.Response) bool {
+	if res.ContentLength >= 0 && res.ContentLength < c.MinSize {
+		return false
+	}
+	// Is content an acceptable type for encoding?
+	var content_type = strings.TrimSpace(strings.SplitN(res.Header.Get("Content-Type"), ";", 2)[0])
+	for _, t := range c.SkipTypes {
+		if strings.HasPrefix(content_type, t) {
+			return false
+		}
+	}
+	for _, t := range c.types {
+		if content_type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks Accept-Encoding parameters for q=0
+func refused(params []string) bool {
+	for _, p := range params {
+		if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+			if q, err := strconv.Atof64(p[2:]); err == nil && q == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newCompressor(w io.Writer, mode string) (compressor io.WriteCloser) {
+	switch mode {
+	case "gzip":
+		compressor, _ = gzip.NewWriter(w)
+	case "deflate":
+		compressor = flate.NewWriter(w, -1)
+	}
+	return
+}
+
+// Compresses body in the background as the response is written out
+func streamCompressed(body io.ReadCloser, mode string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		compressor := newCompressor(pw, mode)
+		_, err := io.Copy(compressor, body)
+		compressor.Close()
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
 // wrapper type for Response struct
 
 type filteredBody bytes.Buffer
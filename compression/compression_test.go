@@ -15,6 +15,7 @@ import (
 	"compress/flate"
 	"net"
 	"time"
+	"strings"
 )
 
 var srv *falcore.Server
@@ -24,6 +25,14 @@ func init() {
 		// falcore setup
 		pipeline := falcore.NewPipeline()
 		pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+			if req.HttpRequest.URL.Path == "/stream" {
+				// unknown length body
+				res := falcore.SimpleResponse(req.HttpRequest, 200, nil, "")
+				res.Header.Set("Content-Type", "text/plain")
+				res.Body = &streamBody{strings.NewReader(streamData)}
+				res.ContentLength = -1
+				return res
+			}
 			for _, data := range serverData {
 				if data.path == req.HttpRequest.URL.Path {
 					header := make(http.Header)
@@ -189,3 +198,116 @@ func TestCompressionFilter(t *testing.T) {
 		}
 	}
 }
+
+var streamData = strings.Repeat("stream me please ", 1000)
+
+type streamBody struct {
+	r io.Reader
+}
+
+func (b *streamBody) Read(p []byte) (int, os.Error) {
+	return b.r.Read(p)
+}
+
+func (b *streamBody) Close() os.Error {
+	return nil
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, p := range []string{"/hello", "/stream"} {
+		for _, mode := range []string{"gzip", "deflate"} {
+			res, err := get(p, mode)
+			if err != nil {
+				t.Errorf("%v %v HTTP Error %v", p, mode, err)
+				continue
+			}
+			if res.Header.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("%v %v Missing Vary header: %q", p, mode, res.Header.Get("Vary"))
+			}
+			if enc := res.Header.Get("Content-Encoding"); enc != mode {
+				t.Errorf("%v %v Header mismatch. Expecting: %v Got: %v", p, mode, mode, enc)
+				continue
+			}
+			var body io.Reader
+			if mode == "gzip" {
+				if body, err = gzip.NewReader(res.Body); err != nil {
+					t.Errorf("%v %v Bad gzip stream: %v", p, mode, err)
+					continue
+				}
+			} else {
+				body = flate.NewReader(res.Body)
+			}
+			data, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Errorf("%v %v Error decompressing: %v", p, mode, err)
+			}
+			expected := "hello world"
+			if p == "/stream" {
+				expected = streamData
+			}
+			if string(data) != expected {
+				t.Errorf("%v %v Round trip mismatch", p, mode)
+			}
+		}
+	}
+}
+
+func TestCompressionSkip(t *testing.T) {
+	filter := NewFilter(nil)
+	filter.MinSize = 100
+
+	tmp, _ := http.NewRequest("GET", "/hello", nil)
+	tmp.Header.Set("Accept-Encoding", "gzip")
+	req := &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "text/plain")
+	res := falcore.SimpleResponse(tmp, 200, header, "too small")
+	filter.FilterResponse(req, res)
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Response below MinSize shouldn't be compressed")
+	}
+
+	header = make(http.Header)
+	header.Set("Content-Type", "image/png")
+	res = falcore.SimpleResponse(tmp, 200, header, strings.Repeat("x", 200))
+	filter.types = append(filter.types, "image/png")
+	filter.FilterResponse(req, res)
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Skipped content type shouldn't be compressed")
+	}
+
+	tmp.Header.Set("Accept-Encoding", "gzip;q=0")
+	header = make(http.Header)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	res = falcore.SimpleResponse(tmp, 200, header, strings.Repeat("x", 200))
+	filter.FilterResponse(req, res)
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Refused encoding shouldn't be used")
+	}
+}
+
+func TestShouldCompress(t *testing.T) {
+	filter := NewFilter(nil)
+	filter.ShouldCompress = func(req *falcore.Request, res *http.Response) bool {
+		return req.HttpRequest.URL.Path != "/raw"
+	}
+
+	for _, p := range []string{"/raw", "/cooked"} {
+		tmp, _ := http.NewRequest("GET", p, nil)
+		tmp.Header.Set("Accept-Encoding", "gzip")
+		req := &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+		// not a type the default checks would compress
+		header := http.Header{"Content-Type": {"application/octet-stream"}}
+		res := falcore.SimpleResponse(tmp, 200, header, strings.Repeat("x", 200))
+		filter.FilterResponse(req, res)
+
+		if p == "/raw" {
+			if len(res.Header) != 1 || res.ContentLength != 200 {
+				t.Errorf("Response should be untouched, got %v %v", res.Header, res.ContentLength)
+			}
+		} else if res.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("ShouldCompress should override the type check")
+		}
+	}
+}
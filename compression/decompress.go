@@ -0,0 +1,115 @@
+package compression
+
+import (
+	"http"
+	"io"
+	"os"
+	"strings"
+	"compress/gzip"
+	"compress/flate"
+	"falcore"
+)
+
+// The limit for a RequestDecompressFilter without MaxBytes
+const DefaultDecompressMaxBytes = 10 << 20
+
+// Set in the Request.Context once a decompressed body passes the limit
+const bodyTooLargeKey = "compression.too_large"
+
+// falcore/compression.RequestDecompressFilter decompresses request
+// bodies sent with a gzip or deflate Content-Encoding so the filters
+// after it read plain bytes.  The Content-Encoding and Content-Length
+// headers are removed.  Other encodings get a '415 Unsupported Media
+// Type' and bodies that aren't valid gzip a 400.
+//
+// A small body can decompress to a huge one, so reads fail with
+// falcore.ErrBodyTooLarge once MaxBytes have come out.  MaxBytes of 0
+// means DefaultDecompressMaxBytes (10MB).  To turn that into a
+// 413, add the same filter to the Downstream list as well, like
+// body_limit.  That works even if a later filter wrapped or buffered
+// the body (see Request.BufferBody).
+type RequestDecompressFilter struct {
+	MaxBytes int64
+}
+
+func NewRequestDecompressFilter(maxBytes int64) *RequestDecompressFilter {
+	return &RequestDecompressFilter{MaxBytes: maxBytes}
+}
+
+func (f *RequestDecompressFilter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || req.Body == nil {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			request.CurrentStage.Status = 2 // Fail
+			return falcore.SimpleResponse(req, 400, nil, "Bad Request\n")
+		}
+		r = gz
+	case "deflate":
+		r = flate.NewReader(req.Body)
+	default:
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.SimpleResponse(req, 415, nil, "Unsupported Media Type\n")
+	}
+	limit := f.MaxBytes
+	if limit <= 0 {
+		limit = DefaultDecompressMaxBytes
+	}
+	req.Body = &decompressedBody{r: r, body: req.Body, remaining: limit, request: request}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	return nil
+}
+
+func (f *RequestDecompressFilter) FilterResponse(request *falcore.Request, res *http.Response) {
+	request.CurrentStage.Status = 1 // Skip
+	if _, exceeded := request.Context[bodyTooLargeKey]; exceeded {
+		if res.Body != nil {
+			res.Body.Close()
+		}
+		*res = *falcore.SimpleResponse(request.HttpRequest, 413, nil, "Request Entity Too Large\n")
+		// the rest of the body is still on the wire
+		res.Close = true
+		request.CurrentStage.Status = 2 // Fail
+	}
+}
+
+// Decompresses the request body and fails reads past the limit
+type decompressedBody struct {
+	r         io.Reader
+	body      io.ReadCloser
+	remaining int64
+	exceeded  bool
+	request   *falcore.Request
+}
+
+func (b *decompressedBody) Read(p []byte) (n int, err os.Error) {
+	if b.exceeded {
+		return 0, falcore.ErrBodyTooLarge
+	}
+	// read one extra byte so we can tell when the limit is passed
+	if int64(len(p)) > b.remaining+1 {
+		p = p[0 : b.remaining+1]
+	}
+	n, err = b.r.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.exceeded = true
+		b.request.Context[bodyTooLargeKey] = true
+		err = falcore.ErrBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return
+}
+
+func (b *decompressedBody) Close() os.Error {
+	return b.body.Close()
+}
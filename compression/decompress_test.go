@@ -0,0 +1,91 @@
+package compression
+
+import (
+	"bytes"
+	"falcore"
+	"http"
+	"io/ioutil"
+	"testing"
+)
+
+func compressedRequest(encoding string, body []byte) *falcore.Request {
+	tmp, _ := http.NewRequest("POST", "/upload", bytes.NewBuffer(body))
+	tmp.ContentLength = int64(len(body))
+	tmp.Header.Set("Content-Encoding", encoding)
+	return &falcore.Request{
+		HttpRequest:  tmp,
+		CurrentStage: falcore.NewPiplineStage("test"),
+		Context:      make(map[string]interface{}),
+	}
+}
+
+func TestRequestDecompress(t *testing.T) {
+	f := NewRequestDecompressFilter(1000)
+	plain := []byte("hello hello hello hello")
+	for encoding, body := range map[string][]byte{"gzip": compress_gzip(plain), "deflate": compress_deflate(plain)} {
+		req := compressedRequest(encoding, body)
+		if res := f.FilterRequest(req); res != nil {
+			t.Fatalf("%v Expected no response, got %v", encoding, res.StatusCode)
+		}
+		got, err := ioutil.ReadAll(req.HttpRequest.Body)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%v Expected the plain body, got %q %v", encoding, got, err)
+		}
+		if req.HttpRequest.Header.Get("Content-Encoding") != "" || req.HttpRequest.ContentLength != -1 {
+			t.Errorf("%v Content-Encoding and length should be gone", encoding)
+		}
+	}
+
+	// a bomb
+	req := compressedRequest("gzip", compress_gzip(make([]byte, 1<<20)))
+	f.FilterRequest(req)
+	if _, err := ioutil.ReadAll(req.HttpRequest.Body); err != falcore.ErrBodyTooLarge {
+		t.Errorf("Expected ErrBodyTooLarge, got %v", err)
+	}
+	res := falcore.SimpleResponse(req.HttpRequest, 200, nil, "ok")
+	f.FilterResponse(req, res)
+	if res.StatusCode != 413 {
+		t.Errorf("Expected a 413 after the limit, got %v", res.StatusCode)
+	}
+
+	if res := f.FilterRequest(compressedRequest("br", plain)); res == nil || res.StatusCode != 415 {
+		t.Errorf("Expected a 415 for an unknown encoding, got %v", res)
+	}
+	if res := f.FilterRequest(compressedRequest("gzip", plain)); res == nil || res.StatusCode != 400 {
+		t.Errorf("Expected a 400 for a body that isn't gzip, got %v", res)
+	}
+}
+
+func TestRequestDecompressDefaultLimit(t *testing.T) {
+	f := new(RequestDecompressFilter)
+	plain := []byte("hello hello hello hello")
+	req := compressedRequest("gzip", compress_gzip(plain))
+	f.FilterRequest(req)
+	if got, err := ioutil.ReadAll(req.HttpRequest.Body); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("Zero value filter should use the default limit, got %q %v", got, err)
+	}
+
+	req = compressedRequest("gzip", compress_gzip(make([]byte, DefaultDecompressMaxBytes+1)))
+	f.FilterRequest(req)
+	if _, err := ioutil.ReadAll(req.HttpRequest.Body); err != falcore.ErrBodyTooLarge {
+		t.Errorf("Expected ErrBodyTooLarge past the default limit, got %v", err)
+	}
+}
+
+func TestRequestDecompressBuffered(t *testing.T) {
+	f := NewRequestDecompressFilter(1000)
+	p := falcore.NewPipeline()
+	p.Upstream.PushBack(f)
+	// like signature or method override, replaces the body
+	p.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		req.BufferBody(1 << 20)
+		return falcore.SimpleResponse(req.HttpRequest, 200, nil, "handled")
+	}))
+	p.Downstream.PushBack(f)
+
+	tmp, _ := http.NewRequest("POST", "/upload", bytes.NewBuffer(compress_gzip(make([]byte, 1<<20))))
+	tmp.Header.Set("Content-Encoding", "gzip")
+	if _, res := p.TestWithRequest(tmp); res.StatusCode != 413 {
+		t.Errorf("Expected a 413 after the body was buffered, got %v", res.StatusCode)
+	}
+}
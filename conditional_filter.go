@@ -0,0 +1,37 @@
+package falcore
+
+import (
+	"http"
+	"time"
+)
+
+// Runs Filter only for requests Predicate returns true for.  Otherwise
+// the stage is marked Skip (Status 1) and the pipeline moves on to the
+// next filter.
+//
+// Filter runs as part of the ConditionalFilter's stage.  Set
+// RecordSkipped to also add a Skip stage for Filter (see NamedFilter) when it
+// doesn't run, so it shows up in the stats and the Signature either way.
+type ConditionalFilter struct {
+	Filter        RequestFilter
+	Predicate     func(req *Request) bool
+	RecordSkipped bool
+}
+
+func NewConditionalFilter(filter RequestFilter, predicate func(req *Request) bool) *ConditionalFilter {
+	return &ConditionalFilter{Filter: filter, Predicate: predicate}
+}
+
+func (f *ConditionalFilter) FilterRequest(request *Request) *http.Response {
+	if f.Predicate(request) {
+		return f.Filter.FilterRequest(request)
+	}
+	request.CurrentStage.Status = 1 // Skip
+	if f.RecordSkipped {
+		pss := NewPiplineStage(filterName(f.Filter))
+		pss.Status = 1
+		pss.EndTime = time.Nanoseconds()
+		request.appendPipelineStage(pss)
+	}
+	return nil
+}
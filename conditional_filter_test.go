@@ -0,0 +1,50 @@
+package falcore
+
+import (
+	"http"
+	"testing"
+)
+
+func TestConditionalFilter(t *testing.T) {
+	onlyPost := func(req *Request) bool { return req.HttpRequest.Method == "POST" }
+	p := NewPipeline()
+	p.Upstream.PushBack(NewConditionalFilter(NewRequestFilter(successFilter), onlyPost))
+
+	// skipped, so the pipeline falls through to the 404
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 404 {
+		t.Errorf("Expected the filter to be skipped, got %v", res.StatusCode)
+	}
+	if req.PipelineStageStats.Len() != 1 {
+		t.Errorf("Expected just the ConditionalFilter stage, got %v", req.PipelineStageStats.Len())
+	}
+	if pss := req.PipelineStageStats.Front().Value.(*PipelineStageStat); pss.Status != 1 {
+		t.Errorf("Skipped stage should have Status 1, got %v", pss.Status)
+	}
+
+	tmp, _ := http.NewRequest("POST", "/hello", nil)
+	if res := p.execute(newRequest(tmp, nil, 0)); res.StatusCode != 200 {
+		t.Errorf("Expected the filter to run, got %v", res.StatusCode)
+	}
+}
+
+func TestConditionalFilterRecordSkipped(t *testing.T) {
+	never := func(req *Request) bool { return false }
+	f := NewConditionalFilter(NewRequestFilter(successFilter), never)
+	f.RecordSkipped = true
+	p := NewPipeline()
+	p.Upstream.PushBack(f)
+
+	req := validGetRequest()
+	p.execute(req)
+	if req.PipelineStageStats.Len() != 2 {
+		t.Fatalf("Expected a stage for the skipped filter, got %v", req.PipelineStageStats.Len())
+	}
+	skipped := req.PipelineStageStats.Back().Value.(*PipelineStageStat)
+	if skipped.Name != "*falcore.genericRequestFilter" || skipped.Status != 1 {
+		t.Errorf("Bad skipped stage: %v %v", skipped.Name, skipped.Status)
+	}
+	if wrapper := req.PipelineStageStats.Front().Value.(*PipelineStageStat); wrapper.EndTime == 0 {
+		t.Errorf("The ConditionalFilter's own stage wasn't finished")
+	}
+}
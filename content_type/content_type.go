@@ -0,0 +1,62 @@
+package content_type
+
+import (
+	"http"
+	"strings"
+	"falcore"
+)
+
+// falcore/content_type.Filter rejects request bodies that aren't one
+// of the Allowed media types with a '415 Unsupported Media Type', so a
+// JSON endpoint fails fast instead of with a parse error further down.
+//
+// Types are compared without case or parameters, so "application/json"
+// allows "application/json; charset=utf-8".  "text/*" allows any text
+// type.  Requests without a body, like most GETs and HEADs, aren't
+// checked.  A body without a Content-Type is rejected.
+type Filter struct {
+	Allowed []string
+}
+
+func NewFilter(allowed ...string) *Filter {
+	return &Filter{Allowed: allowed}
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	if req.ContentLength == 0 && len(req.TransferEncoding) == 0 {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	if f.Allows(req.Header.Get("Content-Type")) {
+		return nil
+	}
+	request.CurrentStage.Status = 2 // Fail
+	return falcore.SimpleResponse(req, 415, nil, "Unsupported Media Type\n")
+}
+
+// Whether contentType is one of the Allowed types
+func (f *Filter) Allows(contentType string) bool {
+	t := mediaType(contentType)
+	if t == "" {
+		return false
+	}
+	for _, allowed := range f.Allowed {
+		allowed = mediaType(allowed)
+		if allowed == t {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(t, allowed[0:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// The type without parameters, lower cased
+func mediaType(v string) string {
+	if i := strings.Index(v, ";"); i >= 0 {
+		v = v[0:i]
+	}
+	return strings.ToLower(strings.TrimSpace(v))
+}
@@ -0,0 +1,41 @@
+package content_type
+
+import (
+	"falcore"
+	"http"
+	"strings"
+	"testing"
+)
+
+func TestContentType(t *testing.T) {
+	f := NewFilter("application/json", "text/*")
+	tests := []struct {
+		method      string
+		body        string
+		contentType string
+		status      int
+	}{
+		{"POST", "{}", "application/json", 0},
+		{"POST", "{}", "Application/JSON; charset=utf-8", 0},
+		{"PUT", "hi", "text/plain", 0},
+		{"POST", "a=b", "application/x-www-form-urlencoded", 415},
+		{"POST", "{}", "", 415},
+		{"GET", "", "", 0},
+		{"POST", "", "image/png", 0},
+	}
+	for _, test := range tests {
+		tmp, _ := http.NewRequest(test.method, "/api", strings.NewReader(test.body))
+		tmp.ContentLength = int64(len(test.body))
+		if test.contentType != "" {
+			tmp.Header.Set("Content-Type", test.contentType)
+		}
+		req := &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+		res := f.FilterRequest(req)
+		switch {
+		case test.status == 0 && res != nil:
+			t.Errorf("%v %q Expected no response, got %v", test.method, test.contentType, res.StatusCode)
+		case test.status != 0 && (res == nil || res.StatusCode != test.status):
+			t.Errorf("%v %q Expected status %v, got %v", test.method, test.contentType, test.status, res)
+		}
+	}
+}
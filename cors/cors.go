@@ -0,0 +1,155 @@
+package cors
+
+import (
+	"http"
+	"strconv"
+	"strings"
+	"falcore"
+)
+
+// falcore/cors.Filter handles Cross-Origin Resource Sharing.
+//
+// Add it to the Upstream list to answer preflight OPTIONS requests.
+// Preflights always get a response from the filter so they never reach
+// the rest of the pipeline.  Add the same Filter to the Downstream list
+// to put the CORS headers on actual responses.
+//
+// AllowedOrigins can contain "*" to allow any origin.  When
+// AllowCredentials is set the request's Origin is echoed back instead
+// of "*" since browsers refuse credentialed responses with a wildcard.
+//
+// Every response the Filter sees gets 'Vary: Origin', allowed or not,
+// so a shared cache never hands one origin's answer to another.
+type Filter struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// Seconds a preflight can be cached.  Not sent if 0
+	MaxAge int
+}
+
+// Create a Filter for origins allowing GET, HEAD and POST
+func NewFilter(origins ...string) *Filter {
+	f := new(Filter)
+	f.AllowedOrigins = origins
+	f.AllowedMethods = []string{"GET", "HEAD", "POST"}
+	return f
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	if !isPreflight(req) {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+
+	origin := f.allowOrigin(req.Header.Get("Origin"))
+	if origin == "" || !f.allowMethod(req.Header.Get("Access-Control-Request-Method")) ||
+		!f.allowHeaders(req.Header.Get("Access-Control-Request-Headers")) {
+		// answer without any CORS headers and the browser will block it
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.SimpleResponse(req, 204, http.Header{"Vary": {"Origin"}}, "")
+	}
+
+	res := falcore.SimpleResponse(req, 204, http.Header{"Vary": {"Origin"}}, "")
+	f.setOriginHeaders(res.Header, origin)
+	res.Header.Set("Access-Control-Allow-Methods", strings.Join(f.AllowedMethods, ", "))
+	if reqHeaders := req.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+		res.Header.Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+	if f.MaxAge > 0 {
+		res.Header.Set("Access-Control-Max-Age", strconv.Itoa(f.MaxAge))
+	}
+	return res
+}
+
+func (f *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
+	req := request.HttpRequest
+	if isPreflight(req) {
+		request.CurrentStage.Status = 1 // Skip
+		return
+	}
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	// with or without CORS headers, the response depends on the Origin
+	falcore.AddVary(res.Header, "Origin")
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		request.CurrentStage.Status = 1 // Skip
+		return
+	}
+	if allowed := f.allowOrigin(origin); allowed != "" {
+		f.setOriginHeaders(res.Header, allowed)
+		if len(f.ExposedHeaders) > 0 {
+			res.Header.Set("Access-Control-Expose-Headers", strings.Join(f.ExposedHeaders, ", "))
+		}
+	} else {
+		request.CurrentStage.Status = 2 // Fail
+	}
+}
+
+func (f *Filter) setOriginHeaders(h http.Header, origin string) {
+	h.Set("Access-Control-Allow-Origin", origin)
+	if f.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Returns the value for Access-Control-Allow-Origin or "" if origin
+// isn't allowed
+func (f *Filter) allowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, o := range f.AllowedOrigins {
+		if o == "*" {
+			if f.AllowCredentials {
+				return origin
+			}
+			return "*"
+		}
+		if strings.ToLower(o) == strings.ToLower(origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+func (f *Filter) allowMethod(method string) bool {
+	for _, m := range f.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Every header in the comma separated list must be allowed.  An
+// AllowedHeaders entry of "*" allows anything.
+func (f *Filter) allowHeaders(headers string) bool {
+	for _, h := range strings.Split(headers, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		found := false
+		for _, a := range f.AllowedHeaders {
+			if a == "*" || http.CanonicalHeaderKey(a) == http.CanonicalHeaderKey(h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package cors
+
+import (
+	"falcore"
+	"http"
+	"testing"
+)
+
+func corsRequest(method, origin string, headers map[string]string) *falcore.Request {
+	tmp, _ := http.NewRequest(method, "/api", nil)
+	if origin != "" {
+		tmp.Header.Set("Origin", origin)
+	}
+	for k, v := range headers {
+		tmp.Header.Set(k, v)
+	}
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestPreflight(t *testing.T) {
+	f := NewFilter("http://example.com")
+	f.AllowedHeaders = []string{"X-Token"}
+	f.MaxAge = 600
+
+	req := corsRequest("OPTIONS", "http://example.com", map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "x-token",
+	})
+	res := f.FilterRequest(req)
+	if res == nil {
+		t.Fatalf("Preflight should short circuit the pipeline")
+	}
+	if res.StatusCode != 204 {
+		t.Errorf("Expected status 204, got %v", res.StatusCode)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "http://example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD, POST",
+		"Access-Control-Allow-Headers": "x-token",
+		"Access-Control-Max-Age":       "600",
+	}
+	for k, v := range expected {
+		if res.Header.Get(k) != v {
+			t.Errorf("Expected %v: '%v', got '%v'", k, v, res.Header.Get(k))
+		}
+	}
+}
+
+func TestPreflightRejected(t *testing.T) {
+	f := NewFilter("http://example.com")
+
+	tests := []*falcore.Request{
+		corsRequest("OPTIONS", "http://evil.com", map[string]string{"Access-Control-Request-Method": "GET"}),
+		corsRequest("OPTIONS", "http://example.com", map[string]string{"Access-Control-Request-Method": "DELETE"}),
+		corsRequest("OPTIONS", "http://example.com", map[string]string{
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "X-Secret",
+		}),
+	}
+	for i, req := range tests {
+		res := f.FilterRequest(req)
+		if res == nil {
+			t.Errorf("%v Rejected preflight should still short circuit", i)
+			continue
+		}
+		if res.Header.Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%v Rejected preflight shouldn't allow the origin", i)
+		}
+		if res.Header.Get("Vary") != "Origin" {
+			t.Errorf("%v Rejected preflight should Vary on Origin", i)
+		}
+	}
+}
+
+func TestNotPreflight(t *testing.T) {
+	f := NewFilter("*")
+	if res := f.FilterRequest(corsRequest("OPTIONS", "", nil)); res != nil {
+		t.Errorf("OPTIONS without CORS headers should pass through")
+	}
+	if res := f.FilterRequest(corsRequest("GET", "http://example.com", nil)); res != nil {
+		t.Errorf("Actual requests should pass through")
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	f := NewFilter("*")
+	f.ExposedHeaders = []string{"X-Total"}
+
+	req := corsRequest("GET", "http://example.com", nil)
+	res := falcore.SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	f.FilterResponse(req, res)
+	if res.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected wildcard origin, got '%v'", res.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if res.Header.Get("Access-Control-Expose-Headers") != "X-Total" {
+		t.Errorf("Missing Access-Control-Expose-Headers")
+	}
+
+	// credentialed responses can't use the wildcard
+	f.AllowCredentials = true
+	res = falcore.SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	f.FilterResponse(req, res)
+	if res.Header.Get("Access-Control-Allow-Origin") != "http://example.com" {
+		t.Errorf("Expected echoed origin, got '%v'", res.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if res.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Missing Access-Control-Allow-Credentials")
+	}
+	if res.Header.Get("Vary") != "Origin" {
+		t.Errorf("Echoed origin should Vary on Origin")
+	}
+
+	f = NewFilter("http://example.com")
+	req = corsRequest("GET", "http://evil.com", nil)
+	res = falcore.SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	f.FilterResponse(req, res)
+	if res.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Disallowed origin got CORS headers")
+	}
+	if res.Header.Get("Vary") != "Origin" {
+		t.Errorf("Disallowed origin should still Vary on Origin")
+	}
+
+	req = corsRequest("GET", "", nil)
+	res = falcore.SimpleResponse(req.HttpRequest, 200, http.Header{"Vary": {"Accept-Encoding"}}, "OK")
+	f.FilterResponse(req, res)
+	if vary := falcore.VaryHeaders(res.Header); len(vary) != 2 || vary[1] != "Origin" {
+		t.Errorf("Requests without an Origin should Vary on Origin too, got %v", vary)
+	}
+}
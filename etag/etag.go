@@ -2,6 +2,13 @@ package etag
 
 import (
 	"http"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 	"falcore"
 )
 
@@ -15,12 +22,23 @@ import (
 // Even as a last step, you will see a significant benefit if
 // clients are well behaved.
 // 
+// With Generate set, 200 responses to GET requests that don't have an
+// Etag get a strong one made by hashing the body, so dynamic handlers
+// get 304s without setting their own validators.  The response still
+// has to be generated but the body isn't sent again.  Only bodies with
+// a known length up to MaxBytes (64KB by default) are hashed since
+// they're read into memory to do it.  Responses with 'Cache-Control:
+// no-store' are left alone.
 type Filter struct {
-
+	Generate bool
+	MaxBytes int64
 }
 
 func (f *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
 	request.CurrentStage.Status = 1 // Skipped (default)
+	if f.Generate {
+		f.generate(request.HttpRequest, res)
+	}
 	if if_none_match := request.HttpRequest.Header.Get("If-None-Match"); if_none_match != "" {
 		if res.StatusCode == 200 && res.Header.Get("Etag") == if_none_match {
 			res.StatusCode = 304
@@ -32,3 +50,39 @@ func (f *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
 		}
 	}
 }
+
+func (f *Filter) generate(req *http.Request, res *http.Response) {
+	if req.Method != "GET" || res.StatusCode != 200 || res.Body == nil || res.Header.Get("Etag") != "" {
+		return
+	}
+	max := f.MaxBytes
+	if max <= 0 {
+		max = 64 << 10
+	}
+	if res.ContentLength < 0 || res.ContentLength > max {
+		return
+	}
+	if strings.Contains(strings.ToLower(res.Header.Get("Cache-Control")), "no-store") {
+		return
+	}
+	original := res.Body
+	data, err := ioutil.ReadAll(io.LimitReader(original, res.ContentLength+1))
+	// whatever happened, the client still gets the whole body
+	res.Body = &readBody{io.MultiReader(bytes.NewBuffer(data), original), original}
+	if err != nil || int64(len(data)) != res.ContentLength {
+		return
+	}
+	h := sha1.New()
+	h.Write(data)
+	res.Header.Set("Etag", fmt.Sprintf("\"%x\"", h.Sum()))
+}
+
+// A response body that has been read into memory, or partly
+type readBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *readBody) Close() os.Error {
+	return b.closer.Close()
+}
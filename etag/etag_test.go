@@ -129,3 +129,37 @@ func TestEtagFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerate(t *testing.T) {
+	f := &Filter{Generate: true, MaxBytes: 20}
+	run := func(body, ifNoneMatch string) *http.Response {
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		if ifNoneMatch != "" {
+			tmp.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		req := &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+		res := falcore.SimpleResponse(tmp, 200, nil, body)
+		f.FilterResponse(req, res)
+		return res
+	}
+
+	res := run("dynamic", "")
+	etag := res.Header.Get("Etag")
+	if len(etag) != 42 || etag[0] != '"' {
+		t.Fatalf("Expected a quoted sha1 Etag, got %q", etag)
+	}
+	body := new(bytes.Buffer)
+	io.Copy(body, res.Body)
+	if body.String() != "dynamic" {
+		t.Errorf("Body was lost hashing it, got %q", body.String())
+	}
+	if again := run("dynamic", "").Header.Get("Etag"); again != etag {
+		t.Errorf("Etag should be stable, got %q then %q", etag, again)
+	}
+	if res = run("dynamic", etag); res.StatusCode != 304 {
+		t.Errorf("Expected a 304 for a matching If-None-Match, got %v", res.StatusCode)
+	}
+	if res = run("this body is over the limit", ""); res.Header.Get("Etag") != "" {
+		t.Errorf("Bodies over MaxBytes shouldn't be hashed")
+	}
+}
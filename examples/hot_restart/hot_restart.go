@@ -4,7 +4,6 @@ import (
 	"falcore"
 	"fmt"
 	"http"
-	"flag"
 	"os/signal"
 	"os"
 	"syscall"
@@ -15,12 +14,8 @@ func Filter(request *falcore.Request) *http.Response {
 	return falcore.SimpleResponse(request.HttpRequest, 200, nil, "OK\n")
 }
 
-// flag to accept a socket file descriptor
-var socketFd = flag.Int("socket", -1, "Socket file descriptor")
-
 func main() {
 	pid := syscall.Getpid()
-	flag.Parse()
 
 	// create the pipeline
 	pipeline := falcore.NewPipeline()
@@ -32,11 +27,11 @@ func main() {
 	// if passed the socket file descriptor, setup the listener that way
 	// if you don't have it, the default is to create the socket listener
 	// with the data passed to falcore.NewServer above (happens in ListenAndServer())
-	if *socketFd != -1 {
+	if fd := falcore.ListenFd(); fd != -1 {
 		// I know I'm a child process if I get here so I can signal the parent when I'm ready to take over
-		go childReady(srv)
-		fmt.Printf("%v Got socket FD: %v\n", pid, *socketFd)
-		srv.FdListen(*socketFd)
+		go srv.SignalParentReady()
+		fmt.Printf("%v Got socket FD: %v\n", pid, fd)
+		srv.FdListen(fd)
 	}
 
 	// using signals to manage the restart lifecycle
@@ -50,30 +45,6 @@ func main() {
 	fmt.Printf("%v Exiting now\n", pid)
 }
 
-// blocks on the server ready and when ready, it sends 
-// a signal to the parent so that it knows it cna now exit
-func childReady(srv *falcore.Server) {
-	pid := syscall.Getpid()
-	// wait for the ready signal
-	<-srv.AcceptReady
-	// grab the parent and send a signal that the child is ready
-	parent := syscall.Getppid()
-	fmt.Printf("%v Kill parent %v with SIGUSR1\n", pid, parent)
-	syscall.Kill(parent, syscall.SIGUSR1)
-}
-
-// setup and fork/exec myself. Make sure to keep open important FD's that won't get re-created by the child
-// specifically, std* and your listen socket
-func forker(srv *falcore.Server) (pid int, err int) {
-	fmt.Printf("Forking now with socket: %v\n", srv.SocketFd())
-	mypath := os.Args[0]
-	args := []string{mypath, "-socket", fmt.Sprintf("%v", srv.SocketFd())}
-	attr := new(syscall.ProcAttr)
-	attr.Files = append([]int(nil), 0, 1, 2, srv.SocketFd())
-	pid, err = syscall.ForkExec(mypath, args, attr)
-	return
-}
-
 // Handle lifecycle events
 func handleSignals(srv *falcore.Server) {
 	var sig os.Signal
@@ -85,12 +56,15 @@ func handleSignals(srv *falcore.Server) {
 			case os.SIGHUP:
 				// send this to the paraent process to initiate the restart
 				fmt.Println(pid, "Received SIGHUP.  forking.")
-				cpid, err := forker(srv)
-				fmt.Println(pid, "Forked pid:", cpid, "errno:", err)
+				if child, err := srv.Restart(); err == nil {
+					fmt.Println(pid, "Forked pid:", child.Pid)
+				} else {
+					fmt.Println(pid, "Fork failed:", err)
+				}
 			case os.SIGUSR1:
 				// child sends this back to the parent when it's ready to Accept
-				fmt.Println(pid, "Received SIGUSR1.  Stopping accept.")
-				srv.StopAccepting()
+				fmt.Println(pid, "Received SIGUSR1.  Draining.")
+				go srv.Shutdown(30e9)
 			case os.SIGINT:
 				fmt.Println(pid, "Received SIGINT.  Shutting down.")
 				os.Exit(0)
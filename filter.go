@@ -2,11 +2,19 @@ package falcore
 
 import (
 	"http"
+	"os"
+	"reflect"
 )
 
 // Filter incomming requests and optionally return a response or nil.  
 // Filters are chained together into a flow (the Pipeline) which will terminate
 // if the Filter returns a response.  
+//
+// Returning nil means "continue": the next Upstream filter gets the
+// request, along with any changes made to it.  Returning a response
+// short circuits the rest of the Upstream and sends the response
+// through the Downstream.  See ModifyRequestFilter for filters that
+// only change the request.
 type RequestFilter interface {
 	FilterRequest(req *Request) *http.Response
 }
@@ -30,6 +38,79 @@ func (f *genericRequestFilter) FilterRequest(req *Request) *http.Response {
 	return f.f(req)
 }
 
+// An os.Error with the status it should be answered with, for filters
+// made with NewValueFilter.  Other errors get a 500.
+type StatusError struct {
+	Status int
+	Err    os.Error
+}
+
+func (e *StatusError) String() string {
+	if e.Err == nil {
+		return http.StatusText(e.Status)
+	}
+	return e.Err.String()
+}
+
+// Helper to create a Filter that computes a value or fails.  The
+// value is sent as JSON with a 200, an *http.Response is sent as is
+// and nil continues to the next filter.  An error gets an
+// ErrorResponse with the status from a StatusError (500 for other
+// errors), which the Pipeline's ErrorHandlers can replace.  They can
+// get the error from Request.FilterError.  500s are logged.
+//    filter = NewValueFilter(func(req *Request) (interface{}, os.Error) {
+//			user, ok := users[req.HttpRequest.URL.Path]
+//			if !ok {
+//				return nil, &StatusError{404, os.NewError("no such user")}
+//			}
+//			return user, nil
+//		})
+func NewValueFilter(f func(req *Request) (interface{}, os.Error)) RequestFilter {
+	return &valueFilter{f}
+}
+
+type valueFilter struct {
+	f func(req *Request) (interface{}, os.Error)
+}
+
+func (f *valueFilter) FilterRequest(req *Request) *http.Response {
+	v, err := f.f(req)
+	if err != nil {
+		status := 500
+		if se, ok := err.(*StatusError); ok && se.Status >= 400 {
+			status = se.Status
+		}
+		if status >= 500 {
+			req.Logf(ERROR, "Filter failed: %v", err)
+		}
+		req.filterError = err
+		// nil when called directly instead of from a Pipeline
+		if req.CurrentStage != nil {
+			req.CurrentStage.Status = 2 // Fail
+		}
+		return ErrorResponse(req.HttpRequest, status)
+	}
+	switch r := v.(type) {
+	case nil:
+		return nil
+	case *http.Response:
+		return r
+	}
+	return JSONResponse(req.HttpRequest, 200, nil, v)
+}
+
+// A RequestFilter that only changes the request, like adding headers
+// or rewriting the path, and always continues to the next filter.
+//    filter = ModifyRequestFilter(func(req *Request) {
+//			req.HttpRequest.URL.Path = "/v2" + req.HttpRequest.URL.Path
+//		})
+type ModifyRequestFilter func(req *Request)
+
+func (f ModifyRequestFilter) FilterRequest(req *Request) *http.Response {
+	f(req)
+	return nil
+}
+
 // Filter outgoing responses. This can be used to modify the response
 // before it is sent.  Modifying the request at this point will have no
 // effect. 
@@ -55,3 +136,18 @@ type genericResponseFilter struct {
 func (f *genericResponseFilter) FilterResponse(req *Request, res *http.Response) {
 	f.f(req, res)
 }
+
+// Filters (and Routers) can implement NamedFilter to choose how they
+// show up in PipelineStageStats, the Signature and log messages.
+// Without it the type name is used, like "*falcore.TimeoutFilter".
+type NamedFilter interface {
+	FilterName() string
+}
+
+// The name for a filter's stage
+func filterName(filter interface{}) string {
+	if named, ok := filter.(NamedFilter); ok {
+		return named.FilterName()
+	}
+	return reflect.TypeOf(filter).String()
+}
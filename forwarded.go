@@ -0,0 +1,161 @@
+package falcore
+
+import (
+	"http"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An address range, like a Server.TrustedProxies entry
+type IPNet struct {
+	ip   net.IP
+	mask net.IPMask
+}
+
+// Parses "10.0.0.0/8", "2001:db8::/32" or a single address
+func ParseCIDR(s string) (*IPNet, os.Error) {
+	addr, bits := s, -1
+	if i := strings.Index(s, "/"); i >= 0 {
+		addr = s[0:i]
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 0 {
+			return nil, os.NewError("falcore: bad CIDR " + s)
+		}
+		bits = n
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, os.NewError("falcore: bad address " + s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if bits < 0 {
+		bits = len(ip) * 8
+	}
+	if bits > len(ip)*8 {
+		return nil, os.NewError("falcore: bad CIDR " + s)
+	}
+	mask := make(net.IPMask, len(ip))
+	for i := 0; i < bits; i++ {
+		mask[i/8] |= 0x80 >> uint(i%8)
+	}
+	return &IPNet{ip.Mask(mask), mask}, nil
+}
+
+// True if ip is in the range.  IPv4 addresses never match IPv6 ranges.
+func (n *IPNet) Contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if len(ip) != len(n.ip) {
+		return false
+	}
+	for i := range ip {
+		if ip[i]&n.mask[i] != n.ip[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// True if addr (host:port) is one of the TrustedProxies
+func (srv *Server) trustedProxy(addr string) bool {
+	if len(srv.trustedNets) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && inNets(srv.trustedNets, ip)
+}
+
+func inNets(nets []*IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The scheme the client used, "http" or "https".  Requests from one of
+// the Server's TrustedProxies can set it with X-Forwarded-Proto.  Only
+// the last value counts, the one the proxy added.  Anything before it
+// came from the client.  Otherwise it comes from the connection's TLS
+// state.
+func (fReq *Request) Scheme() string {
+	if fReq.fromTrustedProxy {
+		switch proto := strings.ToLower(lastValue(fReq.HttpRequest.Header, "X-Forwarded-Proto")); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	if fReq.TLS() != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// The host the client asked for.  Requests from one of the Server's
+// TrustedProxies can set it with X-Forwarded-Host, the last value like
+// Scheme.  Otherwise it's the Host header.
+func (fReq *Request) Host() string {
+	if fReq.fromTrustedProxy {
+		if host := lastValue(fReq.HttpRequest.Header, "X-Forwarded-Host"); host != "" {
+			return host
+		}
+	}
+	return fReq.HttpRequest.Host
+}
+
+// The client's address.  Requests from one of the Server's
+// TrustedProxies can set it with X-Forwarded-For: the last address in
+// it that isn't a trusted proxy is the client.  With the Server's
+// ProxyProtocol on, the connection's address already comes from the
+// PROXY header.  nil if the address can't be parsed.
+func (fReq *Request) ClientIP() net.IP {
+	host, _, err := net.SplitHostPort(fReq.HttpRequest.RemoteAddr)
+	if err != nil {
+		host = fReq.HttpRequest.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !fReq.fromTrustedProxy {
+		return ip
+	}
+	var hops []string
+	for _, v := range fReq.HttpRequest.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	// walk back from the proxy that connected to us.  anything before
+	// the first untrusted hop could have been made up by the client.
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNets(fReq.proxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// The last of a comma separated list, across all of the header's
+// lines.  Each proxy adds to the end.
+func lastValue(h http.Header, name string) string {
+	values := h[http.CanonicalHeaderKey(name)]
+	if len(values) == 0 {
+		return ""
+	}
+	v := values[len(values)-1]
+	if i := strings.LastIndex(v, ","); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
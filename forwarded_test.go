@@ -0,0 +1,124 @@
+package falcore
+
+import (
+	"crypto/tls"
+	"http"
+	"net"
+	"testing"
+)
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		cidr     string
+		ip       string
+		contains bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.0.0.1", false},
+		{"192.168.1.7", "192.168.1.7", true},
+		{"192.168.1.7", "192.168.1.8", false},
+		{"2001:db8::/32", "2001:db8::1", true},
+		{"2001:db8::/32", "2001:db9::1", false},
+		{"10.0.0.0/8", "::1", false},
+	}
+	for _, test := range tests {
+		n, err := ParseCIDR(test.cidr)
+		if err != nil {
+			t.Errorf("%v failed to parse: %v", test.cidr, err)
+			continue
+		}
+		if n.Contains(net.ParseIP(test.ip)) != test.contains {
+			t.Errorf("%v contains %v should be %v", test.cidr, test.ip, test.contains)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "nope", "10.0.0.0/x"} {
+		if _, err := ParseCIDR(bad); err == nil {
+			t.Errorf("%v should fail to parse", bad)
+		}
+	}
+}
+
+func TestSchemeAndHost(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	srv.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := srv.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+
+	forwarded := func(remote string) *Request {
+		tmp, _ := http.NewRequest("GET", "http://internal:8080/", nil)
+		tmp.Header.Set("X-Forwarded-Proto", "https")
+		tmp.Header.Set("X-Forwarded-Host", "www.example.com")
+		req := newRequest(tmp, nil, 0)
+		tmp.RemoteAddr = remote
+		req.fromTrustedProxy = srv.trustedProxy(remote)
+		return req
+	}
+
+	req := forwarded("10.1.1.1:4000")
+	if req.Scheme() != "https" || req.Host() != "www.example.com" {
+		t.Errorf("Trusted proxy headers should be used, got %v %v", req.Scheme(), req.Host())
+	}
+	req = forwarded("8.8.8.8:4000")
+	if req.Scheme() != "http" || req.Host() != "internal:8080" {
+		t.Errorf("Untrusted clients can't set the scheme and host, got %v %v", req.Scheme(), req.Host())
+	}
+
+	req = forwarded("8.8.8.8:4000")
+	req.HttpRequest.TLS = &tls.ConnectionState{}
+	if req.Scheme() != "https" {
+		t.Errorf("TLS connections are https")
+	}
+
+	srv.TrustedProxies = []string{"bogus"}
+	if err := srv.validate(); err == nil {
+		t.Errorf("Bad TrustedProxies should be rejected")
+	}
+}
+
+func TestSchemeAndHostSpoofed(t *testing.T) {
+	tmp, _ := http.NewRequest("GET", "http://internal:8080/", nil)
+	// the client's own headers with the proxy's appended
+	tmp.Header.Set("X-Forwarded-Proto", "https, http")
+	tmp.Header.Add("X-Forwarded-Host", "evil.example.com")
+	tmp.Header.Add("X-Forwarded-Host", "www.example.com")
+	req := newRequest(tmp, nil, 0)
+	req.fromTrustedProxy = true
+	if req.Scheme() != "http" || req.Host() != "www.example.com" {
+		t.Errorf("Expected the values the proxy added, got %v %v", req.Scheme(), req.Host())
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	srv.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := srv.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+
+	tests := []struct {
+		remote string
+		xff    []string
+		client string
+	}{
+		{"8.8.8.8:4000", nil, "8.8.8.8"},
+		{"8.8.8.8:4000", []string{"1.2.3.4"}, "8.8.8.8"},
+		{"10.1.1.1:4000", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"10.1.1.1:4000", []string{"6.6.6.6, 1.2.3.4, 10.2.2.2"}, "1.2.3.4"},
+		{"10.1.1.1:4000", []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		{"10.1.1.1:4000", []string{"10.3.3.3"}, "10.3.3.3"},
+		{"10.1.1.1:4000", []string{"junk, 1.2.3.4"}, "1.2.3.4"},
+		{"10.1.1.1:4000", nil, "10.1.1.1"},
+	}
+	for _, test := range tests {
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		tmp.Header["X-Forwarded-For"] = test.xff
+		req := newRequest(tmp, nil, 0)
+		tmp.RemoteAddr = test.remote
+		req.fromTrustedProxy = srv.trustedProxy(test.remote)
+		req.proxies = srv.trustedNets
+		if ip := req.ClientIP(); ip.String() != test.client {
+			t.Errorf("%v %v expected %v, got %v", test.remote, test.xff, test.client, ip)
+		}
+	}
+}
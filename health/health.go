@@ -0,0 +1,82 @@
+package health
+
+import (
+	"http"
+	"os"
+	"falcore"
+)
+
+// Set in the request Context for health checks.  See IsCheck.
+const CheckKey = "health.check"
+
+// falcore/health.Filter answers load balancer health checks.
+//
+// Put it first in the Upstream list so checks don't go through auth,
+// routing and the rest of the pipeline.  Requests for Path get a 200
+// right away.  With a Check function the answer is a 503 (with the
+// error as the body) whenever it returns an error, for readiness
+// checks that should take the server out of rotation while it warms
+// up or drains.
+//
+// To keep checks out of the access log set the access_log.Filter's
+// Skip to IsCheck.  See Server.HandleSignals for draining on SIGTERM.
+type Filter struct {
+	Path string
+	// Methods answered.  Defaults to GET and HEAD
+	Methods []string
+	// nil means always healthy
+	Check func() os.Error
+	// Report 503 while this server is draining (see Server.Drain) so
+	// load balancers stop sending traffic before it shuts down.  Only
+	// set it for readiness checks.
+	Server *falcore.Server
+}
+
+// A liveness check on path
+func NewFilter(path string) *Filter {
+	return &Filter{Path: path, Methods: []string{"GET", "HEAD"}}
+}
+
+// A readiness check on path that fails while check returns an error
+func NewReadinessFilter(path string, check func() os.Error) *Filter {
+	f := NewFilter(path)
+	f.Check = check
+	return f
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	if req.URL.Path != f.Path || !f.allowMethod(req.Method) {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	request.Context[CheckKey] = true
+
+	h := http.Header{"Cache-Control": {"no-cache"}}
+	if f.Server != nil && f.Server.Draining() {
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.SimpleResponse(req, 503, h, "Draining\n")
+	}
+	if f.Check != nil {
+		if err := f.Check(); err != nil {
+			request.CurrentStage.Status = 2 // Fail
+			return falcore.SimpleResponse(req, 503, h, err.String()+"\n")
+		}
+	}
+	return falcore.SimpleResponse(req, 200, h, "OK\n")
+}
+
+func (f *Filter) allowMethod(method string) bool {
+	for _, m := range f.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// True for requests answered by a health Filter
+func IsCheck(request *falcore.Request) bool {
+	_, ok := request.Context[CheckKey]
+	return ok
+}
@@ -0,0 +1,80 @@
+package health
+
+import (
+	"falcore"
+	"http"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func healthRequest(method, path string) *falcore.Request {
+	tmp, _ := http.NewRequest(method, path, nil)
+	return &falcore.Request{
+		HttpRequest:  tmp,
+		CurrentStage: falcore.NewPiplineStage("test"),
+		Context:      make(map[string]interface{}),
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	f := NewFilter("/healthz")
+
+	req := healthRequest("GET", "/healthz")
+	res := f.FilterRequest(req)
+	if res == nil || res.StatusCode != 200 {
+		t.Fatalf("Expected a 200, got %v", res)
+	}
+	if !IsCheck(req) {
+		t.Errorf("Request should be marked as a health check")
+	}
+
+	for _, req := range []*falcore.Request{healthRequest("GET", "/other"), healthRequest("POST", "/healthz")} {
+		if res := f.FilterRequest(req); res != nil {
+			t.Errorf("%v %v shouldn't be answered", req.HttpRequest.Method, req.HttpRequest.URL.Path)
+		}
+		if IsCheck(req) {
+			t.Errorf("Other requests shouldn't be marked")
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	var ready os.Error = os.NewError("warming up")
+	f := NewReadinessFilter("/ready", func() os.Error { return ready })
+
+	res := f.FilterRequest(healthRequest("GET", "/ready"))
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 503 || string(body) != "warming up\n" {
+		t.Errorf("Expected a 503 while not ready, got %v %q", res.StatusCode, body)
+	}
+
+	ready = nil
+	if res = f.FilterRequest(healthRequest("GET", "/ready")); res.StatusCode != 200 {
+		t.Errorf("Expected a 200 once ready, got %v", res.StatusCode)
+	}
+}
+
+func TestDraining(t *testing.T) {
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(NewFilter("/ready"))
+	srv := falcore.NewServer(0, pipeline)
+	go srv.ListenAndServe()
+	for srv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+
+	f := NewFilter("/ready")
+	f.Server = srv
+	if res := f.FilterRequest(healthRequest("GET", "/ready")); res.StatusCode != 200 {
+		t.Errorf("Expected a 200 before draining, got %v", res.StatusCode)
+	}
+
+	srv.DrainDelay = 1e9
+	go srv.Drain()
+	time.Sleep(1e8)
+	if res := f.FilterRequest(healthRequest("GET", "/ready")); res.StatusCode != 503 {
+		t.Errorf("Expected a 503 while draining, got %v", res.StatusCode)
+	}
+}
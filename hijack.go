@@ -0,0 +1,95 @@
+package falcore
+
+import (
+	"http"
+	"bufio"
+	"net"
+	"os"
+)
+
+// Takes over a connection from the server.  rw reads from the buffer
+// the server was using, so anything the client sent after the request
+// headers is still there, and writes go through the connection's
+// write buffer (remember to Flush).
+type HijackHandler func(req *Request, conn net.Conn, rw *bufio.ReadWriter)
+
+// Marks a response as a hijack.  Reads and closes do nothing so the
+// response is harmless to Downstream filters.
+type hijackBody struct {
+	handler HijackHandler
+}
+
+func (b *hijackBody) Read(p []byte) (int, os.Error) {
+	return 0, os.EOF
+}
+
+func (b *hijackBody) Close() os.Error {
+	return nil
+}
+
+// A response telling the server to hand the connection to handler
+// instead of writing a response, for WebSockets and other protocol
+// upgrades.  The handler writes everything the client sees, including
+// any '101 Switching Protocols'.
+//
+// The server stops its request loop for the connection and clears its
+// timeouts.  handler runs on the connection's goroutine and the
+// connection is closed when it returns.  The request body isn't
+// drained.  Shutdown waits for handler like any other request but
+// never closes a hijacked connection itself.
+func HijackResponse(req *http.Request, handler HijackHandler) *http.Response {
+	res := SimpleResponse(req, 101, nil, "")
+	res.Body = &hijackBody{handler}
+	res.ContentLength = -1
+	return res
+}
+
+// Hands the connection over.  The deferred connectionFinished in the
+// handler closes it afterwards.
+func (srv *Server) hijack(request *Request, res *http.Response, c net.Conn, rw *bufio.ReadWriter) {
+	srv.connMutex.Lock()
+	srv.connections[c] = false, false
+	srv.connMutex.Unlock()
+	c.SetTimeout(0)
+
+	request.startPipelineStage("server.Hijack")
+	res.Body.(*hijackBody).handler(request, c, rw)
+	request.finishPipelineStage()
+	request.ResponseStatus = res.StatusCode
+	request.ResponseLength = -1
+	request.finishRequest()
+	srv.requestFinished(request)
+}
+
+// Marks a response that should never be sent
+type abortBody struct{}
+
+func (b *abortBody) Read(p []byte) (int, os.Error) {
+	return 0, os.EOF
+}
+
+func (b *abortBody) Close() os.Error {
+	return nil
+}
+
+// A response telling the server to close the connection without
+// writing anything, for dropping scanners and abusive clients as
+// cheaply as possible.  The RequestDoneCallback still runs and sees a
+// ResponseStatus of 444 (nginx's "No Response") so dropped requests
+// can be logged.
+func AbortResponse(req *http.Request) *http.Response {
+	res := SimpleResponse(req, 444, nil, "")
+	res.Body = &abortBody{}
+	res.ContentLength = 0
+	return res
+}
+
+// Drops the connection.  The deferred connectionFinished in the
+// handler closes it.
+func (srv *Server) abort(request *Request, res *http.Response, c net.Conn) {
+	srv.log().Debug("%s %v Aborting connection", srv.serverLogPrefix(), c.RemoteAddr())
+	request.ResponseStatus = res.StatusCode
+	request.ResponseLength = 0
+	request.finishRequest()
+	srv.requestFinished(request)
+}
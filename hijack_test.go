@@ -0,0 +1,116 @@
+package falcore
+
+import (
+	"http"
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHijackResponse(t *testing.T) {
+	finished := make(chan int, 1)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return HijackResponse(req.HttpRequest, func(req *Request, conn net.Conn, rw *bufio.ReadWriter) {
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\n\r\n")
+			rw.Flush()
+			// echo lines until the client says bye
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil || line == "bye\n" {
+					break
+				}
+				rw.WriteString(strings.ToUpper(line))
+				rw.Flush()
+			}
+		})
+	}))
+	pipeline.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		finished <- req.ResponseStatus
+		return nil
+	})
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	// the first line arrives with the request so it's sitting in the server's buffer
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhello\n"))
+	if line, err := buf.ReadString('\n'); err != nil || line != "HTTP/1.1 101 Switching Protocols\r\n" {
+		t.Fatalf("Expected the handler's 101, got %q %v", line, err)
+	}
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading headers: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	if line, err := buf.ReadString('\n'); line != "HELLO\n" {
+		t.Errorf("Buffered data didn't reach the handler: %q %v", line, err)
+	}
+	conn.Write([]byte("again\n"))
+	if line, err := buf.ReadString('\n'); line != "AGAIN\n" {
+		t.Errorf("Expected the echo, got %q %v", line, err)
+	}
+
+	conn.Write([]byte("bye\n"))
+	if _, err := buf.ReadString('\n'); err == nil {
+		t.Errorf("Connection should close once the handler returns")
+	}
+	if status := <-finished; status != 101 {
+		t.Errorf("Expected the request to finish with 101, got %v", status)
+	}
+}
+
+func TestAbortResponse(t *testing.T) {
+	finished := make(chan int, 1)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return AbortResponse(req.HttpRequest)
+	}))
+	pipeline.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		finished <- req.ResponseStatus
+		return nil
+	})
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if n, err := buf.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("Expected the connection to close without a response, got %v bytes %v", n, err)
+	}
+	if status := <-finished; status != 444 {
+		t.Errorf("Expected the request to finish with 444, got %v", status)
+	}
+}
+
+func TestAbortResponseWithErrorHandler(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return AbortResponse(req.HttpRequest)
+	}))
+	pipeline.ErrorHandlers = map[int]RequestFilter{0: NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 500, nil, "error page")
+	})}
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if n, err := buf.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("Expected the error handler to leave the abort alone, got %v bytes %v", n, err)
+	}
+}
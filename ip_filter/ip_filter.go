@@ -0,0 +1,99 @@
+package ip_filter
+
+import (
+	"http"
+	"net"
+	"os"
+	"falcore"
+)
+
+// What to do with a request
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+)
+
+// falcore/ip_filter.Filter allows or blocks requests by client address.
+// Blocked requests get a 403.  Put it near the start of the Upstream.
+//
+// An address in both lists is denied unless AllowFirst is set, so a
+// Deny range can carve a hole out of an Allow range (or the other way
+// around with AllowFirst).  Addresses in neither list get Default.
+// For an allow list, set Default to Deny.
+//
+// The address is Request.ClientIP, so requests through the Server's
+// TrustedProxies are checked against the client behind the proxy.
+// IPv4 and IPv6 ranges can be mixed.
+type Filter struct {
+	Allow      []*falcore.IPNet
+	Deny       []*falcore.IPNet
+	Default    Action
+	AllowFirst bool
+}
+
+// Parses the allow and deny lists of addresses or CIDR ranges
+func NewFilter(allow, deny []string, def Action) (*Filter, os.Error) {
+	f := &Filter{Default: def}
+	var err os.Error
+	if f.Allow, err = parse(allow); err != nil {
+		return nil, err
+	}
+	if f.Deny, err = parse(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parse(list []string) ([]*falcore.IPNet, os.Error) {
+	nets := make([]*falcore.IPNet, 0, len(list))
+	for _, s := range list {
+		n, err := falcore.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	if f.Check(request) == Allow {
+		return nil
+	}
+	falcore.Debug("%s Blocked %v", request.ID, request.ClientIP())
+	request.CurrentStage.Status = 2 // Fail
+	return falcore.SimpleResponse(request.HttpRequest, 403, nil, "Forbidden\n")
+}
+
+// The action for request's client address.  Addresses that can't be
+// parsed are denied.
+func (f *Filter) Check(request *falcore.Request) Action {
+	ip := request.ClientIP()
+	if ip == nil {
+		return Deny
+	}
+	allowed, denied := matches(f.Allow, ip), matches(f.Deny, ip)
+	switch {
+	case allowed && denied:
+		if f.AllowFirst {
+			return Allow
+		}
+		return Deny
+	case allowed:
+		return Allow
+	case denied:
+		return Deny
+	}
+	return f.Default
+}
+
+func matches(nets []*falcore.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package ip_filter
+
+import (
+	"falcore"
+	"http"
+	"testing"
+)
+
+func ipRequest(remote string) *falcore.Request {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	tmp.RemoteAddr = remote
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestOverlappingRanges(t *testing.T) {
+	f, err := NewFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "2001:db8:bad::/48"}, Deny)
+	if err != nil {
+		t.Fatalf("Bad lists: %v", err)
+	}
+	tests := []struct {
+		remote     string
+		allowFirst bool
+		action     Action
+	}{
+		{"10.2.3.4:1234", false, Allow},
+		{"10.1.3.4:1234", false, Deny},
+		{"10.1.3.4:1234", true, Allow},
+		{"192.168.1.1:1234", false, Deny},
+		{"[2001:db8::1]:1234", false, Allow},
+		{"[2001:db8:bad::1]:1234", false, Deny},
+		{"[2001:db8:bad::1]:1234", true, Allow},
+		{"[::1]:1234", false, Deny},
+		{"garbage", false, Deny},
+	}
+	for _, test := range tests {
+		f.AllowFirst = test.allowFirst
+		if action := f.Check(ipRequest(test.remote)); action != test.action {
+			t.Errorf("%v (AllowFirst %v) expected %v, got %v", test.remote, test.allowFirst, test.action, action)
+		}
+	}
+}
+
+func TestDefaultAllow(t *testing.T) {
+	f, _ := NewFilter(nil, []string{"192.0.2.0/24"}, Allow)
+	if res := f.FilterRequest(ipRequest("198.51.100.1:80")); res != nil {
+		t.Errorf("Unlisted address should be allowed")
+	}
+	res := f.FilterRequest(ipRequest("192.0.2.9:80"))
+	if res == nil || res.StatusCode != 403 {
+		t.Errorf("Denied address should get a 403, got %v", res)
+	}
+}
+
+func TestBadList(t *testing.T) {
+	if _, err := NewFilter([]string{"10.0.0.0/40"}, nil, Allow); err == nil {
+		t.Errorf("Bad CIDR should be rejected")
+	}
+}
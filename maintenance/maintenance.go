@@ -0,0 +1,95 @@
+package maintenance
+
+import (
+	"http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"falcore"
+)
+
+// falcore/maintenance.Filter answers every request with a 503 while
+// the service is in maintenance mode, so a deploy can take it down
+// without stopping the server.  Put it at the start of the Upstream.
+//
+// Turn it on and off at any time from any goroutine with Enable and
+// Disable, like from an admin endpoint or a signal handler.  It starts
+// off.  While it's on, clients in AllowIPs (see Request.ClientIP) and
+// paths under one of AllowPaths (on segment boundaries, so "/health"
+// doesn't allow "/healthz") still reach the pipeline so
+// ops can check the new version before opening it up.
+type Filter struct {
+	AllowIPs   []*falcore.IPNet
+	AllowPaths []string
+	// Seconds sent in Retry-After.  0 leaves the header out.
+	RetryAfter int
+	// Sent with the 503.  Defaults to "Down for maintenance\n"
+	Body string
+	// Content-Type of the Body.  Defaults to text/plain
+	ContentType string
+	enabled     int32
+}
+
+// Parses allowIPs, addresses or CIDR ranges like ip_filter's
+func NewFilter(allowIPs []string, allowPaths []string) (*Filter, os.Error) {
+	f := &Filter{AllowPaths: allowPaths}
+	f.Body = "Down for maintenance\n"
+	f.ContentType = "text/plain"
+	for _, s := range allowIPs {
+		n, err := falcore.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		f.AllowIPs = append(f.AllowIPs, n)
+	}
+	return f, nil
+}
+
+func (f *Filter) Enable() {
+	atomic.CompareAndSwapInt32(&f.enabled, 0, 1)
+}
+
+func (f *Filter) Disable() {
+	atomic.CompareAndSwapInt32(&f.enabled, 1, 0)
+}
+
+func (f *Filter) Enabled() bool {
+	return atomic.AddInt32(&f.enabled, 0) == 1
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	if !f.Enabled() || f.allowed(request) {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	request.CurrentStage.Status = 2 // Fail
+	h := http.Header{"Cache-Control": {"no-cache"}}
+	if f.ContentType != "" {
+		h.Set("Content-Type", f.ContentType)
+	}
+	if f.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(f.RetryAfter))
+	}
+	return falcore.SimpleResponse(request.HttpRequest, 503, h, f.Body)
+}
+
+func (f *Filter) allowed(request *falcore.Request) bool {
+	for _, prefix := range f.AllowPaths {
+		if falcore.HasPathPrefix(request.HttpRequest.URL.Path, prefix) {
+			return true
+		}
+	}
+	if len(f.AllowIPs) == 0 {
+		return false
+	}
+	ip := request.ClientIP()
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.AllowIPs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
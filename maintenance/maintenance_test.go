@@ -0,0 +1,48 @@
+package maintenance
+
+import (
+	"falcore"
+	"http"
+	"testing"
+)
+
+func maintenanceRequest(path, remote string) *falcore.Request {
+	tmp, _ := http.NewRequest("GET", path, nil)
+	tmp.RemoteAddr = remote
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestMaintenance(t *testing.T) {
+	f, err := NewFilter([]string{"10.0.0.0/8"}, []string{"/status"})
+	if err != nil {
+		t.Fatalf("Bad allow list: %v", err)
+	}
+	f.RetryAfter = 120
+	if res := f.FilterRequest(maintenanceRequest("/", "192.168.1.1:1234")); res != nil {
+		t.Errorf("Requests should pass while maintenance is off, got %v", res.StatusCode)
+	}
+
+	f.Enable()
+	f.Enable()
+	if !f.Enabled() {
+		t.Fatalf("Enable didn't turn it on")
+	}
+	res := f.FilterRequest(maintenanceRequest("/", "192.168.1.1:1234"))
+	if res == nil || res.StatusCode != 503 || res.Header.Get("Retry-After") != "120" {
+		t.Errorf("Expected a 503 with Retry-After, got %v", res)
+	}
+	if res := f.FilterRequest(maintenanceRequest("/", "10.1.2.3:1234")); res != nil {
+		t.Errorf("Allowed address should pass, got %v", res.StatusCode)
+	}
+	if res := f.FilterRequest(maintenanceRequest("/status/db", "192.168.1.1:1234")); res != nil {
+		t.Errorf("Allowed path should pass, got %v", res.StatusCode)
+	}
+	if res := f.FilterRequest(maintenanceRequest("/statusz", "192.168.1.1:1234")); res == nil || res.StatusCode != 503 {
+		t.Errorf("Allowed paths should match whole segments, got %v", res)
+	}
+
+	f.Disable()
+	if res := f.FilterRequest(maintenanceRequest("/", "192.168.1.1:1234")); res != nil {
+		t.Errorf("Requests should pass again after Disable, got %v", res.StatusCode)
+	}
+}
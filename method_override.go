@@ -0,0 +1,90 @@
+package falcore
+
+import (
+	"http"
+	"strings"
+)
+
+// Lets clients that can only send GET and POST reach filters for other
+// methods.  POST requests carrying the Header (X-HTTP-Method-Override
+// by default), or a FormField in the query string or a urlencoded
+// body, get their Method replaced.  Put it ahead of a MethodRouter.
+//
+// Only the Allowed methods (PUT, PATCH and DELETE by default) are
+// taken.  Other requests and overrides are left alone so a form can't
+// turn into something the server treats as safe, like a GET.
+type MethodOverrideFilter struct {
+	Header string
+	// Form field to look for, like "_method".  Off if empty.
+	FormField string
+	Allowed   []string
+	// Most body bytes read looking for FormField.  Larger bodies are
+	// left alone.  Defaults to 64KB.
+	MaxBodyBytes int
+}
+
+func NewMethodOverrideFilter() *MethodOverrideFilter {
+	f := new(MethodOverrideFilter)
+	f.Header = "X-HTTP-Method-Override"
+	f.Allowed = []string{"PUT", "PATCH", "DELETE"}
+	f.MaxBodyBytes = 64 << 10
+	return f
+}
+
+func (f *MethodOverrideFilter) FilterRequest(request *Request) *http.Response {
+	req := request.HttpRequest
+	if req.Method != "POST" {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	method := ""
+	if f.Header != "" {
+		method = req.Header.Get(f.Header)
+	}
+	if method == "" && f.FormField != "" {
+		method = f.formValue(request)
+	}
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if method == "" || !f.allowed(method) {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	req.Method = method
+	return nil
+}
+
+func (f *MethodOverrideFilter) allowed(method string) bool {
+	for _, m := range f.Allowed {
+		if strings.ToUpper(m) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks in the query string, then the body.  The body is buffered so
+// later filters can still read it.
+func (f *MethodOverrideFilter) formValue(request *Request) string {
+	req := request.HttpRequest
+	if values, err := http.ParseQuery(req.URL.RawQuery); err == nil {
+		if v := values.Get(f.FormField); v != "" {
+			return v
+		}
+	}
+	ct := strings.ToLower(req.Header.Get("Content-Type"))
+	if !strings.HasPrefix(ct, "application/x-www-form-urlencoded") {
+		return ""
+	}
+	max := f.MaxBodyBytes
+	if max <= 0 {
+		max = 64 << 10
+	}
+	if err := request.BufferBody(max); err != nil {
+		return ""
+	}
+	values, err := http.ParseQuery(string(req.Body.(*BufferedBody).Bytes()))
+	if err != nil {
+		return ""
+	}
+	return values.Get(f.FormField)
+}
@@ -0,0 +1,47 @@
+package falcore
+
+import (
+	"http"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMethodOverrideFilter(t *testing.T) {
+	f := NewMethodOverrideFilter()
+	f.FormField = "_method"
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		header   string
+		body     string
+		expected string
+	}{
+		{"header", "POST", "/", "delete", "", "DELETE"},
+		{"query", "POST", "/?_method=PUT", "", "", "PUT"},
+		{"form", "POST", "/", "", "a=b&_method=patch", "PATCH"},
+		{"not allowed", "POST", "/", "GET", "", "POST"},
+		{"only post", "GET", "/", "DELETE", "", "GET"},
+		{"nothing", "POST", "/", "", "a=b", "POST"},
+	}
+	for _, test := range tests {
+		tmp, _ := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		tmp.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header != "" {
+			tmp.Header.Set("X-HTTP-Method-Override", test.header)
+		}
+		req := newRequest(tmp, nil, 0)
+		req.CurrentStage = NewPiplineStage("test")
+		if res := f.FilterRequest(req); res != nil {
+			t.Errorf("%v Expected no response, got %v", test.name, res.StatusCode)
+		}
+		if tmp.Method != test.expected {
+			t.Errorf("%v Expected method %v, got %v", test.name, test.expected, tmp.Method)
+		}
+		if body, _ := ioutil.ReadAll(tmp.Body); string(body) != test.body {
+			t.Errorf("%v Body should still be readable, got %q", test.name, body)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package path_normalize
+
+import (
+	"http"
+	"strings"
+	"falcore"
+)
+
+// What to do with a trailing slash
+type TrailingSlash int
+
+const (
+	// Leave it as the client sent it
+	KeepSlash TrailingSlash = iota
+	// Remove it ("/a/" becomes "/a")
+	StripSlash
+	// Add one ("/a" becomes "/a/")
+	AddSlash
+)
+
+// falcore/path_normalize.Filter cleans up URL paths before routing.
+// Put it ahead of the Routers and FileFilters that look at the path.
+//
+// Empty and "." segments are dropped, so "//a/./b" is "/a/b", and ".."
+// removes the one before it.  Paths that climb out of the root with
+// ".." (even percent encoded) or contain a NUL get a 400.  The cleaned
+// path replaces req.URL.Path, or with Redirect, GET and HEAD requests
+// get a 301 to it instead so clients and caches learn the canonical
+// URL.
+type Filter struct {
+	TrailingSlash TrailingSlash
+	Redirect      bool
+}
+
+func NewFilter(trailingSlash TrailingSlash, redirect bool) *Filter {
+	return &Filter{TrailingSlash: trailingSlash, Redirect: redirect}
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	clean, ok := f.Normalize(req.URL.Path)
+	if !ok {
+		falcore.Debug("%s Rejecting path %q", request.ID, req.URL.Path)
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.SimpleResponse(req, 400, nil, "Bad Request\n")
+	}
+	if clean == req.URL.Path {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	if f.Redirect && (req.Method == "GET" || req.Method == "HEAD") {
+		location := escapePath(clean)
+		if req.URL.RawQuery != "" {
+			location += "?" + req.URL.RawQuery
+		}
+		return falcore.RedirectResponse(req, 301, location)
+	}
+	req.URL.Path = clean
+	return nil
+}
+
+// The canonical form of p.  ok is false if p can't be cleaned up.
+func (f *Filter) Normalize(p string) (clean string, ok bool) {
+	if strings.Contains(p, "\x00") {
+		return "", false
+	}
+	segments := strings.Split(p, "/")
+	out := make([]string, 0, len(segments))
+	for _, s := range segments {
+		switch s {
+		case "", ".":
+		case "..":
+			if len(out) == 0 {
+				return "", false
+			}
+			out = out[0 : len(out)-1]
+		default:
+			out = append(out, s)
+		}
+	}
+	clean = "/" + strings.Join(out, "/")
+	if clean == "/" {
+		return clean, true
+	}
+
+	last := segments[len(segments)-1]
+	slash := last == "" || last == "." || last == ".."
+	switch f.TrailingSlash {
+	case StripSlash:
+		slash = false
+	case AddSlash:
+		slash = true
+	}
+	if slash {
+		clean += "/"
+	}
+	return clean, true
+}
+
+// Percent encodes each segment of a decoded path for a Location, so
+// "/a?b" stays a path instead of becoming a query
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = escapeSegment(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+func escapeSegment(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if segmentSafe(c) {
+			out = append(out, c)
+		} else {
+			out = append(out, '%', hexDigits[c>>4], hexDigits[c&15])
+		}
+	}
+	return string(out)
+}
+
+// Unreserved characters and the sub-delims allowed in a path segment
+func segmentSafe(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexRune("-._~!$&'()*+,;=:@", int(c)) >= 0
+}
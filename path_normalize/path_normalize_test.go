@@ -0,0 +1,77 @@
+package path_normalize
+
+import (
+	"falcore"
+	"http"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		slash TrailingSlash
+		path  string
+		clean string
+		ok    bool
+	}{
+		{KeepSlash, "/", "/", true},
+		{KeepSlash, "", "/", true},
+		{KeepSlash, "//a///b", "/a/b", true},
+		{KeepSlash, "/a/./b/", "/a/b/", true},
+		{KeepSlash, "/a/b/../c", "/a/c", true},
+		{KeepSlash, "/a/b/..", "/a/", true},
+		{KeepSlash, "/a/../..", "", false},
+		{KeepSlash, "/../etc/passwd", "", false},
+		{KeepSlash, "/a\x00b", "", false},
+		{StripSlash, "/a/b/", "/a/b", true},
+		{StripSlash, "/", "/", true},
+		{AddSlash, "/a/b", "/a/b/", true},
+		{AddSlash, "//", "/", true},
+	}
+	for _, test := range tests {
+		f := NewFilter(test.slash, false)
+		clean, ok := f.Normalize(test.path)
+		if clean != test.clean || ok != test.ok {
+			t.Errorf("%q (%v) expected %q %v, got %q %v", test.path, test.slash, test.clean, test.ok, clean, ok)
+		}
+	}
+}
+
+func normalizeRequest(method, url string) *falcore.Request {
+	tmp, _ := http.NewRequest(method, url, nil)
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestFilter(t *testing.T) {
+	f := NewFilter(StripSlash, false)
+	req := normalizeRequest("GET", "http://example.com//a/./b/")
+	if res := f.FilterRequest(req); res != nil {
+		t.Errorf("Expected the path to be rewritten, got a %v", res.StatusCode)
+	}
+	if req.HttpRequest.URL.Path != "/a/b" {
+		t.Errorf("Expected /a/b, got %v", req.HttpRequest.URL.Path)
+	}
+
+	// percent encoded dot segments are decoded by the time we see them
+	res := f.FilterRequest(normalizeRequest("GET", "http://example.com/%2e%2e/secret"))
+	if res == nil || res.StatusCode != 400 {
+		t.Errorf("Escaping the root should get a 400, got %v", res)
+	}
+
+	f.Redirect = true
+	res = f.FilterRequest(normalizeRequest("GET", "http://example.com//a/?q=1"))
+	if res == nil || res.StatusCode != 301 || res.Header.Get("Location") != "/a?q=1" {
+		t.Errorf("Expected a 301 to /a?q=1, got %v", res)
+	}
+	// decoded characters that mean something in a URL stay encoded
+	res = f.FilterRequest(normalizeRequest("GET", "http://example.com/a%3Fb//c%23d%20e/"))
+	if res == nil || res.StatusCode != 301 || res.Header.Get("Location") != "/a%3Fb/c%23d%20e" {
+		t.Errorf("Expected a 301 to /a%%3Fb/c%%23d%%20e, got %v", res)
+	}
+	req = normalizeRequest("POST", "http://example.com//a/")
+	if res = f.FilterRequest(req); res != nil || req.HttpRequest.URL.Path != "/a" {
+		t.Errorf("POSTs should be rewritten instead of redirected")
+	}
+	if res = f.FilterRequest(normalizeRequest("GET", "http://example.com/a")); res != nil {
+		t.Errorf("Clean paths should pass through")
+	}
+}
@@ -3,8 +3,8 @@ package falcore
 import (
 	"container/list"
 	"http"
-	"log"
 	"reflect"
+	"time"
 )
 
 // Pipelines have an upstream and downstream list of filters.
@@ -12,8 +12,20 @@ import (
 // a Response is returned.  Once a request is returned, it is passed
 // through ALL ResponseFilters in the Downstream list, in order.
 //
-// If no response is generated by any Filters a default 404 response is
-// returned.
+// If no response is generated by any Filters the NotFoundHandler is
+// asked for one.  Without a NotFoundHandler (or if it returns nil too)
+// a plain 404 response is returned.
+//
+// Downstream is where cross cutting changes to the response go, like
+// compression or extra headers.  The ResponseFilters run in order on
+// every response, including the default 404, after the Upstream is
+// done and before the server writes it.  Each one gets its own
+// PipelineStageStat so its time shows up in the stats.
+//
+// Every Upstream filter gets a PipelineStageStat named after its type
+// too so per filter latency shows up without any work in the filter.
+// The stages of a Pipeline picked by a Router (or used as a filter)
+// are nested in the stage for that Pipeline, whose time includes them.
 //
 // The RequestDoneCallback (if set) will be called after the request 
 // has completed.  The finished request object will be passed to
@@ -25,8 +37,37 @@ type Pipeline struct {
 	Upstream            *list.List
 	Downstream          *list.List
 	RequestDoneCallback RequestFilter
+	// Makes the response when the Upstream doesn't.  Use it for a
+	// branded error page or a JSON error body.
+	NotFoundHandler RequestFilter
+	// Replace error responses (status 400 and up) by status code, for
+	// consistent error pages no matter which filter failed.  The
+	// handler under 0 gets any error status without its own.  Handlers
+	// run once the Upstream is done, before the Downstream, and can
+	// return nil to keep the original response.  Their responses are
+	// never handled again, even by the pipeline a Router picked this
+	// one from.
+	ErrorHandlers map[int]RequestFilter
+	// phase of each Upstream element added by Register
+	phases map[*list.Element]Phase
 }
 
+// Where Register puts a filter in the Upstream.  Lower phases run
+// first.  The gaps leave room for phases of your own, like
+// PhaseAuth + 10 for filters that need the user.
+type Phase int
+
+const (
+	// Blocking, rate limiting, body limits
+	PhaseSecurity Phase = 100
+	// Working out who the client is
+	PhaseAuth Phase = 200
+	// Rewrites and routers
+	PhaseRouting Phase = 300
+	// Filters that answer the request
+	PhaseHandler Phase = 400
+)
+
 func NewPipeline() (l *Pipeline) {
 	l = new(Pipeline)
 	l.Upstream = list.New()
@@ -34,6 +75,24 @@ func NewPipeline() (l *Pipeline) {
 	return
 }
 
+// Adds filter to the Upstream by phase, so modules can each add
+// their filters without worrying about the order they run in.  The
+// filter goes after every registered filter of the same or an earlier
+// phase and before the later ones.  Filters added straight to the
+// Upstream list stay where they are and don't count as any phase.
+func (p *Pipeline) Register(phase Phase, filter RequestFilter) {
+	if p.phases == nil {
+		p.phases = make(map[*list.Element]Phase)
+	}
+	for e := p.Upstream.Front(); e != nil; e = e.Next() {
+		if ep, ok := p.phases[e]; ok && ep > phase {
+			p.phases[p.Upstream.InsertBefore(filter, e)] = phase
+			return
+		}
+	}
+	p.phases[p.Upstream.PushBack(filter)] = phase
+}
+
 // Pipelines are also RequestFilters... wacky eh?
 // Be careful though because a Pipeline will always returns a 
 // response so no Filters after a Pipeline filter will be run.
@@ -41,51 +100,124 @@ func (p *Pipeline) FilterRequest(req *Request) *http.Response {
 	return p.execute(req)
 }
 
+// Runs req through the pipeline the way the Server would, without a
+// connection, for testing filters.  The Request gets an ID, timing,
+// stage stats and a RemoteAddr of 127.0.0.1 if it doesn't have one.
+// The response length and status are filled in and the
+// RequestDoneCallback is run before returning.  Panics aren't
+// recovered.
+func (p *Pipeline) TestWithRequest(req *http.Request) (*Request, *http.Response) {
+	startTime := time.Nanoseconds()
+	if req.RemoteAddr == "" {
+		req.RemoteAddr = "127.0.0.1:0"
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	request := newRequest(req, nil, startTime)
+	pssInit := NewPiplineStage("server.Init")
+	pssInit.StartTime = startTime
+	pssInit.EndTime = time.Nanoseconds()
+	request.appendPipelineStage(pssInit)
+
+	res := p.execute(request)
+	setResponseLength(req, res)
+	request.ResponseStatus = res.StatusCode
+	request.ResponseLength = res.ContentLength
+	request.finishRequest()
+	if p.RequestDoneCallback != nil {
+		request.finishAbandoned()
+		p.RequestDoneCallback.FilterRequest(request)
+	}
+	return request, res
+}
+
 func (p *Pipeline) execute(req *Request) (res *http.Response) {
+	// a nil response means continue with the next filter, anything
+	// else ends the Upstream
 	for e := p.Upstream.Front(); e != nil && res == nil; e = e.Next() {
 		if router, ok := e.Value.(Router); ok {
-			t := reflect.TypeOf(router)
-			req.startPipelineStage(t.String())
+			req.startPipelineStage(filterName(router))
 			pipe := router.SelectPipeline(req)
 			req.finishPipelineStage()
 			if pipe != nil {
-				t := reflect.TypeOf(pipe)
-				req.startPipelineStage(t.String()[1:])
+				req.startPipelineStage(pipeName(pipe))
 				res = pipe.FilterRequest(req)
 				req.finishPipelineStage()
 			}
 		} else if filter, ok := e.Value.(RequestFilter); ok {
-			t := reflect.TypeOf(filter)
-			req.startPipelineStage(t.String())
+			req.startPipelineStage(filterName(filter))
 			res = filter.FilterRequest(req)
 			req.finishPipelineStage()
 			if res != nil {
 				break
 			}
 		} else {
-			log.Printf("%v is not a RequestFilter\n", e.Value)
+			req.Logf(ERROR, "%v is not a RequestFilter", e.Value)
 			break
 		}
 	}
 
+	if res == nil && p.NotFoundHandler != nil {
+		req.startPipelineStage("NotFoundHandler")
+		res = p.NotFoundHandler.FilterRequest(req)
+		req.finishPipelineStage()
+	}
 	if res == nil {
 		// Error: No response was generated
 		res = SimpleResponse(req.HttpRequest, 404, nil, "Not found\n")
 	}
+	res = p.handleError(req, res)
 
 	p.down(req, res)
 	return
 }
 
+func (p *Pipeline) handleError(req *Request, res *http.Response) *http.Response {
+	if res.StatusCode < 400 || len(p.ErrorHandlers) == 0 || res == req.errorResponse {
+		return res
+	}
+	// aborts and hijacks aren't errors to dress up, the server has to
+	// see them as they are
+	switch res.Body.(type) {
+	case *abortBody, *hijackBody:
+		return res
+	}
+	handler, ok := p.ErrorHandlers[res.StatusCode]
+	if !ok {
+		if handler, ok = p.ErrorHandlers[0]; !ok {
+			return res
+		}
+	}
+	req.startPipelineStage("ErrorHandler")
+	replacement := handler.FilterRequest(req)
+	req.finishPipelineStage()
+	if replacement == nil {
+		return res
+	}
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	req.errorResponse = replacement
+	return replacement
+}
+
+// Stages for pipelines picked by a Router drop the '*'
+func pipeName(pipe RequestFilter) string {
+	if named, ok := pipe.(NamedFilter); ok {
+		return named.FilterName()
+	}
+	return reflect.TypeOf(pipe).String()[1:]
+}
+
 func (p *Pipeline) down(req *Request, res *http.Response) {
 	for e := p.Downstream.Front(); e != nil; e = e.Next() {
 		if filter, ok := e.Value.(ResponseFilter); ok {
-			t := reflect.TypeOf(filter)
-			req.startPipelineStage(t.String())
+			req.startPipelineStage(filterName(filter))
 			filter.FilterResponse(req, res)
 			req.finishPipelineStage()
 		} else {
-			// TODO
+			req.Logf(ERROR, "%v is not a ResponseFilter", e.Value)
 			break
 		}
 	}
@@ -5,6 +5,9 @@ import (
 	"container/list"
 	"http"
 	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -63,6 +66,109 @@ func TestPipelineNoResponse(t *testing.T) {
 	}
 }
 
+func TestPipelineDownstreamNotFound(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(sumFilter))
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Order", "1")
+	}))
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Order", res.Header.Get("X-Order")+"2")
+	}))
+
+	stageTrack = list.New()
+	req := validGetRequest()
+	response := p.execute(req)
+	if response.StatusCode != 404 {
+		t.Fatalf("Pipeline response code wrong: %v expected %v", response.StatusCode, 404)
+	}
+	if response.Header.Get("X-Order") != "12" {
+		t.Errorf("Downstream filters didn't run in order on the 404: '%v'", response.Header.Get("X-Order"))
+	}
+	if req.PipelineStageStats.Len() != 3 {
+		t.Errorf("Expected a stage for each filter, got %v", req.PipelineStageStats.Len())
+	}
+}
+
+func TestPipelineNotFoundHandler(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(sumFilter))
+	p.NotFoundHandler = NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 404, http.Header{"Content-Type": {"application/json"}}, "{\"error\":\"not found\"}")
+	})
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Downstream", "yes")
+	}))
+
+	stageTrack = list.New()
+	response := p.execute(validGetRequest())
+	if response.StatusCode != 404 || response.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the custom 404, got %v %v", response.StatusCode, response.Header)
+	}
+	if response.Header.Get("X-Downstream") != "yes" {
+		t.Errorf("Downstream filters should run on the custom 404")
+	}
+
+	// falls back to the plain 404
+	p.NotFoundHandler = NewRequestFilter(func(req *Request) *http.Response { return nil })
+	if response = p.execute(validGetRequest()); response.StatusCode != 404 {
+		t.Errorf("Expected the default 404, got %v", response.StatusCode)
+	}
+}
+
+// A Router that always picks the same pipeline
+type constantRouter struct {
+	pipe *Pipeline
+}
+
+func (r *constantRouter) SelectPipeline(req *Request) RequestFilter {
+	return r.pipe
+}
+
+func TestPipelineNestedStages(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		time.Sleep(1e7)
+		return nil
+	}))
+	inner.Upstream.PushBack(NewRequestFilter(successFilter))
+	p := NewPipeline()
+	p.Upstream.PushBack(&constantRouter{inner})
+
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 200 {
+		t.Fatalf("Expected the inner pipeline's response, got %v", res.StatusCode)
+	}
+	req.finishRequest()
+
+	// router, inner pipeline and its two filters
+	var stages []*PipelineStageStat
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		stages = append(stages, e.Value.(*PipelineStageStat))
+	}
+	if len(stages) != 4 {
+		t.Fatalf("Expected 4 stages, got %v", len(stages))
+	}
+	outer := stages[1]
+	if outer.Name != "falcore.Pipeline" {
+		t.Errorf("Expected the inner pipeline's stage, got %v", outer.Name)
+	}
+	for _, pss := range stages[2:] {
+		if pss.EndTime == 0 || pss.EndTime > outer.EndTime {
+			t.Errorf("%v should finish inside %v", pss.Name, outer.Name)
+		}
+	}
+	if outer.EndTime-outer.StartTime < 1e7 {
+		t.Errorf("Pipeline stage should include its filters' time, got %v", outer.EndTime-outer.StartTime)
+	}
+	if req.Overhead < 0 {
+		t.Errorf("Nested stages were counted twice, Overhead %v", req.Overhead)
+	}
+	if req.CurrentStage != outer {
+		t.Errorf("CurrentStage should be back to the outer stage, got %v", req.CurrentStage.Name)
+	}
+}
+
 func TestPipelineOKResponse(t *testing.T) {
 	p := NewPipeline()
 
@@ -174,3 +280,248 @@ func TestPipelineStatsChecksum(t *testing.T) {
 	//req.Trace()
 
 }
+
+func TestRequestContext(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		req.Context["user"] = "dave"
+		return nil
+	}))
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		user, _ := req.Context["user"].(string)
+		return SimpleResponse(req.HttpRequest, 200, nil, user)
+	}))
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-User", req.Context["user"].(string))
+	}))
+
+	response := p.execute(validGetRequest())
+	if response.Header.Get("X-User") != "dave" {
+		t.Errorf("Context value not passed downstream")
+	}
+	if response.ContentLength != int64(len("dave")) {
+		t.Errorf("Context value not passed between upstream filters")
+	}
+}
+
+type namedFilter struct{}
+
+func (f *namedFilter) FilterRequest(req *Request) *http.Response {
+	return nil
+}
+
+func (f *namedFilter) FilterName() string {
+	return "auth"
+}
+
+func TestNamedFilter(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(&namedFilter{})
+	p.Upstream.PushBack(NewRequestFilter(successFilter))
+
+	req := validGetRequest()
+	p.execute(req)
+	first := req.PipelineStageStats.Front().Value.(*PipelineStageStat)
+	if first.Name != "auth" {
+		t.Errorf("Expected the stage to use FilterName, got %v", first.Name)
+	}
+	second := req.PipelineStageStats.Front().Next().Value.(*PipelineStageStat)
+	if second.Name != "*falcore.genericRequestFilter" {
+		t.Errorf("Unnamed filters should use the type name, got %v", second.Name)
+	}
+}
+
+func TestModifyRequestFilter(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(ModifyRequestFilter(func(req *Request) {
+		req.HttpRequest.URL.Path = "/v2" + req.HttpRequest.URL.Path
+		req.HttpRequest.Header.Set("X-Rewritten", "yes")
+	}))
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, req.HttpRequest.URL.Path+" "+req.HttpRequest.Header.Get("X-Rewritten"))
+	}))
+
+	req := validGetRequest()
+	res := p.execute(req)
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "/v2/hello yes" {
+		t.Errorf("Expected the next filter to see the changes, got %v %q", res.StatusCode, body)
+	}
+	if name := req.PipelineStageStats.Front().Value.(*PipelineStageStat).Name; name != "falcore.ModifyRequestFilter" {
+		t.Errorf("Expected a falcore.ModifyRequestFilter stage, got %v", name)
+	}
+}
+
+func TestPipelineErrorHandlers(t *testing.T) {
+	status := 500
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, status, nil, "broken")
+	}))
+	calls := 0
+	page := func(name string) RequestFilter {
+		return NewRequestFilter(func(req *Request) *http.Response {
+			calls++
+			return SimpleResponse(req.HttpRequest, status, nil, name)
+		})
+	}
+	inner.ErrorHandlers = map[int]RequestFilter{500: page("inner 500")}
+
+	p := NewPipeline()
+	p.Upstream.PushBack(&constantRouter{inner})
+	p.ErrorHandlers = map[int]RequestFilter{0: page("outer"), 500: page("outer 500")}
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Downstream", "yes")
+	}))
+
+	tests := []struct {
+		status int
+		body   string
+		calls  int
+	}{
+		// handled once by the inner pipeline
+		{500, "inner 500", 1},
+		// the inner pipeline has no 503 handler, the outer catch all takes it
+		{503, "outer", 1},
+		{200, "broken", 0},
+	}
+	for _, test := range tests {
+		status, calls = test.status, 0
+		res := p.execute(validGetRequest())
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != test.body || calls != test.calls {
+			t.Errorf("%v expected %q from %v handlers, got %q from %v", test.status, test.body, test.calls, body, calls)
+		}
+		if res.Header.Get("X-Downstream") != "yes" {
+			t.Errorf("%v Downstream should run on error pages", test.status)
+		}
+	}
+
+	// a handler can decline
+	p.ErrorHandlers[0] = NewRequestFilter(func(req *Request) *http.Response { return nil })
+	status = 404
+	res := p.execute(validGetRequest())
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "broken" {
+		t.Errorf("Expected the original response, got %q", body)
+	}
+}
+
+func TestPipelineTestWithRequest(t *testing.T) {
+	done := false
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 201, nil, "from "+req.HttpRequest.RemoteAddr)
+	}))
+	p.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		done = true
+		return nil
+	})
+
+	tmp, _ := http.NewRequest("POST", "/things", nil)
+	req, res := p.TestWithRequest(tmp)
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 201 || string(body) != "from 127.0.0.1:0" {
+		t.Errorf("Expected the filter's response, got %v %q", res.StatusCode, body)
+	}
+	if req.ID == "" || req.EndTime < req.StartTime || req.ResponseStatus != 201 || req.ResponseLength != int64(len(body)) {
+		t.Errorf("Request wasn't filled in: %+v", req)
+	}
+	if req.PipelineStageStats.Len() != 2 || req.PipelineStageStats.Front().Value.(*PipelineStageStat).Name != "server.Init" {
+		t.Errorf("Expected server.Init and the filter's stage, got %v stages", req.PipelineStageStats.Len())
+	}
+	if !done {
+		t.Errorf("RequestDoneCallback should run")
+	}
+}
+
+func TestPipelineRegister(t *testing.T) {
+	var order []string
+	named := func(name string) RequestFilter {
+		return NewRequestFilter(func(req *Request) *http.Response {
+			order = append(order, name)
+			return nil
+		})
+	}
+	p := NewPipeline()
+	p.Upstream.PushBack(named("raw"))
+	p.Register(PhaseHandler, named("handler"))
+	p.Register(PhaseAuth, named("auth"))
+	p.Register(PhaseSecurity, named("security"))
+	p.Register(PhaseAuth, named("auth2"))
+	p.Register(PhaseRouting, named("routing"))
+
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	p.TestWithRequest(tmp)
+	if got := strings.Join(order, " "); got != "raw security auth auth2 routing handler" {
+		t.Errorf("Unexpected filter order: %v", got)
+	}
+}
+
+func TestValueFilter(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewValueFilter(func(req *Request) (interface{}, os.Error) {
+		switch req.HttpRequest.URL.Path {
+		case "/missing":
+			return nil, &StatusError{404, os.NewError("no such thing")}
+		case "/broken":
+			return nil, os.NewError("database is down")
+		case "/next":
+			return nil, nil
+		}
+		return map[string]int{"answer": 42}, nil
+	}))
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "next")
+	}))
+	p.ErrorHandlers = map[int]RequestFilter{
+		404: NewRequestFilter(func(req *Request) *http.Response {
+			return SimpleResponse(req.HttpRequest, 404, nil, "custom: "+req.FilterError().String())
+		}),
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", 200, `{"answer":42}`},
+		{"/missing", 404, "custom: no such thing"},
+		{"/broken", 500, "Internal Server Error\n"},
+		{"/next", 200, "next"},
+	}
+	for _, test := range tests {
+		tmp, _ := http.NewRequest("GET", test.path, nil)
+		_, res := p.TestWithRequest(tmp)
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != test.status || string(body) != test.body {
+			t.Errorf("%v Expected %v %q, got %v %q", test.path, test.status, test.body, res.StatusCode, body)
+		}
+	}
+
+	// straight from another filter, without a pipeline stage
+	req := validGetRequest()
+	req.HttpRequest.URL.Path = "/missing"
+	if res := p.Upstream.Front().Value.(RequestFilter).FilterRequest(req); res == nil || res.StatusCode != 404 {
+		t.Errorf("Expected a 404 outside a pipeline, got %v", res)
+	}
+}
+
+func TestPipelineBadElementLogged(t *testing.T) {
+	l := &recordingLogger{errors: make(chan string, 2)}
+	p := NewPipeline()
+	p.Upstream.PushBack("not a filter")
+	p.Downstream.PushBack("not a filter either")
+	req := validGetRequest()
+	req.logger = l
+	p.execute(req)
+	for _, expected := range []string{"%v is not a RequestFilter", "%v is not a ResponseFilter"} {
+		select {
+		case line := <-l.errors:
+			if line != req.ID+" "+expected {
+				t.Errorf("Expected %q, got %q", expected, line)
+			}
+		default:
+			t.Errorf("Expected %q on the request's logger", expected)
+		}
+	}
+}
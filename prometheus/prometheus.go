@@ -0,0 +1,188 @@
+package prometheus
+
+import (
+	"http"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"falcore"
+)
+
+// Upper bounds in seconds for the duration histograms
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// falcore/prometheus.Collector exports request metrics in the
+// Prometheus text format.
+//
+// Use the Collector as (or call it from) the Pipeline's
+// RequestDoneCallback.  Put InFlight() first in the Upstream list to
+// track requests in progress and Handler() anywhere in the Upstream
+// list to serve the metrics.  The done callback runs even if a filter
+// panics so the in flight gauge stays accurate.
+//
+// Metrics, prefixed with Namespace:
+//
+//   requests_total               counter by status class (2xx, 4xx...)
+//   requests_in_flight           gauge
+//   request_duration_seconds     histogram
+//   stage_duration_seconds       histogram by pipeline stage
+type Collector struct {
+	Namespace string
+	Buckets   []float64
+
+	requests map[string]int64
+	inFlight int64
+	duration *histogram
+	stages   map[string]*histogram
+	mutex    *sync.Mutex
+}
+
+const inFlightKey = "prometheus.inflight"
+
+func NewCollector() *Collector {
+	c := new(Collector)
+	c.Namespace = "falcore"
+	c.Buckets = DefaultBuckets
+	c.requests = make(map[string]int64)
+	c.stages = make(map[string]*histogram)
+	c.mutex = new(sync.Mutex)
+	return c
+}
+
+// The RequestDoneCallback
+func (c *Collector) FilterRequest(request *falcore.Request) *http.Response {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := request.Context[inFlightKey]; ok {
+		c.inFlight--
+	}
+	c.requests[fmt.Sprintf("%dxx", request.ResponseStatus/100)]++
+	if c.duration == nil {
+		c.duration = newHistogram(c.Buckets)
+	}
+	c.duration.observe(float64(falcore.TimeDiff(request.StartTime, request.EndTime)))
+	for e := request.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		pss, _ := e.Value.(*falcore.PipelineStageStat)
+		h := c.stages[pss.Name]
+		if h == nil {
+			h = newHistogram(c.Buckets)
+			c.stages[pss.Name] = h
+		}
+		h.observe(float64(falcore.TimeDiff(pss.StartTime, pss.EndTime)))
+	}
+	return nil
+}
+
+// A RequestFilter that counts the request as in flight until the
+// done callback sees it.
+func (c *Collector) InFlight() falcore.RequestFilter {
+	return falcore.NewRequestFilter(func(request *falcore.Request) *http.Response {
+		c.mutex.Lock()
+		c.inFlight++
+		c.mutex.Unlock()
+		request.Context[inFlightKey] = true
+		return nil
+	})
+}
+
+// A RequestFilter that serves the metrics for requests to path and
+// passes everything else through.
+func (c *Collector) Handler(path string) falcore.RequestFilter {
+	return falcore.NewRequestFilter(func(request *falcore.Request) *http.Response {
+		if request.HttpRequest.URL.Path != path {
+			request.CurrentStage.Status = 1 // Skip
+			return nil
+		}
+		h := http.Header{"Content-Type": {"text/plain; version=0.0.4"}}
+		return falcore.SimpleResponse(request.HttpRequest, 200, h, c.String())
+	})
+}
+
+// The metrics in the text exposition format
+func (c *Collector) String() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	buf := new(bytes.Buffer)
+
+	name := c.Namespace + "_requests_total"
+	fmt.Fprintf(buf, "# HELP %s Requests completed by status class.\n# TYPE %s counter\n", name, name)
+	for _, code := range sortedKeys(c.requests) {
+		fmt.Fprintf(buf, "%s{code=\"%s\"} %d\n", name, code, c.requests[code])
+	}
+
+	name = c.Namespace + "_requests_in_flight"
+	fmt.Fprintf(buf, "# HELP %s Requests currently being handled.\n# TYPE %s gauge\n", name, name)
+	fmt.Fprintf(buf, "%s %d\n", name, c.inFlight)
+
+	name = c.Namespace + "_request_duration_seconds"
+	fmt.Fprintf(buf, "# HELP %s Total request time.\n# TYPE %s histogram\n", name, name)
+	if c.duration != nil {
+		c.duration.write(buf, name, "")
+	}
+
+	name = c.Namespace + "_stage_duration_seconds"
+	fmt.Fprintf(buf, "# HELP %s Time spent in each pipeline stage.\n# TYPE %s histogram\n", name, name)
+	stages := make([]string, 0, len(c.stages))
+	for stage := range c.stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		c.stages[stage].write(buf, name, "stage=\""+escapeLabel(stage)+"\",")
+	}
+	return buf.String()
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "\"", "\\\"", -1)
+	return strings.Replace(v, "\n", "\\n", -1)
+}
+
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// labels is either empty or a list of labels ending in a comma
+func (h *histogram) write(buf *bytes.Buffer, name, labels string) {
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(buf, "%s_bucket{%sle=\"%v\"} %d\n", name, labels, bound, cumulative)
+	}
+	fmt.Fprintf(buf, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	if labels != "" {
+		labels = "{" + labels[0:len(labels)-1] + "}"
+	}
+	fmt.Fprintf(buf, "%s_sum%s %v\n", name, labels, h.sum)
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, labels, h.count)
+}
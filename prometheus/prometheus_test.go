@@ -0,0 +1,164 @@
+package prometheus
+
+import (
+	"testing"
+	"falcore"
+	"http"
+	"os"
+	"fmt"
+	"strings"
+	"io/ioutil"
+	"container/list"
+	"time"
+	"log"
+)
+
+var srv *falcore.Server
+var collector = NewCollector()
+
+func init() {
+	// Silence log output
+	log.SetOutput(nil)
+
+	go func() {
+		pipeline := falcore.NewPipeline()
+		pipeline.Upstream.PushBack(collector.InFlight())
+		pipeline.Upstream.PushBack(collector.Handler("/metrics"))
+		pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+			if req.HttpRequest.URL.Path == "/panic" {
+				panic("oops")
+			}
+			return falcore.SimpleResponse(req.HttpRequest, 200, nil, "OK")
+		}))
+		pipeline.RequestDoneCallback = collector
+		srv = falcore.NewServer(0, pipeline)
+		if err := srv.ListenAndServe(); err != nil {
+			panic(fmt.Sprintf("Could not start falcore: %v", err))
+		}
+	}()
+}
+
+func port() int {
+	for srv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+	return srv.Port()
+}
+
+func get(path string) (string, os.Error) {
+	res, err := http.Get(fmt.Sprintf("http://localhost:%v%v", port(), path))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return string(body), err
+}
+
+// the done callback runs in its own goroutine
+func waitFor(c *Collector, line string) bool {
+	for i := 0; i < 100; i++ {
+		if strings.Contains(c.String(), line) {
+			return true
+		}
+		time.Sleep(1e7)
+	}
+	return false
+}
+
+func TestInFlightAfterPanic(t *testing.T) {
+	if _, err := get("/"); err != nil {
+		t.Fatalf("Error getting /: %v", err)
+	}
+	if _, err := get("/panic"); err != nil {
+		t.Fatalf("Error getting /panic: %v", err)
+	}
+	if !waitFor(collector, "falcore_requests_total{code=\"2xx\"} 1\n") ||
+		!waitFor(collector, "falcore_requests_total{code=\"5xx\"} 1\n") {
+		t.Fatalf("Panicked request wasn't counted")
+	}
+	if !waitFor(collector, "falcore_requests_in_flight 0\n") {
+		t.Errorf("In flight gauge wasn't decremented:\n%v", collector.String())
+	}
+
+	body, err := get("/metrics")
+	if err != nil {
+		t.Fatalf("Error getting metrics: %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE falcore_requests_total counter\n",
+		"falcore_requests_total{code=\"2xx\"} 1\n",
+		"falcore_requests_in_flight 1\n", // the metrics request itself
+		"# TYPE falcore_request_duration_seconds histogram\n",
+		"falcore_request_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Missing '%v' in:\n%v", strings.TrimSpace(line), body)
+		}
+	}
+}
+
+func TestInFlightAfterTimeout(t *testing.T) {
+	c := NewCollector()
+	release := make(chan int)
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(c.InFlight())
+	pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		<-release
+		return falcore.SimpleResponse(req.HttpRequest, 200, nil, "too late")
+	}))
+	pipeline.RequestDoneCallback = c
+	timeoutSrv := falcore.NewServer(0, pipeline)
+	timeoutSrv.RequestTimeout = 5e7
+	go timeoutSrv.ListenAndServe()
+	defer timeoutSrv.StopAccepting()
+	for timeoutSrv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%v/", timeoutSrv.Port()))
+	if err != nil {
+		t.Fatalf("Error getting /: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 504 {
+		t.Errorf("Expected a 504, got %v", res.StatusCode)
+	}
+	close(release)
+	if !waitFor(c, "falcore_requests_in_flight 0\n") || !waitFor(c, "falcore_requests_total{code=\"5xx\"} 1\n") {
+		t.Errorf("In flight gauge wasn't decremented after a timeout:\n%v", c.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	c := NewCollector()
+	c.Buckets = []float64{0.1, 1}
+	for _, ms := range []int64{50, 500, 5000} {
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		req := &falcore.Request{HttpRequest: tmp, PipelineStageStats: list.New()}
+		req.StartTime = 1e12
+		req.EndTime = req.StartTime + ms*1e6
+		req.ResponseStatus = 404
+		req.PipelineStageStats.PushBack(&falcore.PipelineStageStat{
+			Name:      "stage \"one\"",
+			StartTime: req.StartTime,
+			EndTime:   req.EndTime,
+		})
+		c.FilterRequest(req)
+	}
+
+	out := c.String()
+	for _, line := range []string{
+		"falcore_requests_total{code=\"4xx\"} 3\n",
+		"falcore_request_duration_seconds_bucket{le=\"0.1\"} 1\n",
+		"falcore_request_duration_seconds_bucket{le=\"1\"} 2\n",
+		"falcore_request_duration_seconds_bucket{le=\"+Inf\"} 3\n",
+		"falcore_request_duration_seconds_count 3\n",
+		"falcore_stage_duration_seconds_bucket{stage=\"stage \\\"one\\\"\",le=\"1\"} 2\n",
+		"falcore_stage_duration_seconds_count{stage=\"stage \\\"one\\\"\"} 3\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Missing '%v' in:\n%v", strings.TrimSpace(line), out)
+		}
+	}
+}
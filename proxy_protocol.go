@@ -0,0 +1,219 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Returned by reads on a connection that didn't start with a valid
+// PROXY protocol header
+var ErrBadProxyHeader = os.NewError("falcore: missing or malformed PROXY protocol header")
+
+// The longest v1 header is 107 bytes including the CRLF
+const maxProxyHeader = 107
+
+// v2 headers start with this and then have 4 more fixed bytes:
+// version and command, address family and protocol, and the length of
+// the rest
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Largest v2 address and TLV block we'll read
+const maxProxyV2Length = 4096
+
+// Wraps accepted connections to read the PROXY header
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, os.Error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newProxyConn(c), nil
+}
+
+// A connection that starts with a PROXY protocol header.  The header
+// is read on the first Read.  After that RemoteAddr reports the client
+// and LocalAddr the address the client connected to.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	parsed bool
+	err    os.Error
+	remote net.Addr
+	local  net.Addr
+	// v2 TLVs by type
+	tlvs map[byte][]byte
+}
+
+func newProxyConn(c net.Conn) *proxyConn {
+	r, _ := bufio.NewReaderSize(c, 512)
+	return &proxyConn{Conn: c, r: r}
+}
+
+func (c *proxyConn) Read(p []byte) (int, os.Error) {
+	if !c.parsed {
+		c.parsed = true
+		c.err = c.readHeader()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) readHeader() os.Error {
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if first[0] == proxyV2Signature[0] {
+		return c.readHeaderV2()
+	}
+	line := make([]byte, 0, maxProxyHeader)
+	for len(line) < maxProxyHeader {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	c.remote, c.local, err = parseProxyHeader(string(line))
+	return err
+}
+
+func (c *proxyConn) readHeaderV2() os.Error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	length := int(header[14])<<8 | int(header[15])
+	if !bytes.Equal(header[0:12], proxyV2Signature) || length > maxProxyV2Length {
+		return ErrBadProxyHeader
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(c.r, block); err != nil {
+		return err
+	}
+	var err os.Error
+	c.remote, c.local, c.tlvs, err = parseProxyHeaderV2(header, block)
+	return err
+}
+
+// Parses "PROXY TCP4 src dst srcport dstport\r\n".  Returns nil
+// addresses for UNKNOWN connections, which keep the real ones.
+func parseProxyHeader(line string) (remote, local net.Addr, err os.Error) {
+	if !strings.HasPrefix(line, "PROXY ") || !strings.HasSuffix(line, "\r\n") {
+		return nil, nil, ErrBadProxyHeader
+	}
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrBadProxyHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, nil, ErrBadProxyHeader
+	}
+	dstPort, err := strconv.Atoi(fields[5])
+	if src == nil || dst == nil || err != nil || srcPort < 0 || srcPort > 65535 || dstPort < 0 || dstPort > 65535 {
+		return nil, nil, ErrBadProxyHeader
+	}
+	if (fields[1] == "TCP4") != (src.To4() != nil) {
+		return nil, nil, ErrBadProxyHeader
+	}
+	return &net.TCPAddr{IP: src, Port: srcPort}, &net.TCPAddr{IP: dst, Port: dstPort}, nil
+}
+
+// Parses the addresses and TLVs after the 16 byte v2 header.  LOCAL
+// connections (the balancer's own health checks) and address families
+// other than TCP over IPv4 and IPv6 return nil addresses and keep the
+// real ones.
+func parseProxyHeaderV2(header, block []byte) (remote, local net.Addr, tlvs map[byte][]byte, err os.Error) {
+	command := header[12] & 0xf
+	if header[12]>>4 != 2 || command > 1 {
+		return nil, nil, nil, ErrBadProxyHeader
+	}
+	// the address block's size depends on the family even when we
+	// don't use it
+	var addrLen int
+	switch header[13] >> 4 {
+	case 1: // IPv4
+		addrLen = 12
+	case 2: // IPv6
+		addrLen = 36
+	case 3: // unix
+		addrLen = 216
+	}
+	if len(block) < addrLen {
+		return nil, nil, nil, ErrBadProxyHeader
+	}
+	if command == 1 && header[13]&0xf == 1 && addrLen <= 36 && addrLen > 0 {
+		ipLen := (addrLen - 4) / 2
+		ports := block[2*ipLen:]
+		remote = &net.TCPAddr{IP: net.IP(block[0:ipLen]), Port: int(ports[0])<<8 | int(ports[1])}
+		local = &net.TCPAddr{IP: net.IP(block[ipLen : 2*ipLen]), Port: int(ports[2])<<8 | int(ports[3])}
+	}
+
+	rest := block[addrLen:]
+	for len(rest) > 0 {
+		if len(rest) < 3 {
+			return nil, nil, nil, ErrBadProxyHeader
+		}
+		n := int(rest[1])<<8 | int(rest[2])
+		if len(rest) < 3+n {
+			return nil, nil, nil, ErrBadProxyHeader
+		}
+		if tlvs == nil {
+			tlvs = make(map[byte][]byte)
+		}
+		tlvs[rest[0]] = rest[3 : 3+n]
+		rest = rest[3+n:]
+	}
+	return
+}
+
+// The value of a PROXY protocol v2 TLV from the load balancer, like
+// 0x05 for the unique connection ID or 0xEA for an AWS VPC endpoint
+// ID.  nil if the connection had no such TLV, didn't use v2, or is a
+// TLS connection (whose underlying connection isn't reachable).
+func (fReq *Request) ProxyTLV(typ byte) []byte {
+	if c, ok := fReq.Connection.(*proxyConn); ok {
+		return c.tlvs[typ]
+	}
+	return nil
+}
+
+// Wraps the listener if ProxyProtocol is on.  Has to happen before
+// the TLS listener is added since the header comes before the handshake.
+func (srv *Server) proxyProtocolListen() {
+	if _, ok := srv.listener.(*proxyListener); srv.ProxyProtocol && !ok {
+		srv.listener = &proxyListener{srv.listener}
+	}
+}
@@ -0,0 +1,123 @@
+package falcore
+
+import (
+	"http"
+	"strings"
+	"testing"
+)
+
+var proxyHeaderTests = []struct {
+	line   string
+	remote string
+	ok     bool
+}{
+	{"PROXY TCP4 192.0.2.1 192.0.2.2 5555 80\r\n", "192.0.2.1:5555", true},
+	{"PROXY TCP6 2001:db8::1 2001:db8::2 5555 443\r\n", "[2001:db8::1]:5555", true},
+	{"PROXY UNKNOWN\r\n", "", true},
+	{"PROXY TCP4 192.0.2.1 192.0.2.2 5555 80\n", "", false},
+	{"PROXY TCP4 2001:db8::1 192.0.2.2 5555 80\r\n", "", false},
+	{"PROXY TCP4 192.0.2.1 192.0.2.2 99999 80\r\n", "", false},
+	{"PROXY UDP4 192.0.2.1 192.0.2.2 5555 80\r\n", "", false},
+	{"GET / HTTP/1.1\r\n", "", false},
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	for _, test := range proxyHeaderTests {
+		addr, _, err := parseProxyHeader(test.line)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: expected ok=%v, got %v", test.line, test.ok, err)
+			continue
+		}
+		if test.remote != "" && (addr == nil || addr.String() != test.remote) {
+			t.Errorf("%q: expected %v, got %v", test.line, test.remote, addr)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, req.HttpRequest.RemoteAddr)
+	}))
+	srv := NewServer(0, pipeline)
+	srv.ProxyProtocol = true
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	_, body, err := rawRequest(conn, buf, "PROXY TCP4 192.0.2.1 192.0.2.2 5555 80\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || body != "192.0.2.1:5555" {
+		t.Errorf("Expected the client address from the header, got %q %v", body, err)
+	}
+	// keep-alive requests keep the address
+	_, body, err = rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || body != "192.0.2.1:5555" {
+		t.Errorf("Second request lost the client address: %q %v", body, err)
+	}
+	conn.Close()
+
+	conn, buf = dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(1e9)
+	if _, _, err = rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err == nil {
+		t.Errorf("Connection without a PROXY header should be closed")
+	}
+}
+
+// A v2 header for TCP over IPv4 with a connection ID TLV
+func proxyV2Header(command byte) string {
+	block := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x15, 0xb3, 0, 80}
+	block = append(block, 0x05, 0, 3, 'a', 'b', 'c')
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, 0x11, 0, byte(len(block)))
+	return string(append(header, block...))
+}
+
+func TestParseProxyHeaderV2(t *testing.T) {
+	raw := []byte(proxyV2Header(1))
+	remote, local, tlvs, err := parseProxyHeaderV2(raw[0:16], raw[16:])
+	if err != nil {
+		t.Fatalf("Couldn't parse header: %v", err)
+	}
+	if remote.String() != "192.0.2.1:5555" || local.String() != "192.0.2.2:80" {
+		t.Errorf("Expected 192.0.2.1:5555 to 192.0.2.2:80, got %v to %v", remote, local)
+	}
+	if string(tlvs[0x05]) != "abc" {
+		t.Errorf("Expected the connection ID TLV, got %q", tlvs[0x05])
+	}
+
+	raw = []byte(proxyV2Header(0))
+	if remote, _, _, err = parseProxyHeaderV2(raw[0:16], raw[16:]); err != nil || remote != nil {
+		t.Errorf("LOCAL should keep the real address, got %v %v", remote, err)
+	}
+
+	raw = []byte(proxyV2Header(1))
+	if _, _, _, err = parseProxyHeaderV2(raw[0:16], raw[16:len(raw)-1]); err == nil {
+		t.Errorf("Expected an error for a truncated TLV")
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, req.HttpRequest.RemoteAddr+" "+string(req.ProxyTLV(0x05)))
+	}))
+	srv := NewServer(0, pipeline)
+	srv.ProxyProtocol = true
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	_, body, err := rawRequest(conn, buf, proxyV2Header(1)+"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || body != "192.0.2.1:5555 abc" {
+		t.Errorf("Expected the client address and TLV from the header, got %q %v", body, err)
+	}
+	conn.Close()
+
+	conn, buf = dialTestServer(t, srv)
+	defer conn.Close()
+	_, body, err = rawRequest(conn, buf, proxyV2Header(0)+"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || body == "" || strings.HasPrefix(body, "192.0.2.1") {
+		t.Errorf("LOCAL connections should keep the real address, got %q %v", body, err)
+	}
+}
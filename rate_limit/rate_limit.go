@@ -0,0 +1,154 @@
+package rate_limit
+
+import (
+	"http"
+	"net"
+	"fmt"
+	"sync"
+	"time"
+	"falcore"
+)
+
+// Picks the bucket for a request.  Requests with an empty key aren't limited.
+type KeyFunc func(request *falcore.Request) string
+
+// Keys on the client IP from RemoteAddr
+func RemoteAddrKey(request *falcore.Request) string {
+	addr := request.HttpRequest.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Keys on the value of a request header, like an API key
+func HeaderKey(name string) KeyFunc {
+	return func(request *falcore.Request) string {
+		return request.HttpRequest.Header.Get(name)
+	}
+}
+
+// Holds the token buckets.  Take has to be atomic per key so a shared
+// backend should do the refill and take in one operation.
+type Store interface {
+	// Refill the bucket for key at rate tokens per second up to burst
+	// and take a token if there is one.  Returns whether a token was
+	// taken, the tokens left and the nanoseconds until the next token.
+	Take(key string, rate float64, burst int, now int64) (ok bool, remaining int, wait int64)
+}
+
+// falcore/rate_limit.Filter limits requests with a token bucket per key.
+//
+// Each key gets Burst tokens which refill at Rate per second.  A request
+// without a token gets a '429 Too Many Requests' with Retry-After and
+// X-RateLimit-Limit / X-RateLimit-Remaining headers.
+type Filter struct {
+	Rate  float64
+	Burst int
+	Key   KeyFunc
+	Store Store
+}
+
+// Create a Filter keyed by client IP using an in memory store
+func NewFilter(rate float64, burst int) *Filter {
+	f := new(Filter)
+	f.Rate = rate
+	f.Burst = burst
+	f.Key = RemoteAddrKey
+	f.Store = NewMemoryStore()
+	return f
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	key := f.Key(request)
+	if key == "" {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	ok, remaining, wait := f.Store.Take(key, f.Rate, f.Burst, time.Nanoseconds())
+	if ok {
+		return nil
+	}
+	request.CurrentStage.Status = 2 // Fail
+	h := make(http.Header)
+	h.Set("Retry-After", fmt.Sprintf("%d", (wait+999999999)/1e9))
+	h.Set("X-Ratelimit-Limit", fmt.Sprintf("%d", f.Burst))
+	h.Set("X-Ratelimit-Remaining", fmt.Sprintf("%d", remaining))
+	return falcore.SimpleResponse(request.HttpRequest, 429, h, "Too Many Requests\n")
+}
+
+type bucket struct {
+	tokens  float64
+	updated int64
+	// when the bucket will be full again and can be forgotten
+	full int64
+}
+
+// The default in memory Store.  Buckets that have refilled completely
+// are the same as new ones so they're dropped every SweepInterval.
+type MemoryStore struct {
+	// nanoseconds.  Default 1 minute
+	SweepInterval int64
+
+	buckets   map[string]*bucket
+	lastSweep int64
+	mutex     *sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := new(MemoryStore)
+	s.SweepInterval = 60e9
+	s.buckets = make(map[string]*bucket)
+	s.lastSweep = time.Nanoseconds()
+	s.mutex = new(sync.Mutex)
+	return s
+}
+
+func (s *MemoryStore) Take(key string, rate float64, burst int, now int64) (ok bool, remaining int, wait int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if now-s.lastSweep >= s.SweepInterval {
+		s.sweep(now)
+	}
+
+	b := s.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens += float64(now-b.updated) / 1e9 * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else if rate > 0 {
+		wait = int64((1 - b.tokens) / rate * 1e9)
+	}
+	if rate > 0 {
+		b.full = now + int64((float64(burst)-b.tokens)/rate*1e9)
+	} else {
+		b.full = now + s.SweepInterval
+	}
+	return ok, int(b.tokens), wait
+}
+
+// Number of buckets being tracked
+func (s *MemoryStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.buckets)
+}
+
+func (s *MemoryStore) sweep(now int64) {
+	for key, b := range s.buckets {
+		if b.full <= now {
+			s.buckets[key] = nil, false
+		}
+	}
+	s.lastSweep = now
+}
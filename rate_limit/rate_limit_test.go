@@ -0,0 +1,87 @@
+package rate_limit
+
+import (
+	"falcore"
+	"http"
+	"testing"
+)
+
+func limitRequest(remoteAddr string) *falcore.Request {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	tmp.RemoteAddr = remoteAddr
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestFilter(t *testing.T) {
+	f := NewFilter(1, 3)
+	for i := 0; i < 3; i++ {
+		if res := f.FilterRequest(limitRequest("10.0.0.1:1234")); res != nil {
+			t.Fatalf("Request %v shouldn't be limited", i)
+		}
+	}
+
+	res := f.FilterRequest(limitRequest("10.0.0.1:5678"))
+	if res == nil || res.StatusCode != 429 {
+		t.Fatalf("Expected a 429 once the bucket is empty")
+	}
+	if res.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After: 1, got '%v'", res.Header.Get("Retry-After"))
+	}
+	if res.Header.Get("X-Ratelimit-Limit") != "3" || res.Header.Get("X-Ratelimit-Remaining") != "0" {
+		t.Errorf("Wrong rate limit headers: %v", res.Header)
+	}
+
+	// other clients have their own bucket
+	if res := f.FilterRequest(limitRequest("10.0.0.2:1234")); res != nil {
+		t.Errorf("Other client shouldn't be limited")
+	}
+}
+
+func TestHeaderKey(t *testing.T) {
+	f := NewFilter(1, 1)
+	f.Key = HeaderKey("X-Api-Key")
+
+	req := limitRequest("10.0.0.1:1234")
+	if res := f.FilterRequest(req); res != nil || req.CurrentStage.Status != 1 {
+		t.Errorf("Requests without a key shouldn't be limited")
+	}
+
+	req.HttpRequest.Header.Set("X-Api-Key", "abc")
+	f.FilterRequest(req)
+	if res := f.FilterRequest(req); res == nil || res.StatusCode != 429 {
+		t.Errorf("Expected a 429 for the second request with the same key")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	var now int64 = 1e12
+	s.lastSweep = now
+
+	if ok, remaining, _ := s.Take("a", 2, 2, now); !ok || remaining != 1 {
+		t.Errorf("Expected a token with 1 left, got %v %v", ok, remaining)
+	}
+	s.Take("a", 2, 2, now)
+	ok, _, wait := s.Take("a", 2, 2, now)
+	if ok {
+		t.Errorf("Bucket should be empty")
+	}
+	if wait != 5e8 {
+		t.Errorf("Expected to wait 0.5s, got %v", wait)
+	}
+
+	// refills at 2 per second
+	if ok, _, _ := s.Take("a", 2, 2, now+5e8); !ok {
+		t.Errorf("Bucket should have refilled")
+	}
+
+	// full buckets get swept
+	s.Take("b", 2, 2, now)
+	if s.Len() != 2 {
+		t.Fatalf("Expected 2 buckets, got %v", s.Len())
+	}
+	s.Take("c", 2, 2, now+s.SweepInterval)
+	if s.Len() != 1 {
+		t.Errorf("Expected full buckets to be swept, have %v", s.Len())
+	}
+}
@@ -0,0 +1,139 @@
+package redirect
+
+import (
+	"http"
+	"os"
+	"regexp"
+	"strings"
+	"falcore"
+)
+
+// A redirect rule.  Set one of HTTPS, Host or Match.
+type Rule struct {
+	// Redirect plaintext requests to https
+	HTTPS bool
+	// Redirect requests for any other host to this one.  Compared
+	// without case or port.
+	Host string
+	// Redirect paths matching Match to Replacement.  $1 to $9 in the
+	// replacement are the captured groups and $$ is a literal $.
+	Match       *regexp.Regexp
+	Replacement string
+	// Defaults to 301
+	Status int
+}
+
+// Redirect plaintext requests to https
+func HTTPSRule(status int) *Rule {
+	return &Rule{HTTPS: true, Status: status}
+}
+
+// Redirect to a canonical host name
+func HostRule(host string, status int) *Rule {
+	return &Rule{Host: host, Status: status}
+}
+
+// Rewrite paths matching pattern into a redirect
+func PathRule(pattern, replacement string, status int) (*Rule, os.Error) {
+	match, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &Rule{Match: match, Replacement: replacement, Status: status}, nil
+}
+
+// falcore/redirect.Filter sends redirects based on a list of Rules.
+//
+// Every rule that applies changes the Location so one redirect does
+// the job of several.  A plaintext request for /old on example.com
+// with an https rule, a host rule for www.example.com and a path rule
+// from /old to /new goes straight to https://www.example.com/new.
+// The status comes from the first rule that applied.  Query strings
+// are kept.  Behind a proxy, list it in the Server's TrustedProxies so
+// the scheme and host the client used are checked (see Request.Scheme).
+type Filter struct {
+	Rules []*Rule
+}
+
+func NewFilter(rules ...*Rule) *Filter {
+	return &Filter{Rules: rules}
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	scheme := request.Scheme()
+	host := request.Host()
+	path := req.URL.Path
+	status := 0
+
+	for _, rule := range f.Rules {
+		applied := false
+		switch {
+		case rule.HTTPS:
+			if scheme != "https" {
+				scheme = "https"
+				// the old port won't be serving https
+				host = stripPort(host)
+				applied = true
+			}
+		case rule.Host != "":
+			if strings.ToLower(stripPort(host)) != strings.ToLower(rule.Host) {
+				host = rule.Host
+				applied = true
+			}
+		case rule.Match != nil:
+			if groups := rule.Match.FindStringSubmatch(path); groups != nil {
+				path = expand(rule.Replacement, groups)
+				applied = true
+			}
+		}
+		if applied && status == 0 {
+			status = rule.Status
+			if status == 0 {
+				status = 301
+			}
+		}
+	}
+
+	if status == 0 {
+		request.CurrentStage.Status = 1 // Skip
+		return nil
+	}
+	location := scheme + "://" + host + path
+	if req.URL.RawQuery != "" {
+		location += "?" + req.URL.RawQuery
+	}
+	return falcore.RedirectResponse(req, status, location)
+}
+
+func stripPort(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 && i > strings.LastIndex(host, "]") {
+		return host[0:i]
+	}
+	return host
+}
+
+// Substitutes $1-$9 with the captured groups
+func expand(template string, groups []string) string {
+	out := make([]byte, 0, len(template))
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c == '$' && i+1 < len(template) {
+			next := template[i+1]
+			if next == '$' {
+				out = append(out, '$')
+				i++
+				continue
+			}
+			if next >= '1' && next <= '9' {
+				if g := int(next - '0'); g < len(groups) {
+					out = append(out, groups[g]...)
+				}
+				i++
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
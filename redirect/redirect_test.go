@@ -0,0 +1,73 @@
+package redirect
+
+import (
+	"falcore"
+	"http"
+	"testing"
+)
+
+func redirectRequest(url string) *falcore.Request {
+	tmp, _ := http.NewRequest("GET", url, nil)
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestRedirects(t *testing.T) {
+	users, err := PathRule(`^/users/([0-9]+)$`, "/people/$1", 308)
+	if err != nil {
+		t.Fatalf("Bad rule: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		rules    []*Rule
+		url      string
+		status   int
+		location string
+	}{
+		{"https", []*Rule{HTTPSRule(0)}, "http://example.com:8080/a?b=c", 301, "https://example.com/a?b=c"},
+		{"host", []*Rule{HostRule("www.example.com", 302)}, "http://example.com/a", 302, "http://www.example.com/a"},
+		{"host matches", []*Rule{HostRule("www.example.com", 302)}, "http://WWW.example.com/a", 0, ""},
+		{"path", []*Rule{users}, "http://example.com/users/12", 308, "http://example.com/people/12"},
+		{"path no match", []*Rule{users}, "http://example.com/users/bob", 0, ""},
+		{"combined", []*Rule{HTTPSRule(301), HostRule("www.example.com", 302), users},
+			"http://example.com/users/7", 301, "https://www.example.com/people/7"},
+		{"first applied status", []*Rule{HTTPSRule(301), users},
+			"http://example.com/users/7", 301, "https://example.com/people/7"},
+	}
+
+	for _, test := range tests {
+		res := NewFilter(test.rules...).FilterRequest(redirectRequest(test.url))
+		if test.status == 0 {
+			if res != nil {
+				t.Errorf("%v Expected no redirect, got %v", test.name, res.Header.Get("Location"))
+			}
+			continue
+		}
+		if res == nil {
+			t.Errorf("%v Expected a redirect", test.name)
+			continue
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("%v Expected status %v, got %v", test.name, test.status, res.StatusCode)
+		}
+		if loc := res.Header.Get("Location"); loc != test.location {
+			t.Errorf("%v Expected Location %v, got %v", test.name, test.location, loc)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	groups := []string{"/a/b", "a", "b"}
+	tests := map[string]string{
+		"/$2/$1":  "/b/a",
+		"$$1":     "$1",
+		"/$9":     "/",
+		"/cost$":  "/cost$",
+		"/plain/": "/plain/",
+	}
+	for template, expected := range tests {
+		if got := expand(template, groups); got != expected {
+			t.Errorf("expand(%q) = %q, expected %q", template, got, expected)
+		}
+	}
+}
@@ -5,10 +5,16 @@ import (
 	"container/list"
 	"fmt"
 	"time"
-	"rand"
-	"hash"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
 	"hash/crc32"
 	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"crypto/tls"
 )
 
 // Request wrapper
@@ -18,12 +24,13 @@ import (
 //
 // A pointer is kept to the originating Connection.
 //
-// There is a unique ID assigned to each request.  This ID is not 
-// globally unique to keep it shorter for logging purposes.  It is 
-// possible to have duplicates though very unlikely over the period 
-// of a day or so.  It is a good idea to log the ID in any custom
-// log statements so that individual requests can easily be grepped
-// from busy log files.
+// There is a unique ID assigned to each request: 16 random bytes, hex
+// encoded, so it can follow the request across services (see
+// Server.RequestIDHeader and RequestIDFilter).  It is a good idea to
+// log the ID in any custom log statements so that individual requests
+// can easily be grepped from busy log files.  ID stays an exported
+// field rather than an ID() method since existing filters read and
+// set it directly, and Go doesn't allow both.
 //
 // Falcore collects performance statistics on every stage of the 
 // pipeline.  The stats for the request are kept in PipelineStageStats.
@@ -36,6 +43,19 @@ import (
 // See falcore.PipelineStageStat docs for more info.
 // 
 // The Signature is also a cool feature. See the 
+//
+// Trailers sent after a chunked request body show up in
+// HttpRequest.Trailer only once the body has been read to EOF, so a
+// filter wanting them has to consume the body first.  The server
+// closes (and drains) the body after the pipeline is done, so filters
+// can't see trailers the pipeline never read.
+//
+// Context is for passing values between filters, like an auth filter
+// handing the logged in user to the filters after it.  A request goes
+// through the pipeline one filter at a time so there is no locking.
+// Filters that start their own goroutines must do their own.  The
+// Context is still available in the RequestDoneCallback and is dropped
+// after that.
 type Request struct {
 	ID                 string
 	StartTime          int64
@@ -44,9 +64,39 @@ type Request struct {
 	Connection         net.Conn
 	PipelineStageStats *list.List
 	CurrentStage       *PipelineStageStat
-	pipelineHash       hash.Hash32
+	pipelineHash       uint32
 	piplineTot         int64
 	Overhead           int64
+	// Filled in by the server once the response has been written.
+	// ResponseLength is -1 if the length wasn't known up front.  See
+	// also BytesIn and BytesOut.
+	ResponseStatus int
+	ResponseLength int64
+	bytesIn        int64
+	bytesOut       int64
+	Context        map[string]interface{}
+	// When (nanoseconds) the whole request has to be done by.  0 means
+	// no deadline.  See Remaining.
+	Deadline   int64
+	openStages []*PipelineStageStat
+	cancel     chan int
+	// shared with snapshots so any of them can cancel
+	cancelOnce *sync.Once
+	// snapshots given up on, see abandon
+	abandoned []*Request
+	// closed when a snapshot's run is over
+	finished chan int
+	// see Scheme, Host and ClientIP
+	fromTrustedProxy bool
+	proxies          []*IPNet
+	// the server's Logger, see Logf
+	logger Logger
+	// the server's Name
+	listenerName string
+	// made by a Pipeline's ErrorHandlers
+	errorResponse *http.Response
+	// see FilterError
+	filterError os.Error
 }
 
 // Used internally to create and initialize a new request.
@@ -55,24 +105,224 @@ func newRequest(request *http.Request, conn net.Conn, startTime int64) *Request
 	fReq.HttpRequest = request
 	fReq.StartTime = startTime
 	fReq.Connection = conn
-	// create a semi-unique id to track a connection in the logs
-	// the last 3 zeros of time.Nanosecods appear to always be zero		
-	fReq.ID = fmt.Sprintf("%010x", (fReq.StartTime-(fReq.StartTime-(fReq.StartTime%1e12)))+int64(rand.Intn(999)))
+	if conn != nil {
+		request.RemoteAddr = conn.RemoteAddr().String()
+	}
+	// the handshake is done by the time a request has been read
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		request.TLS = &state
+	}
+	fReq.ID = newRequestID(startTime)
 	fReq.PipelineStageStats = list.New()
-	fReq.pipelineHash = crc32.NewIEEE()
+	fReq.Context = make(map[string]interface{})
+	fReq.cancel = make(chan int)
+	fReq.cancelOnce = new(sync.Once)
+	if timeout, ok := requestTimeout(request.Header); ok {
+		fReq.Deadline = startTime + timeout
+	}
 	return fReq
 }
 
-// Starts a new pipeline stage and makes it the CurrentStage.
+// Nanoseconds left before the Deadline, for passing the budget on to
+// backends.  Negative once it has passed.  ok is false if the request
+// has no deadline.
+func (fReq *Request) Remaining() (ns int64, ok bool) {
+	if fReq.Deadline == 0 {
+		return 0, false
+	}
+	return fReq.Deadline - time.Nanoseconds(), true
+}
+
+// The timeout the client asked for with X-Request-Timeout-Ms or a
+// gRPC style grpc-timeout header
+func requestTimeout(h http.Header) (int64, bool) {
+	if v := h.Get("X-Request-Timeout-Ms"); v != "" {
+		if ms, err := strconv.Atoi64(v); err == nil && ms > 0 {
+			return ms * 1e6, true
+		}
+	}
+	// up to 8 digits and a unit
+	if v := h.Get("Grpc-Timeout"); len(v) >= 2 && len(v) <= 9 {
+		n, err := strconv.Atoi64(v[0 : len(v)-1])
+		if err != nil || n <= 0 {
+			return 0, false
+		}
+		switch v[len(v)-1] {
+		case 'H':
+			return n * 3600e9, true
+		case 'M':
+			return n * 60e9, true
+		case 'S':
+			return n * 1e9, true
+		case 'm':
+			return n * 1e6, true
+		case 'u':
+			return n * 1e3, true
+		case 'n':
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// The TLS connection state or nil if the request didn't come in over
+// TLS.  PeerCertificates has the client's certs when the server asks
+// for them.
+func (fReq *Request) TLS() *tls.ConnectionState {
+	return fReq.HttpRequest.TLS
+}
+
+// The connection the request came in on, for filters that key off the
+// socket, like per-connection rate limits or geo lookups by address.
+// Behind a PROXY protocol load balancer RemoteAddr and LocalAddr are
+// the ones the balancer reported; see also ProxyTLV.  nil for
+// requests that didn't come from a Server.
+//
+// It's for looking at only.  The server owns the connection's reads,
+// writes, timeouts and closing, and doing any of those from a filter
+// will corrupt the requests around it.  To take the connection over
+// return a HijackResponse.
+func (fReq *Request) Conn() net.Conn {
+	return fReq.Connection
+}
+
+var requestCounter int64
+
+// A random 128 bit ID in hex
+func newRequestID(startTime int64) string {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		// no randomness to be had, settle for unique in this process
+		return fmt.Sprintf("%016x%016x", startTime, atomic.AddInt64(&requestCounter, 1))
+	}
+	return hex.EncodeToString(id)
+}
+
+// Closed when the request is cancelled, like when a TimeoutFilter gives
+// up on it.  Long running filters can select on it and stop early.
+func (fReq *Request) Cancelled() <-chan int {
+	return fReq.cancel
+}
+
+// Cancels the request.  Safe to call more than once.
+func (fReq *Request) Cancel() {
+	if fReq.cancel == nil {
+		return
+	}
+	fReq.cancelOnce.Do(func() {
+		close(fReq.cancel)
+	})
+}
+
+// A copy of the request for running filters that might be given up on,
+// like a pipeline past its deadline (see Server.executeWithDeadline).
+// It has its own stage list, open stages and Context, so a run that
+// goes on after the request moved on doesn't touch the original.  The
+// open stages and CurrentStage are copied too since the run still sets
+// their Status and finishes them.  The copy shares the cancel channel.
+// Close finished when the run is over, then either merge it back or
+// abandon it.
+func (fReq *Request) snapshot() *Request {
+	c := new(Request)
+	*c = *fReq
+	c.abandoned = nil
+	c.finished = make(chan int)
+
+	clones := make(map[*PipelineStageStat]*PipelineStageStat)
+	clone := func(pss *PipelineStageStat) *PipelineStageStat {
+		if pss == nil {
+			return nil
+		}
+		if cp, ok := clones[pss]; ok {
+			return cp
+		}
+		cp := new(PipelineStageStat)
+		*cp = *pss
+		clones[pss] = cp
+		return cp
+	}
+	c.CurrentStage = clone(fReq.CurrentStage)
+	c.openStages = make([]*PipelineStageStat, len(fReq.openStages))
+	for i, pss := range fReq.openStages {
+		c.openStages[i] = clone(pss)
+	}
+	c.PipelineStageStats = list.New()
+	if fReq.PipelineStageStats != nil {
+		for e := fReq.PipelineStageStats.Front(); e != nil; e = e.Next() {
+			v := e.Value
+			if pss, ok := v.(*PipelineStageStat); ok && clones[pss] != nil {
+				v = clones[pss]
+			}
+			c.PipelineStageStats.PushBack(v)
+		}
+	}
+	c.Context = make(map[string]interface{}, len(fReq.Context))
+	for k, v := range fReq.Context {
+		c.Context[k] = v
+	}
+	return c
+}
+
+// Takes over the state of a snapshot whose run finished in time
+func (fReq *Request) merge(c *Request) {
+	finished := fReq.finished
+	abandoned := append(fReq.abandoned, c.abandoned...)
+	*fReq = *c
+	fReq.finished = finished
+	fReq.abandoned = abandoned
+}
+
+// Gives up on a snapshot that's still running.  Its Context values
+// are picked up by finishAbandoned once it's done.
+func (fReq *Request) abandon(c *Request) {
+	fReq.abandoned = append(fReq.abandoned, c)
+}
+
+// Waits for the abandoned snapshots to finish and copies in the
+// Context values they added, like the in flight marker from
+// prometheus.Collector, so the RequestDoneCallback sees them.  Values
+// the request already has win.
+func (fReq *Request) finishAbandoned() {
+	for _, c := range fReq.abandoned {
+		<-c.finished
+		c.finishAbandoned()
+		for k, v := range c.Context {
+			if _, ok := fReq.Context[k]; !ok {
+				fReq.Context[k] = v
+			}
+		}
+	}
+	fReq.abandoned = nil
+}
+
+// True if the client sent 'Expect: 100-continue' and is waiting to send
+// the body.  Filters that reject the request without reading the body
+// can answer with a 417 Expectation Failed instead.
+func (fReq *Request) ExpectsContinue() bool {
+	cr, ok := fReq.HttpRequest.Body.(*continueReader)
+	return ok && !cr.sent
+}
+
+// Starts a new pipeline stage and makes it the CurrentStage.  Stages
+// started before the current one finishes are nested in it, like the
+// filters of a Pipeline picked by a Router.
 func (fReq *Request) startPipelineStage(name string) {
 	fReq.CurrentStage = NewPiplineStage(name)
 	fReq.PipelineStageStats.PushBack(fReq.CurrentStage)
+	fReq.openStages = append(fReq.openStages, fReq.CurrentStage)
 }
 
-// Finishes the CurrentStage.
+// Finishes the innermost open stage.  The stage it was nested in (if
+// any) becomes the CurrentStage again.
 func (fReq *Request) finishPipelineStage() {
+	if n := len(fReq.openStages); n > 0 {
+		fReq.CurrentStage = fReq.openStages[n-1]
+		fReq.openStages = fReq.openStages[0 : n-1]
+	}
 	fReq.CurrentStage.EndTime = time.Nanoseconds()
 	fReq.finishCommon()
+	fReq.resumeOpenStage()
 }
 
 // Appends an already completed PipelineStageStat directly to the list
@@ -80,14 +330,25 @@ func (fReq *Request) appendPipelineStage(pss *PipelineStageStat) {
 	fReq.PipelineStageStats.PushBack(pss)
 	fReq.CurrentStage = pss
 	fReq.finishCommon()
+	fReq.resumeOpenStage()
+}
+
+// Makes the innermost open stage the CurrentStage so its filter can
+// keep setting its Status
+func (fReq *Request) resumeOpenStage() {
+	if n := len(fReq.openStages); n > 0 {
+		fReq.CurrentStage = fReq.openStages[n-1]
+	}
 }
 
 // Does some required bookeeping for the pipeline and the pipeline signature
 func (fReq *Request) finishCommon() {
-	fReq.pipelineHash.Write([]byte(fReq.CurrentStage.Name))
-	fReq.pipelineHash.Write([]byte{fReq.CurrentStage.Status})
-	fReq.piplineTot += fReq.CurrentStage.EndTime - fReq.CurrentStage.StartTime
-
+	fReq.pipelineHash = crc32.Update(fReq.pipelineHash, crc32.IEEETable, []byte(fReq.CurrentStage.Name))
+	fReq.pipelineHash = crc32.Update(fReq.pipelineHash, crc32.IEEETable, []byte{fReq.CurrentStage.Status})
+	if len(fReq.openStages) == 0 {
+		// nested stages are already counted in the one they're in
+		fReq.piplineTot += fReq.CurrentStage.EndTime - fReq.CurrentStage.StartTime
+	}
 }
 
 // The Signature will only be complete in the RequestDoneCallback.  At
@@ -97,7 +358,7 @@ func (fReq *Request) finishCommon() {
 // To modify the signature for your own use, just set the 
 // request.CurrentStage.Status in your RequestFilter or ResponseFilter.
 func (fReq *Request) Signature() string {
-	return fmt.Sprintf("%X", fReq.pipelineHash.Sum32())
+	return fmt.Sprintf("%X", fReq.pipelineHash)
 }
 
 // Call from RequestDoneCallback.  Logs a bunch of information about the 
@@ -117,6 +378,84 @@ func (fReq *Request) Trace() {
 	Trace("%s %-30s S=0 Tot=%.4f %%=%.2f", fReq.ID, "Overhead", float32(fReq.Overhead)/1.0e9, float32(fReq.Overhead)/1.0e9/reqTime*100.0)
 }
 
+// Logs through the server's Logger (or the package logger) with the
+// request ID in front so one request's lines can be grepped out of
+// the log.  lvl is one of FINEST through CRITICAL.
+func (fReq *Request) Logf(lvl level, format string, args ...interface{}) {
+	l := fReq.logger
+	if l == nil {
+		l = logger
+	}
+	format = fReq.ID + " " + format
+	switch lvl {
+	case FINEST:
+		l.Finest(format, args...)
+	case FINE:
+		l.Fine(format, args...)
+	case DEBUG:
+		l.Debug(format, args...)
+	case TRACE:
+		l.Trace(format, args...)
+	case INFO:
+		l.Info(format, args...)
+	case WARNING:
+		l.Warn(format, args...)
+	case ERROR:
+		l.Error(format, args...)
+	default:
+		l.Critical(format, args...)
+	}
+}
+
+// Longest X-Falcore-Trace header (see Server.DebugTrace)
+const maxTraceBytes = 2048
+
+// The finished stages so far as "name;s=status;dur=ms" in the order
+// they started, Server-Timing style.  Cut off with "..." at
+// maxTraceBytes.
+func (fReq *Request) traceHeader() string {
+	trace := ""
+	for e := fReq.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		pss, _ := e.Value.(*PipelineStageStat)
+		if pss == nil || pss.EndTime == 0 {
+			continue
+		}
+		entry := fmt.Sprintf("%s;s=%d;dur=%.3f", pss.Name, pss.Status, float32(pss.EndTime-pss.StartTime)/1e6)
+		if trace != "" {
+			entry = ", " + entry
+		}
+		if len(trace)+len(entry) > maxTraceBytes-len(", ...") {
+			return trace + ", ..."
+		}
+		trace += entry
+	}
+	return trace
+}
+
+// Bytes read from and written to the connection for this request,
+// headers and bodies included.  Filled in with ResponseStatus, so use
+// them from the RequestDoneCallback.
+func (fReq *Request) BytesIn() int64 {
+	return fReq.bytesIn
+}
+
+func (fReq *Request) BytesOut() int64 {
+	return fReq.bytesOut
+}
+
+// The error a filter made with NewValueFilter failed with, for
+// ErrorHandlers and the RequestDoneCallback.  nil if none did.
+func (fReq *Request) FilterError() os.Error {
+	return fReq.filterError
+}
+
+// The Name of the Server the request came in on, so a shared pipeline
+// can apply different policies per listener, like only asking for auth
+// on the public port.  Empty if the server has no name.
+func (fReq *Request) ListenerName() string {
+	return fReq.listenerName
+}
+
 func (fReq *Request) finishRequest() {
 	fReq.EndTime = time.Nanoseconds()
 	fReq.Overhead = (fReq.EndTime - fReq.StartTime) - fReq.piplineTot
@@ -0,0 +1,40 @@
+package falcore
+
+import (
+	"http"
+)
+
+// Longest incoming ID we'll adopt.  Anything longer gets a new ID.
+const maxRequestIDLength = 128
+
+// Use an ID from an upstream service if it's sane.  It ends up in log
+// lines so control characters and spaces aren't allowed.
+func (fReq *Request) adoptID(id string) {
+	if id == "" || len(id) > maxRequestIDLength {
+		return
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f {
+			return
+		}
+	}
+	fReq.ID = id
+}
+
+// Sends the Request.ID back in a response header so clients and other
+// services can match their logs up with ours.  Header defaults to
+// X-Request-Id.  Pair with Server.RequestIDHeader to pass IDs through.
+type RequestIDFilter struct {
+	Header string
+}
+
+func (f *RequestIDFilter) FilterResponse(request *Request, res *http.Response) {
+	header := f.Header
+	if header == "" {
+		header = "X-Request-Id"
+	}
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	res.Header.Set(header, request.ID)
+}
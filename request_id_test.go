@@ -0,0 +1,48 @@
+package falcore
+
+import (
+	"http"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, req.ID)
+	}))
+	pipeline.Downstream.PushBack(&RequestIDFilter{})
+	srv := NewServer(0, pipeline)
+	srv.RequestIDHeader = "X-Request-Id"
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	tests := []struct {
+		name    string
+		id      string
+		adopted bool
+	}{
+		{"no header", "", false},
+		{"incoming id", "abc-123", true},
+		{"bad characters", "abc\x01def", false},
+	}
+	for _, test := range tests {
+		conn, buf := dialTestServer(t, srv)
+		raw := "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"
+		if test.id != "" {
+			raw += "X-Request-Id: " + test.id + "\r\n"
+		}
+		res, body, err := rawRequest(conn, buf, raw+"\r\n")
+		conn.Close()
+		if err != nil {
+			t.Errorf("%v Request failed: %v", test.name, err)
+			continue
+		}
+		echoed := res.Header.Get("X-Request-Id")
+		if echoed == "" || echoed != body {
+			t.Errorf("%v Response header '%v' doesn't match Request.ID '%v'", test.name, echoed, body)
+		}
+		if (echoed == test.id) != test.adopted {
+			t.Errorf("%v Wrong ID: %v", test.name, echoed)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package falcore
+
+import (
+	"http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutHeaders(t *testing.T) {
+	tests := []struct {
+		header  string
+		value   string
+		timeout int64
+		ok      bool
+	}{
+		{"X-Request-Timeout-Ms", "250", 250e6, true},
+		{"X-Request-Timeout-Ms", "0", 0, false},
+		{"X-Request-Timeout-Ms", "soon", 0, false},
+		{"Grpc-Timeout", "2S", 2e9, true},
+		{"Grpc-Timeout", "100m", 100e6, true},
+		{"Grpc-Timeout", "1H", 3600e9, true},
+		{"Grpc-Timeout", "5u", 5e3, true},
+		{"Grpc-Timeout", "123456789S", 0, false},
+		{"Grpc-Timeout", "10x", 0, false},
+		{"Grpc-Timeout", "S", 0, false},
+	}
+	for _, test := range tests {
+		h := http.Header{}
+		h.Set(test.header, test.value)
+		timeout, ok := requestTimeout(h)
+		if ok != test.ok || timeout != test.timeout {
+			t.Errorf("%v: %v got %v %v, expected %v %v", test.header, test.value, timeout, ok, test.timeout, test.ok)
+		}
+	}
+}
+
+func TestRequestRemaining(t *testing.T) {
+	req := validGetRequest()
+	if _, ok := req.Remaining(); ok {
+		t.Errorf("Request without a deadline has no remaining budget")
+	}
+
+	tmp, _ := http.NewRequest("GET", "/hello", nil)
+	tmp.Header.Set("X-Request-Timeout-Ms", "1000")
+	req = newRequest(tmp, nil, time.Nanoseconds())
+	remaining, ok := req.Remaining()
+	if !ok || remaining <= 0 || remaining > 1e9 {
+		t.Errorf("Expected up to a second remaining, got %v %v", remaining, ok)
+	}
+}
+
+func TestLogf(t *testing.T) {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	req := newRequest(tmp, nil, time.Nanoseconds())
+	l := &recordingLogger{errors: make(chan string, 1)}
+	req.logger = l
+	req.Logf(ERROR, "bad thing %v", 1)
+	if line := <-l.errors; line != req.ID+" bad thing %v" {
+		t.Errorf("Expected the request ID in front, got %q", line)
+	}
+}
+
+func TestTraceHeader(t *testing.T) {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	req := newRequest(tmp, nil, time.Nanoseconds())
+	req.startPipelineStage("outer")
+	req.startPipelineStage("inner")
+	req.CurrentStage.Status = 2
+	req.finishPipelineStage()
+	req.finishPipelineStage()
+	req.startPipelineStage("unfinished")
+	trace := req.traceHeader()
+	if !strings.HasPrefix(trace, "outer;s=0;dur=") || !strings.Contains(trace, ", inner;s=2;dur=") || strings.Contains(trace, "unfinished") {
+		t.Errorf("Unexpected trace %q", trace)
+	}
+
+	for i := 0; i < 200; i++ {
+		req.appendPipelineStage(&PipelineStageStat{Name: "a_long_stage_name", StartTime: 1, EndTime: 2})
+	}
+	if trace = req.traceHeader(); len(trace) > maxTraceBytes || !strings.HasSuffix(trace, ", ...") {
+		t.Errorf("Long traces should be cut off, got %v bytes", len(trace))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		// same start time for all of them
+		id := newRequest(tmp, nil, 1e9).ID
+		if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+			t.Fatalf("Expected 32 hex characters, got %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("Duplicate ID %v", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,71 @@
+package require_headers
+
+import (
+	"http"
+	"os"
+	"regexp"
+	"strings"
+	"falcore"
+)
+
+// A required header and, optionally, what its value has to look like.
+// Names are matched without case.
+type Requirement struct {
+	Name string
+	// nil allows any non-empty value
+	Match *regexp.Regexp
+}
+
+// falcore/require_headers.Filter rejects requests missing any of the
+// Required headers with a 400.  The body lists every missing header
+// and every header whose value didn't match so one round trip tells
+// the client everything that's wrong.
+type Filter struct {
+	Required []*Requirement
+}
+
+// Require names with any value
+func NewFilter(names ...string) *Filter {
+	f := new(Filter)
+	for _, name := range names {
+		f.Required = append(f.Required, &Requirement{Name: name})
+	}
+	return f
+}
+
+// Require name with a value matching pattern
+func (f *Filter) Require(name, pattern string) os.Error {
+	match, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	f.Required = append(f.Required, &Requirement{Name: name, Match: match})
+	return nil
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	var missing, invalid []string
+	for _, r := range f.Required {
+		name := http.CanonicalHeaderKey(r.Name)
+		value := req.Header.Get(name)
+		if value == "" {
+			missing = append(missing, name)
+		} else if r.Match != nil && !r.Match.MatchString(value) {
+			invalid = append(invalid, name)
+		}
+	}
+	if len(missing) == 0 && len(invalid) == 0 {
+		return nil
+	}
+
+	request.CurrentStage.Status = 2 // Fail
+	body := ""
+	if len(missing) > 0 {
+		body += "Missing headers: " + strings.Join(missing, ", ") + "\n"
+	}
+	if len(invalid) > 0 {
+		body += "Invalid headers: " + strings.Join(invalid, ", ") + "\n"
+	}
+	return falcore.SimpleResponse(req, 400, http.Header{"Content-Type": {"text/plain"}}, body)
+}
@@ -0,0 +1,53 @@
+package require_headers
+
+import (
+	"falcore"
+	"http"
+	"io/ioutil"
+	"testing"
+)
+
+func headerRequest(headers map[string]string) *falcore.Request {
+	tmp, _ := http.NewRequest("GET", "/api", nil)
+	for k, v := range headers {
+		tmp.Header.Set(k, v)
+	}
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestRequireHeaders(t *testing.T) {
+	f := NewFilter("x-api-key")
+	if err := f.Require("X-Api-Version", `^v[0-9]+$`); err != nil {
+		t.Fatalf("Bad pattern: %v", err)
+	}
+
+	if res := f.FilterRequest(headerRequest(map[string]string{"X-Api-Key": "k", "X-Api-Version": "v2"})); res != nil {
+		t.Errorf("Valid request was rejected: %v", res.StatusCode)
+	}
+
+	tests := []struct {
+		headers map[string]string
+		body    string
+	}{
+		{map[string]string{}, "Missing headers: X-Api-Key, X-Api-Version\n"},
+		{map[string]string{"X-Api-Key": "k", "X-Api-Version": "2"}, "Invalid headers: X-Api-Version\n"},
+		{map[string]string{"X-Api-Version": "latest"}, "Missing headers: X-Api-Key\nInvalid headers: X-Api-Version\n"},
+	}
+	for _, test := range tests {
+		res := f.FilterRequest(headerRequest(test.headers))
+		if res == nil {
+			t.Errorf("%v should be rejected", test.headers)
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 400 || string(body) != test.body {
+			t.Errorf("%v Expected 400 %q, got %v %q", test.headers, test.body, res.StatusCode, body)
+		}
+	}
+}
+
+func TestRequireBadPattern(t *testing.T) {
+	if err := NewFilter().Require("X-Thing", "(("); err == nil {
+		t.Errorf("Expected an error for a bad pattern")
+	}
+}
@@ -2,6 +2,7 @@ package falcore
 
 import (
 	"http"
+	"json"
 	"strings"
 	"os"
 )
@@ -22,6 +23,77 @@ func SimpleResponse(req *http.Request, status int, headers http.Header, body str
 	return res
 }
 
+// A response with v encoded as JSON.  If v can't be marshaled the
+// error is logged and a plain 500 is returned instead.
+func JSONResponse(req *http.Request, status int, headers http.Header, v interface{}) *http.Response {
+	body, err := json.Marshal(v)
+	if err != nil {
+		Error("Can't marshal JSON response: %v", err)
+		return SimpleResponse(req, 500, nil, "Internal Server Error\n")
+	}
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set("Content-Type", "application/json")
+	return SimpleResponse(req, status, headers, string(body))
+}
+
+// A plain text response saying only what the status means, like "Not
+// Found", so error details don't reach the client.  Set the Pipeline's
+// ErrorHandlers for nicer error pages.
+func ErrorResponse(req *http.Request, status int) *http.Response {
+	headers := http.Header{"Content-Type": {"text/plain"}}
+	return SimpleResponse(req, status, headers, http.StatusText(status)+"\n")
+}
+
+// A redirect to location with a short body for clients that don't
+// follow it
+func RedirectResponse(req *http.Request, status int, location string) *http.Response {
+	headers := http.Header{"Location": {location}}
+	return SimpleResponse(req, status, headers, "Redirecting to "+location+"\n")
+}
+
+// Adds names to h's Vary header, leaving out the ones already there,
+// for filters whose output depends on a request header.  Each filter
+// can add its own without repeating the others, and caches see one
+// consistent list.  Nothing is added to a Vary of "*".
+func AddVary(h http.Header, names ...string) {
+	vary := VaryHeaders(h)
+	added := false
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, v := range vary {
+			if v == name || v == "*" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			vary = append(vary, name)
+			added = true
+		}
+	}
+	if added {
+		h.Set("Vary", strings.Join(vary, ", "))
+	}
+}
+
+// The header names listed in h's Vary header lines
+func VaryHeaders(h http.Header) (vary []string) {
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return
+}
+
 // string type for response objects
 
 type fixedResBody strings.Reader
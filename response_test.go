@@ -0,0 +1,50 @@
+package falcore
+
+import (
+	"http"
+	"io/ioutil"
+	"testing"
+)
+
+func TestJSONResponse(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := JSONResponse(req, 404, http.Header{"X-Thing": {"1"}}, map[string]string{"error": "not found"})
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 404 || string(body) != `{"error":"not found"}` {
+		t.Errorf("Bad JSON response: %v %q", res.StatusCode, body)
+	}
+	if res.ContentLength != int64(len(body)) {
+		t.Errorf("Expected ContentLength %v, got %v", len(body), res.ContentLength)
+	}
+	if res.Header.Get("Content-Type") != "application/json" || res.Header.Get("X-Thing") != "1" {
+		t.Errorf("Bad headers: %v", res.Header)
+	}
+
+	// can't be marshaled
+	if res = JSONResponse(req, 200, nil, make(chan int)); res.StatusCode != 500 {
+		t.Errorf("Expected a 500 for a bad value, got %v", res.StatusCode)
+	}
+}
+
+func TestRedirectResponse(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := RedirectResponse(req, 302, "http://example.com/")
+	if res.StatusCode != 302 || res.Header.Get("Location") != "http://example.com/" {
+		t.Errorf("Bad redirect: %v %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	h := http.Header{"Vary": {"accept-encoding"}}
+	AddVary(h, "Origin", "Accept-Encoding")
+	AddVary(h, "origin")
+	if v := h["Vary"]; len(v) != 1 || v[0] != "Accept-Encoding, Origin" {
+		t.Errorf("Expected each name once, got %q", v)
+	}
+
+	h = http.Header{"Vary": {"*"}}
+	AddVary(h, "Origin")
+	if v := h.Get("Vary"); v != "*" {
+		t.Errorf("Vary * should be left alone, got %q", v)
+	}
+}
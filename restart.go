@@ -0,0 +1,63 @@
+package falcore
+
+import (
+	"os"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Environment variable telling a restarted process which fd is the
+// listening socket
+const ListenFdEnv = "FALCORE_LISTEN_FD"
+
+// Hot restarts go like this:
+//
+//   1. The running process calls Restart (on SIGHUP say).  A new copy of
+//      the binary starts with the listening socket as fd 3.
+//   2. The child sees ListenFd() != -1, calls FdListen with it and
+//      then SignalParentReady.
+//   3. Once the child is accepting, the parent gets SIGUSR1 and calls
+//      StopAccepting or Shutdown to drain its connections and exit.
+//
+// Nothing is dropped since the socket is never closed.  See
+// examples/hot_restart.
+func (srv *Server) Restart() (*os.Process, os.Error) {
+	if srv.listenerFile == nil {
+		return nil, os.NewError("falcore: Restart needs a TCP listener")
+	}
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, ListenFdEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env, fmt.Sprintf("%v=3", ListenFdEnv))
+	srv.log().Info("%s Restarting %v with socket %v", srv.serverLogPrefix(), os.Args[0], srv.SocketFd())
+	return os.StartProcess(os.Args[0], os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, srv.listenerFile},
+	})
+}
+
+// The listening socket passed in by Restart, or -1 if this process
+// wasn't started that way.
+func ListenFd() int {
+	if fd, err := strconv.Atoi(os.Getenv(ListenFdEnv)); err == nil && fd >= 0 {
+		return fd
+	}
+	return -1
+}
+
+// Waits for the server to start accepting and sends SIGUSR1 to the
+// parent so it can stop.  This consumes the AcceptReady signal.
+func (srv *Server) SignalParentReady() os.Error {
+	<-srv.AcceptReady
+	parent := syscall.Getppid()
+	srv.log().Info("%s Ready, signaling parent %v", srv.serverLogPrefix(), parent)
+	if e := syscall.Kill(parent, syscall.SIGUSR1); e != 0 {
+		return os.NewSyscallError("kill", e)
+	}
+	return nil
+}
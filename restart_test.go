@@ -0,0 +1,33 @@
+package falcore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestListenFd(t *testing.T) {
+	defer os.Setenv(ListenFdEnv, "")
+
+	tests := []struct {
+		env string
+		fd  int
+	}{
+		{"", -1},
+		{"3", 3},
+		{"junk", -1},
+		{"-2", -1},
+	}
+	for _, test := range tests {
+		os.Setenv(ListenFdEnv, test.env)
+		if fd := ListenFd(); fd != test.fd {
+			t.Errorf("Expected %v for '%v', got %v", test.fd, test.env, fd)
+		}
+	}
+}
+
+func TestRestartNeedsListener(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	if _, err := srv.Restart(); err == nil {
+		t.Errorf("Restart without a listener should fail")
+	}
+}
@@ -0,0 +1,112 @@
+package falcore
+
+import (
+	"http"
+	"time"
+)
+
+// Runs Filter again when it fails, for proxying to backends that
+// sometimes drop a request (see upstream.Upstream).  A response is a
+// failure if Retryable says so, by default any 5xx, which includes the
+// 502 and 504 the upstream filters send for connection errors and
+// timeouts.  After Retries more tries the last response is returned.
+//
+// Only idempotent requests (GET, HEAD, PUT, DELETE, OPTIONS and TRACE)
+// are retried unless AllowNonIdempotent is set.  The request body is
+// buffered (see Request.BufferBody) so every try sends all of it.
+// Bodies over MaxBodyBytes go through once without retries.
+//
+// The wait between tries starts at Backoff and doubles each time.  No
+// retry is started once the request is cancelled or the wait would run
+// past its Deadline.
+type RetryFilter struct {
+	Filter             RequestFilter
+	Retries            int
+	Backoff            int64
+	Retryable          func(res *http.Response) bool
+	AllowNonIdempotent bool
+	MaxBodyBytes       int
+}
+
+// Retries filter up to retries more times, starting 100ms apart, for
+// bodies up to 1MB
+func NewRetryFilter(filter RequestFilter, retries int) *RetryFilter {
+	return &RetryFilter{
+		Filter:       filter,
+		Retries:      retries,
+		Backoff:      1e8,
+		MaxBodyBytes: 1 << 20,
+	}
+}
+
+func (f *RetryFilter) FilterRequest(request *Request) *http.Response {
+	req := request.HttpRequest
+	if f.Retries <= 0 || !(f.AllowNonIdempotent || idempotent(req.Method)) {
+		return f.Filter.FilterRequest(request)
+	}
+	if err := request.BufferBody(f.MaxBodyBytes); err != nil {
+		Debug("%s Not retrying %v: %v", request.ID, filterName(f.Filter), err)
+		return f.Filter.FilterRequest(request)
+	}
+	// the wrapped filter may change the headers, like adding to
+	// X-Forwarded-For.  every try starts from the originals.
+	header := cloneHeader(req.Header)
+	backoff := f.Backoff
+	for try := 0; ; try++ {
+		res := f.Filter.FilterRequest(request)
+		if res == nil || !f.retryable(res) || try == f.Retries || !f.canWait(request, backoff) {
+			return res
+		}
+		Warn("%s %v failed with %v, retrying in %.4f", request.ID, filterName(f.Filter), res.StatusCode, float32(backoff)/1e9)
+		if backoff > 0 {
+			select {
+			case <-request.Cancelled():
+				return res
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if res.Body != nil {
+			res.Body.Close()
+		}
+		req.Header = cloneHeader(header)
+		request.BufferBody(f.MaxBodyBytes)
+	}
+	panic("unreachable")
+}
+
+func (f *RetryFilter) retryable(res *http.Response) bool {
+	if f.Retryable != nil {
+		return f.Retryable(res)
+	}
+	return res.StatusCode >= 500
+}
+
+// False if there's no point starting another try
+func (f *RetryFilter) canWait(request *Request, backoff int64) bool {
+	select {
+	case <-request.Cancelled():
+		return false
+	default:
+	}
+	if remaining, ok := request.Remaining(); ok && remaining <= backoff {
+		return false
+	}
+	return true
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
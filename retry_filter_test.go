@@ -0,0 +1,86 @@
+package falcore
+
+import (
+	"http"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Fails with status until it's been called fails times
+func flakyFilter(fails int, status int, bodies *[]string) RequestFilter {
+	calls := 0
+	return NewRequestFilter(func(req *Request) *http.Response {
+		body, _ := ioutil.ReadAll(req.HttpRequest.Body)
+		*bodies = append(*bodies, string(body))
+		req.HttpRequest.Header.Add("X-Forwarded-For", "10.0.0.1")
+		if calls++; calls <= fails {
+			return SimpleResponse(req.HttpRequest, status, nil, "try again")
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, req.HttpRequest.Header.Get("X-Forwarded-For"))
+	})
+}
+
+func retryRequest(method string) *Request {
+	tmp, _ := http.NewRequest(method, "/", strings.NewReader("payload"))
+	req := newRequest(tmp, nil, 0)
+	req.CurrentStage = NewPiplineStage("test")
+	return req
+}
+
+func TestRetryFilter(t *testing.T) {
+	var bodies []string
+	f := NewRetryFilter(flakyFilter(2, 503, &bodies), 3)
+	f.Backoff = 1e6
+	res := f.FilterRequest(retryRequest("PUT"))
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected the third try to succeed, got %v", res.StatusCode)
+	}
+	if len(bodies) != 3 {
+		t.Fatalf("Expected 3 tries, got %v", len(bodies))
+	}
+	for i, body := range bodies {
+		if body != "payload" {
+			t.Errorf("Try %v got body %q", i, body)
+		}
+	}
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "10.0.0.1" {
+		t.Errorf("Headers should start over on each try, got %q", body)
+	}
+}
+
+func TestRetryFilterExhausted(t *testing.T) {
+	var bodies []string
+	f := NewRetryFilter(flakyFilter(10, 502, &bodies), 2)
+	f.Backoff = 1e6
+	if res := f.FilterRequest(retryRequest("GET")); res.StatusCode != 502 {
+		t.Errorf("Expected the last response, got %v", res.StatusCode)
+	}
+	if len(bodies) != 3 {
+		t.Errorf("Expected 3 tries, got %v", len(bodies))
+	}
+}
+
+func TestRetryFilterConditions(t *testing.T) {
+	var bodies []string
+	f := NewRetryFilter(flakyFilter(1, 503, &bodies), 2)
+	f.Backoff = 0
+	if res := f.FilterRequest(retryRequest("POST")); res.StatusCode != 503 || len(bodies) != 1 {
+		t.Errorf("POST shouldn't be retried, got %v after %v tries", res.StatusCode, len(bodies))
+	}
+
+	bodies = nil
+	f = NewRetryFilter(flakyFilter(1, 404, &bodies), 2)
+	if res := f.FilterRequest(retryRequest("GET")); res.StatusCode != 404 || len(bodies) != 1 {
+		t.Errorf("4xx shouldn't be retried, got %v after %v tries", res.StatusCode, len(bodies))
+	}
+
+	bodies = nil
+	f = NewRetryFilter(flakyFilter(1, 404, &bodies), 2)
+	f.AllowNonIdempotent = true
+	f.Retryable = func(res *http.Response) bool { return res.StatusCode == 404 }
+	f.Backoff = 0
+	if res := f.FilterRequest(retryRequest("POST")); res.StatusCode != 200 || len(bodies) != 2 {
+		t.Errorf("Custom conditions should retry, got %v after %v tries", res.StatusCode, len(bodies))
+	}
+}
@@ -3,7 +3,11 @@ package falcore
 import (
 	"regexp"
 	"container/list"
+	"http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // Interface for defining routers
@@ -38,10 +42,22 @@ func (r *MatchAnyRoute) MatchString(str string) RequestFilter {
 	return r.Filter
 }
 
+// Optional interface for routes that need the whole request.  PathRouter
+// uses MatchRequest instead of MatchString for routes that implement it.
+type RequestRoute interface {
+	Route
+	MatchRequest(req *Request) RequestFilter
+}
+
 // Will match based on a regular expression
+//
+// If Params is set, the captured groups are stored in the
+// Request.Context when routed by PathRouter.  Params[0] names the first
+// group, Params[1] the second and so on.  Empty names are skipped.
 type RegexpRoute struct {
 	Match  *regexp.Regexp
 	Filter RequestFilter
+	Params []string
 }
 
 func (r *RegexpRoute) MatchString(str string) RequestFilter {
@@ -51,28 +67,124 @@ func (r *RegexpRoute) MatchString(str string) RequestFilter {
 	return nil
 }
 
+func (r *RegexpRoute) MatchRequest(req *Request) RequestFilter {
+	if len(r.Params) == 0 {
+		return r.MatchString(req.HttpRequest.URL.Path)
+	}
+	groups := r.Match.FindStringSubmatch(req.HttpRequest.URL.Path)
+	if groups == nil {
+		return nil
+	}
+	for i, name := range r.Params {
+		if name != "" && i+1 < len(groups) {
+			req.Context[name] = groups[i+1]
+		}
+	}
+	return r.Filter
+}
+
+// Will match a path exactly
+type ExactRoute struct {
+	Path   string
+	Filter RequestFilter
+}
+
+func (r *ExactRoute) MatchString(str string) RequestFilter {
+	if str == r.Path {
+		return r.Filter
+	}
+	return nil
+}
+
+// Will match a path prefix on segment boundaries, so "/api" matches
+// "/api" and "/api/users" but not "/apiary".
+type PrefixRoute struct {
+	Prefix string
+	Filter RequestFilter
+}
+
+func (r *PrefixRoute) MatchString(str string) RequestFilter {
+	if HasPathPrefix(str, r.Prefix) {
+		return r.Filter
+	}
+	return nil
+}
+
+// True if path starts with prefix on a segment boundary, like
+// PrefixRoute
+func HasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
 // Route requsts based on hostname
+//
+// Hosts are matched ignoring case and any port in the Host header.
+// A host can be a wildcard like "*.example.com" which matches every
+// subdomain of example.com but not example.com itself.  Exact matches
+// win over wildcards and longer wildcards win over shorter ones.
+//
+// When no host matches, the Default filter is used.  If there is no
+// Default, the NotFound filter is used which returns a 404 unless it's
+// changed.  Set NotFound to nil to fall through to the rest of the
+// pipeline instead.
 type HostRouter struct {
-	hosts map[string]RequestFilter
+	hosts    map[string]RequestFilter
+	Default  RequestFilter
+	NotFound RequestFilter
 }
 
 // Generate a new HostRouter instance
 func NewHostRouter() *HostRouter {
 	r := new(HostRouter)
 	r.hosts = make(map[string]RequestFilter)
+	r.NotFound = NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 404, nil, "Not Found\n")
+	})
 	return r
 }
 
-// TODO: support for non-exact matches
 func (r *HostRouter) AddMatch(host string, pipe RequestFilter) {
-	r.hosts[host] = pipe
+	r.hosts[strings.ToLower(host)] = pipe
 }
 
 func (r *HostRouter) SelectPipeline(req *Request) (pipe RequestFilter) {
-	return r.hosts[req.HttpRequest.Host]
+	host := strings.ToLower(stripPort(req.HttpRequest.Host))
+	if pipe = r.hosts[host]; pipe != nil {
+		return
+	}
+	// wildcards, most specific first
+	for i := strings.Index(host, "."); i >= 0; {
+		if pipe = r.hosts["*"+host[i:]]; pipe != nil {
+			return
+		}
+		next := strings.Index(host[i+1:], ".")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	if r.Default != nil {
+		return r.Default
+	}
+	return r.NotFound
+}
+
+// Removes the port from a Host header.  IPv6 literals keep their brackets.
+func stripPort(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 && i > strings.LastIndex(host, "]") {
+		return host[0:i]
+	}
+	return host
 }
 
 // Route requests based on path
+//
+// Routes are tried in the order they were added and the first match
+// wins.  When prefixes overlap, add the longer one first to get longest
+// match behavior.
 type PathRouter struct {
 	Routes *list.List
 }
@@ -97,14 +209,215 @@ func (r *PathRouter) AddMatch(match string, filter RequestFilter) (err os.Error)
 	return
 }
 
+// convenience method for adding ExactRoutes
+func (r *PathRouter) AddExact(path string, filter RequestFilter) {
+	r.Routes.PushBack(&ExactRoute{Path: path, Filter: filter})
+}
+
+// convenience method for adding PrefixRoutes
+func (r *PathRouter) AddPrefix(prefix string, filter RequestFilter) {
+	r.Routes.PushBack(&PrefixRoute{Prefix: prefix, Filter: filter})
+}
+
+// convenience method for adding RegexpRoutes that capture params
+func (r *PathRouter) AddParamMatch(match string, filter RequestFilter, params ...string) (err os.Error) {
+	route := &RegexpRoute{Filter: filter, Params: params}
+	if route.Match, err = regexp.Compile(match); err == nil {
+		r.Routes.PushBack(route)
+	}
+	return
+}
+
 // Will panic if r.Routes contains an object that isn't a Route
 func (r *PathRouter) SelectPipeline(req *Request) (pipe RequestFilter) {
 	var route Route
 	for r := r.Routes.Front(); r != nil; r = r.Next() {
 		route = r.Value.(Route)
-		if f := route.MatchString(req.HttpRequest.URL.Path); f != nil {
+		if rr, ok := route.(RequestRoute); ok {
+			if f := rr.MatchRequest(req); f != nil {
+				return f
+			}
+		} else if f := route.MatchString(req.HttpRequest.URL.Path); f != nil {
 			return f
 		}
 	}
 	return nil
 }
+
+// Dispatch requests based on the request method
+//
+// MethodRouter is a RequestFilter rather than a Router so it can
+// answer unknown methods with a 405 and an Allow header listing the
+// registered methods.  If HeadFallback is set, HEAD requests without
+// their own filter go to the GET filter and the body is dropped.
+type MethodRouter struct {
+	methods      map[string]RequestFilter
+	HeadFallback bool
+}
+
+// Generate a new MethodRouter instance
+func NewMethodRouter() *MethodRouter {
+	r := new(MethodRouter)
+	r.methods = make(map[string]RequestFilter)
+	r.HeadFallback = true
+	return r
+}
+
+func (r *MethodRouter) AddMethod(method string, filter RequestFilter) {
+	r.methods[strings.ToUpper(method)] = filter
+}
+
+func (r *MethodRouter) FilterRequest(req *Request) *http.Response {
+	method := req.HttpRequest.Method
+	if filter, ok := r.methods[method]; ok {
+		return filter.FilterRequest(req)
+	}
+	if method == "HEAD" && r.HeadFallback {
+		if filter, ok := r.methods["GET"]; ok {
+			res := filter.FilterRequest(req)
+			if res != nil && res.Body != nil {
+				res.Body.Close()
+				res.Body = nil
+			}
+			return res
+		}
+	}
+	return SimpleResponse(req.HttpRequest, 405, http.Header{"Allow": {r.allow()}}, "Method Not Allowed\n")
+}
+
+func (r *MethodRouter) allow() string {
+	methods := make([]string, 0, len(r.methods)+1)
+	for method := range r.methods {
+		methods = append(methods, method)
+	}
+	if _, ok := r.methods["GET"]; ok && r.HeadFallback {
+		if _, ok := r.methods["HEAD"]; !ok {
+			methods = append(methods, "HEAD")
+		}
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// Dispatch requests by the media types the client Accepts, for
+// endpoints that can answer in more than one format
+//
+// The filter for the offered type with the highest quality in the
+// Accept header wins.  The most specific range decides a type's
+// quality, so "text/*;q=0.5, text/html" prefers text/html over
+// text/plain.  Ties go to the type added first, which is also what
+// clients without an Accept header get.  If nothing offered is
+// acceptable the answer is a 406 listing what is.
+//
+// The chosen type is left in the Request's Context under
+// AcceptTypeKey and the response gets 'Vary: Accept'.
+// The Request.Context key for the type an AcceptRouter picked
+const AcceptTypeKey = "accept.type"
+
+type AcceptRouter struct {
+	types   []string
+	filters map[string]RequestFilter
+}
+
+func NewAcceptRouter() *AcceptRouter {
+	r := new(AcceptRouter)
+	r.filters = make(map[string]RequestFilter)
+	return r
+}
+
+func (r *AcceptRouter) AddType(mediaType string, filter RequestFilter) {
+	mediaType = strings.ToLower(mediaType)
+	if _, ok := r.filters[mediaType]; !ok {
+		r.types = append(r.types, mediaType)
+	}
+	r.filters[mediaType] = filter
+}
+
+func (r *AcceptRouter) FilterRequest(req *Request) *http.Response {
+	chosen := r.Negotiate(req.HttpRequest.Header.Get("Accept"))
+	if chosen == "" {
+		req.CurrentStage.Status = 2 // Fail
+		return SimpleResponse(req.HttpRequest, 406, http.Header{"Vary": {"Accept"}},
+			"Not Acceptable.  Available: "+strings.Join(r.types, ", ")+"\n")
+	}
+	req.Context[AcceptTypeKey] = chosen
+	res := r.filters[chosen].FilterRequest(req)
+	if res != nil {
+		if res.Header == nil {
+			res.Header = make(http.Header)
+		}
+		AddVary(res.Header, "Accept")
+	}
+	return res
+}
+
+// The added type that best matches an Accept header, or "" if none
+// are acceptable
+func (r *AcceptRouter) Negotiate(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		if len(r.types) > 0 {
+			return r.types[0]
+		}
+		return ""
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, t := range r.types {
+		if q := acceptQuality(ranges, t); q > bestQ {
+			best, bestQ = t, q
+		}
+	}
+	return best
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		ar := acceptRange{strings.ToLower(strings.TrimSpace(params[0])), 1}
+		if ar.mediaType == "" {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") || strings.HasPrefix(p, "Q=") {
+				if q, err := strconv.Atof64(p[2:]); err == nil && q >= 0 && q <= 1 {
+					ar.q = q
+				} else {
+					ar.q = 0
+				}
+			}
+		}
+		ranges = append(ranges, ar)
+	}
+	return ranges
+}
+
+// The quality of the most specific range matching mediaType
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	major := mediaType
+	if i := strings.Index(mediaType, "/"); i >= 0 {
+		major = mediaType[0:i]
+	}
+	q, specificity := 0.0, 0
+	for _, ar := range ranges {
+		s := 0
+		switch ar.mediaType {
+		case mediaType:
+			s = 3
+		case major + "/*":
+			s = 2
+		case "*/*", "*":
+			s = 1
+		}
+		if s > specificity {
+			q, specificity = ar.q, s
+		}
+	}
+	return q
+}
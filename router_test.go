@@ -47,7 +47,210 @@ func TestHostRouter(t *testing.T) {
 
 	req.HttpRequest.Host = "ngmoco.com"
 	filt = hr.SelectPipeline(req)
+	if filt != hr.NotFound {
+		t.Errorf("Host router should use NotFound when nothing matches")
+	}
+
+	hr.NotFound = nil
+	filt = hr.SelectPipeline(req)
 	if filt != nil {
-		t.Errorf("Host router got currently unsupported fuzzy match so you should update this test")
+		t.Errorf("Host router should fall through without a NotFound filter")
+	}
+}
+
+func TestHostRouterFuzzy(t *testing.T) {
+	hr := NewHostRouter()
+
+	var sf1 SimpleFilter = 1
+	var sf2 SimpleFilter = 2
+	var sf3 SimpleFilter = 3
+	var sf4 SimpleFilter = 4
+	hr.AddMatch("www.ngmoco.com", sf1)
+	hr.AddMatch("*.ngmoco.com", sf2)
+	hr.AddMatch("*.api.ngmoco.com", sf3)
+	hr.AddMatch("[::1]", sf4)
+
+	tests := []struct {
+		host   string
+		filter RequestFilter
+	}{
+		{"www.ngmoco.com", sf1},
+		{"WWW.NGMOCO.COM", sf1},
+		{"www.ngmoco.com:8080", sf1},
+		{"developer.ngmoco.com", sf2},
+		{"a.b.ngmoco.com", sf2},
+		{"v1.api.ngmoco.com:443", sf3},
+		{"ngmoco.com", hr.NotFound},
+		{"[::1]:8000", sf4},
+	}
+
+	req := validGetRequest()
+	for _, test := range tests {
+		req.HttpRequest.Host = test.host
+		if filt := hr.SelectPipeline(req); filt != test.filter {
+			t.Errorf("Host router picked the wrong pipeline for %v", test.host)
+		}
+	}
+
+	hr.Default = sf1
+	req.HttpRequest.Host = "example.com"
+	if filt := hr.SelectPipeline(req); filt != sf1 {
+		t.Errorf("Host router didn't use Default")
+	}
+}
+
+func TestPrefixRoute(t *testing.T) {
+	var sf1 SimpleFilter = 1
+	r := &PrefixRoute{Prefix: "/api", Filter: sf1}
+
+	for _, path := range []string{"/api", "/api/", "/api/users"} {
+		if r.MatchString(path) != sf1 {
+			t.Errorf("Prefix route didn't match %v", path)
+		}
+	}
+	for _, path := range []string{"/apiary", "/ap", "/"} {
+		if r.MatchString(path) != nil {
+			t.Errorf("Prefix route shouldn't match %v", path)
+		}
+	}
+}
+
+func TestPathRouter(t *testing.T) {
+	pr := NewPathRouter()
+
+	var sf1 SimpleFilter = 1
+	var sf2 SimpleFilter = 2
+	var sf3 SimpleFilter = 3
+	var sf4 SimpleFilter = 4
+	var sf5 SimpleFilter = 5
+	pr.AddExact("/api", sf1)
+	pr.AddPrefix("/api/v1", sf2)
+	pr.AddPrefix("/api", sf3)
+	pr.AddPrefix("/api/v1/users", sf4) // shadowed by /api/v1
+	if err := pr.AddParamMatch(`^/users/([0-9]+)/posts/([^/]+)$`, sf5, "user", "post"); err != nil {
+		t.Fatalf("Couldn't add route: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		filter RequestFilter
+	}{
+		{"/api", sf1},
+		{"/api/v1", sf2},
+		{"/api/v1/users", sf2},
+		{"/api/v2", sf3},
+		{"/apiary", nil},
+		{"/users/12/posts/hello", sf5},
+		{"/users/bob/posts/hello", nil},
+	}
+
+	for _, test := range tests {
+		req := validGetRequest()
+		req.HttpRequest.URL.Path = test.path
+		if filt := pr.SelectPipeline(req); filt != test.filter {
+			t.Errorf("Path router picked the wrong pipeline for %v", test.path)
+		}
+	}
+
+	req := validGetRequest()
+	req.HttpRequest.URL.Path = "/users/12/posts/hello"
+	pr.SelectPipeline(req)
+	if req.Context["user"] != "12" || req.Context["post"] != "hello" {
+		t.Errorf("Path router didn't capture params: %v", req.Context)
+	}
+}
+
+func TestMethodRouter(t *testing.T) {
+	mr := NewMethodRouter()
+	mr.AddMethod("get", NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "got")
+	}))
+	mr.AddMethod("POST", NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 201, nil, "posted")
+	}))
+
+	req := validGetRequest()
+	if res := mr.FilterRequest(req); res.StatusCode != 200 {
+		t.Errorf("Expected GET to be routed, got %v", res.StatusCode)
+	}
+
+	req.HttpRequest.Method = "POST"
+	if res := mr.FilterRequest(req); res.StatusCode != 201 {
+		t.Errorf("Expected POST to be routed, got %v", res.StatusCode)
+	}
+
+	req.HttpRequest.Method = "HEAD"
+	res := mr.FilterRequest(req)
+	if res.StatusCode != 200 || res.Body != nil {
+		t.Errorf("Expected HEAD to use GET without a body")
+	}
+
+	req.HttpRequest.Method = "DELETE"
+	res = mr.FilterRequest(req)
+	if res.StatusCode != 405 {
+		t.Errorf("Expected 405, got %v", res.StatusCode)
+	}
+	if allow := res.Header.Get("Allow"); allow != "GET, HEAD, POST" {
+		t.Errorf("Wrong Allow header: %v", allow)
+	}
+
+	mr.HeadFallback = false
+	req.HttpRequest.Method = "HEAD"
+	res = mr.FilterRequest(req)
+	if res.StatusCode != 405 || res.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("HEAD shouldn't fall back to GET when disabled")
+	}
+}
+
+func TestAcceptRouter(t *testing.T) {
+	ar := NewAcceptRouter()
+	for _, mt := range []string{"application/json", "text/html", "text/plain"} {
+		body := mt
+		ar.AddType(mt, NewRequestFilter(func(req *Request) *http.Response {
+			return SimpleResponse(req.HttpRequest, 200, nil, body)
+		}))
+	}
+
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/html", "text/html"},
+		{"text/*", "text/html"},
+		{"text/plain;q=0.9, text/html;q=0.5", "text/plain"},
+		{"text/*;q=0.5, text/html", "text/html"},
+		{"text/html;q=0.2, */*;q=0.1", "text/html"},
+		{"application/json;q=0, */*", "text/html"},
+		{"TEXT/Plain", "text/plain"},
+		{"image/png", ""},
+		{"*/*;q=0", ""},
+	}
+	for _, test := range tests {
+		if got := ar.Negotiate(test.accept); got != test.expected {
+			t.Errorf("Accept '%v': expected '%v', got '%v'", test.accept, test.expected, got)
+		}
+	}
+
+	req := validGetRequest()
+	req.HttpRequest.Header.Set("Accept", "text/html;q=0.5, text/plain")
+	res := ar.FilterRequest(req)
+	if res.StatusCode != 200 || req.Context[AcceptTypeKey] != "text/plain" {
+		t.Errorf("Expected text/plain, got %v %v", res.StatusCode, req.Context[AcceptTypeKey])
+	}
+	if res.Header.Get("Vary") != "Accept" {
+		t.Errorf("Expected Vary: Accept, got '%v'", res.Header.Get("Vary"))
+	}
+
+	req = validGetRequest()
+	req.CurrentStage = NewPiplineStage("test")
+	req.HttpRequest.Header.Set("Accept", "image/png")
+	res = ar.FilterRequest(req)
+	if res.StatusCode != 406 || req.CurrentStage.Status != 2 {
+		t.Errorf("Expected a failed 406, got %v", res.StatusCode)
+	}
+	if _, ok := req.Context[AcceptTypeKey]; ok {
+		t.Errorf("Content-Type shouldn't be set without a match")
 	}
 }
@@ -0,0 +1,59 @@
+package security_headers
+
+import (
+	"http"
+	"falcore"
+)
+
+// falcore/security_headers.Filter adds the usual security headers to
+// every response.  Add it to the Downstream list.
+//
+// Set a field to "" to leave that header out.  Headers the response
+// already has are left alone so a filter can set its own policy for
+// one response.  Set Override to always use the Filter's values.
+//
+// Strict-Transport-Security is only sent on TLS connections.
+// Browsers ignore it over plain http anyway.
+type Filter struct {
+	StrictTransportSecurity string
+	ContentTypeOptions      string
+	FrameOptions            string
+	ContentSecurityPolicy   string
+	ReferrerPolicy          string
+	// Replace headers already on the response
+	Override bool
+}
+
+// Create a Filter with conservative defaults.  There's no default
+// Content-Security-Policy since a useful one depends on the site.
+func NewFilter() *Filter {
+	f := new(Filter)
+	f.StrictTransportSecurity = "max-age=31536000"
+	f.ContentTypeOptions = "nosniff"
+	f.FrameOptions = "SAMEORIGIN"
+	f.ReferrerPolicy = "strict-origin-when-cross-origin"
+	return f
+}
+
+func (f *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	if request.TLS() != nil {
+		f.set(res.Header, "Strict-Transport-Security", f.StrictTransportSecurity)
+	}
+	f.set(res.Header, "X-Content-Type-Options", f.ContentTypeOptions)
+	f.set(res.Header, "X-Frame-Options", f.FrameOptions)
+	f.set(res.Header, "Content-Security-Policy", f.ContentSecurityPolicy)
+	f.set(res.Header, "Referrer-Policy", f.ReferrerPolicy)
+}
+
+func (f *Filter) set(h http.Header, name, value string) {
+	if value == "" {
+		return
+	}
+	if _, exists := h[name]; exists && !f.Override {
+		return
+	}
+	h.Set(name, value)
+}
@@ -0,0 +1,73 @@
+package security_headers
+
+import (
+	"crypto/tls"
+	"falcore"
+	"http"
+	"testing"
+)
+
+func run(f *Filter, secure bool, header http.Header) *http.Response {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	if secure {
+		tmp.TLS = &tls.ConnectionState{HandshakeComplete: true}
+	}
+	req := &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+	res := falcore.SimpleResponse(tmp, 200, header, "hello")
+	f.FilterResponse(req, res)
+	return res
+}
+
+func TestDefaults(t *testing.T) {
+	f := NewFilter()
+	res := run(f, true, nil)
+	expected := map[string]string{
+		"Strict-Transport-Security": "max-age=31536000",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+	}
+	for k, v := range expected {
+		if res.Header.Get(k) != v {
+			t.Errorf("Expected %v: '%v', got '%v'", k, v, res.Header.Get(k))
+		}
+	}
+	if _, ok := res.Header["Content-Security-Policy"]; ok {
+		t.Errorf("Content-Security-Policy shouldn't be set by default")
+	}
+
+	res = run(f, false, nil)
+	if res.Header.Get("Strict-Transport-Security") != "" {
+		t.Errorf("HSTS shouldn't be sent over plain http")
+	}
+	if res.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Other headers should still be sent over plain http")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	f := NewFilter()
+	f.FrameOptions = ""
+	f.ContentSecurityPolicy = "default-src 'self'"
+	res := run(f, false, nil)
+	if _, ok := res.Header["X-Frame-Options"]; ok {
+		t.Errorf("Disabled header was sent")
+	}
+	if res.Header.Get("Content-Security-Policy") != "default-src 'self'" {
+		t.Errorf("Expected the configured policy, got '%v'", res.Header.Get("Content-Security-Policy"))
+	}
+}
+
+func TestResponseOverride(t *testing.T) {
+	f := NewFilter()
+	res := run(f, false, http.Header{"X-Frame-Options": {"DENY"}})
+	if res.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("Response's own header should win, got '%v'", res.Header.Get("X-Frame-Options"))
+	}
+
+	f.Override = true
+	res = run(f, false, http.Header{"X-Frame-Options": {"DENY"}})
+	if res.Header.Get("X-Frame-Options") != "SAMEORIGIN" {
+		t.Errorf("Override should replace the response's header, got '%v'", res.Header.Get("X-Frame-Options"))
+	}
+}
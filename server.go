@@ -10,8 +10,12 @@ import (
 	"io"
 	"crypto/rand"
 	"crypto/tls"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -20,20 +24,217 @@ type Server struct {
 	Pipeline         *Pipeline
 	listener         net.Listener
 	listenerFile     *os.File
-	stopAccepting    chan int
+	stopAccepting    chan int // closed by StopAccepting
+	stopOnce         sync.Once
+	acceptDone       chan int // closed when the accept loop exits
 	handlerWaitGroup *sync.WaitGroup
 	logPrefix        string
 	AcceptReady      chan int
+	connMutex        *sync.Mutex
+	connections      map[net.Conn]bool // true while waiting for a request
+	shuttingDown     bool
+	// Allow persistent connections.  HTTP/1.1 connections are kept open
+	// unless the request or response carries 'Connection: close'.  HTTP/1.0
+	// clients must ask for keep-alive explicitly.  Defaults to true.
+	KeepAlive bool
+	// Size of the per connection read buffer.  Requests with header
+	// lines larger than this can't be parsed.  Defaults to 8KB.
+	ReadBufferSize int
+	// Size of the per connection write buffer.  Defaults to the bufio default.
+	WriteBufferSize int
+	// Timeouts (in nanoseconds) applied to the connection.  ReadTimeout bounds
+	// each read while receiving a request, WriteTimeout each write while
+	// sending the response.  IdleTimeout is used instead of ReadTimeout while
+	// a keep-alive connection waits for its next request.  0 means no timeout.
+	ReadTimeout  int64
+	WriteTimeout int64
+	IdleTimeout  int64
+	// Builds the response sent when a filter panics.  The panic value is
+	// passed in.  If nil, or if it returns nil, a plain 500 is sent.
+	PanicHandler func(req *Request, err interface{}) *http.Response
+	// Set SO_REUSEPORT on the listening socket so several processes can
+	// accept on the same port and let the kernel balance between them.
+	// Requires a kernel that supports the option (Linux 3.9+).
+	ReusePort bool
+	// Maximum number of simultaneous connections.  0 means no limit.
+	MaxConnections int
+	// What to do with new connections once MaxConnections is reached
+	OverflowPolicy OverflowPolicy
+	connSlots      chan int
+	// Where this server's log output goes.  If nil, the package level
+	// logger (see SetLogger) is used.
+	Logger Logger
+	// If set, requests carrying this header (like X-Request-Id) keep
+	// the value as their Request.ID instead of getting a new one.
+	// See RequestIDFilter for echoing it back.
+	RequestIDHeader string
+	// Answer 'Expect: 100-continue' with a '100 Continue' the first time
+	// a filter reads the request body.  If no filter reads it, the final
+	// response is sent without the 100 and the connection is closed.
+	// Requests with any other expectation get a 417.  Defaults to true.
+	ExpectContinue bool
+	// How long (in nanoseconds) Accept blocks before checking for
+	// StopAccepting.  Defaults to 3 seconds.  Shorter makes
+	// StopAccepting and Shutdown take effect sooner, longer wakes the
+	// accept loop less often.  With 0, StopAccepting waits for the next
+	// connection.  It's applied when the socket is opened, so set it
+	// before FdListen or ListenAndServe.
+	AcceptTimeout int64
+	// Base settings for ListenAndServeTLS, for cipher suites, client
+	// certs and so on.  It's copied when the server starts.  The cert
+	// from ListenAndServeTLS's arguments is added to its Certificates.
+	// Pass empty file names to only use the Certificates already set.
+	// With several certificates the one matching the SNI name is used.
+	// See ReloadCertificate for replacing the cert while serving.
+	TLSConfig *tls.Config
+	// what new TLS connections get, guarded by connMutex
+	tlsCurrent *tls.Config
+	// Expect a PROXY protocol header (as sent by HAProxy, AWS NLBs and
+	// other load balancers) at the start of every connection and use
+	// the client address from it as the RemoteAddr.  The text (v1) and
+	// binary (v2) versions are both understood.  Connections without
+	// a valid header are closed.  See Request.ProxyTLV.
+	ProxyProtocol bool
+	// Most bytes read while parsing a request line and headers before
+	// giving up with a 431.  Defaults to 1MB.  Single header lines are
+	// also limited by ReadBufferSize.
+	MaxHeaderBytes int
+	// Most bytes of headers a response can have.  A response over it
+	// (from a filter bug, usually) is logged and replaced with a 500
+	// rather than sent to clients that would reject it.  0 means no
+	// limit.
+	MaxResponseHeaderBytes int
+	// Send TCP keep-alive probes every TCPKeepAlive nanoseconds (rounded
+	// up to seconds) once a connection has gone quiet, so peers that
+	// vanished behind a NAT or firewall are noticed and their
+	// connections closed.  Unrelated to (HTTP) KeepAlive.  Only applies
+	// to TCP connections, including TLS and PROXY protocol ones.  0
+	// leaves the OS default, usually off.  Linux only.
+	TCPKeepAlive int64
+	// Default Request.Deadline (nanoseconds after the request starts)
+	// for requests that don't send X-Request-Timeout-Ms or grpc-timeout.
+	// Deadlines asked for by the client are capped at this.  0 means no
+	// default.  Once the deadline passes the request is cancelled and
+	// the client gets a 504 (and a closed connection) without waiting on
+	// the pipeline any longer.
+	RequestTimeout int64
+	// Takes over TLS connections that negotiate one of these protocols
+	// (through NPN) instead of http/1.1, like an HTTP/2 implementation.
+	// The protocols are advertised ahead of http/1.1.  The handler runs
+	// on the connection's goroutine and the connection is closed when it
+	// returns.
+	TLSNextProto map[string]func(srv *Server, conn *tls.Conn)
+	// How long (nanoseconds) a TLS client gets to finish the handshake
+	// before the connection is closed, so connections that never start
+	// one don't tie up a handler.  Defaults to 10 seconds.  0 uses the
+	// ReadTimeout.
+	TLSHandshakeTimeout int64
+	// How long (nanoseconds) to keep reading and throwing away what the
+	// client sends after the server decides to close a connection.
+	// Closing a socket with unread input makes the kernel reset the
+	// connection, which can destroy the end of a response the client
+	// hasn't read yet, like a 'Connection: close' response to a request
+	// whose body wasn't read or the last response before a restart.
+	// The connection is closed as soon as the client closes its side.
+	// 0 closes right away.
+	LingerTimeout int64
+	// Label for this server passed on to its requests, like "public" or
+	// "internal-tls", for pipelines shared between several servers.
+	// See Request.ListenerName.  ServerGroup sets it to the address.
+	Name string
+	// Close keep-alive connections after this many requests or once
+	// they've been open this long (nanoseconds) so busy clients can't
+	// hold on to a handler forever.  The last response gets a
+	// 'Connection: close'.  0 means no limit.  See IdleTimeout for
+	// closing connections that go quiet.
+	MaxKeepAliveRequests int
+	KeepAliveTimeout     int64
+	// Addresses or CIDR ranges ("10.0.0.0/8") of proxies trusted to
+	// report the client's scheme, host and address through
+	// X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-For.  See
+	// Request.Scheme, Request.Host and Request.ClientIP.
+	TrustedProxies []string
+	trustedNets    []*IPNet
+	// Add an X-Falcore-Trace header to every response listing the
+	// pipeline stages the request went through with their status and
+	// time in milliseconds.  It shows how the server sees a request
+	// from the client side, for debugging only: it tells anyone how
+	// the pipeline is built.
+	DebugTrace bool
+	// Settings for Drain and HandleSignals.  DrainDelay (nanoseconds)
+	// is how long to keep serving with Draining reporting true before
+	// shutting down, so load balancers see failing readiness checks
+	// and stop sending traffic first.  DrainTimeout is passed to
+	// Shutdown and defaults to 30 seconds.  DrainSignals defaults to
+	// SIGTERM and SIGINT.
+	DrainDelay   int64
+	DrainTimeout int64
+	DrainSignals []os.UnixSignal
+	draining     bool
+	counters     ServerStats
 }
 
+// Runtime counters for a Server.  See Server.Stats.
+type ServerStats struct {
+	// Connections handed to a handler and how many are still open
+	ConnectionsAccepted int64
+	ActiveConnections   int64
+	// Requests through the pipeline and how many are in it right now
+	RequestsServed   int64
+	RequestsInFlight int64
+	// Closed connections by how many requests they served, to see how
+	// well keep-alive is working.  Bucket i counts connections with at
+	// most RequestsPerConnectionBuckets[i] requests (and more than the
+	// bucket before), the last one connections with more than all of
+	// them.  Connections that failed the TLS handshake aren't counted.
+	RequestsPerConnection [len(RequestsPerConnectionBuckets) + 1]int64
+}
+
+// Upper bounds of the ServerStats.RequestsPerConnection buckets
+var RequestsPerConnectionBuckets = [...]int{0, 1, 2, 5, 10, 20, 50, 100}
+
+// Connections accepted per request served.  Near 1 means clients
+// aren't reusing connections, near 0 that they are.  0 before any
+// requests.
+func (s ServerStats) NewConnectionRatio() float64 {
+	if s.RequestsServed == 0 {
+		return 0
+	}
+	return float64(s.ConnectionsAccepted) / float64(s.RequestsServed)
+}
+
+// How the accept loop deals with connections over Server.MaxConnections
+type OverflowPolicy int
+
+const (
+	// Stop accepting until a connection closes (backpressure)
+	OverflowBlock OverflowPolicy = iota
+	// Close new connections right away
+	OverflowClose
+	// Send a 503 and close new connections
+	OverflowServiceUnavailable
+)
+
+// Create a server listening on port on all interfaces
 func NewServer(port int, pipeline *Pipeline) *Server {
+	return NewServerWithAddr(fmt.Sprintf(":%v", port), pipeline)
+}
+
+// Create a server listening on addr, like "127.0.0.1:8080" or "[::1]:8080"
+func NewServerWithAddr(addr string, pipeline *Pipeline) *Server {
 	s := new(Server)
-	s.Addr = fmt.Sprintf(":%v", port)
+	s.Addr = addr
 	s.Pipeline = pipeline
 	s.stopAccepting = make(chan int)
 	s.AcceptReady = make(chan int, 1)
 	s.handlerWaitGroup = new(sync.WaitGroup)
+	s.connMutex = new(sync.Mutex)
+	s.connections = make(map[net.Conn]bool)
 	s.logPrefix = fmt.Sprintf("%d", syscall.Getpid())
+	s.KeepAlive = true
+	s.ExpectContinue = true
+	s.AcceptTimeout = 3e9
+	s.TLSHandshakeTimeout = 10e9
 	return s
 }
 
@@ -43,8 +244,8 @@ func (srv *Server) FdListen(fd int) os.Error {
 	if srv.listener, err = net.FileListener(srv.listenerFile); err != nil {
 		return err
 	}
-	if l, ok := srv.listener.(*net.TCPListener); ok {
-		l.SetTimeout(3e9)
+	if _, ok := srv.listener.(*net.TCPListener); ok {
+		srv.setAcceptTimeout()
 	} else {
 		return os.NewError("Broken listener isn't TCP")
 	}
@@ -57,6 +258,9 @@ func (srv *Server) socketListen() os.Error {
 	if la, err = net.ResolveTCPAddr("tcp", srv.Addr); err != nil {
 		return err
 	}
+	if srv.ReusePort {
+		return srv.reusePortListen(la)
+	}
 
 	var l *net.TCPListener
 	if l, err = net.ListenTCP("tcp", la); err != nil {
@@ -69,19 +273,168 @@ func (srv *Server) socketListen() os.Error {
 	if e := syscall.SetNonblock(srv.listenerFile.Fd(), true); e != 0 {
 		return os.Errno(e)
 	}
-	l.SetTimeout(3e9)
+	srv.setAcceptTimeout()
+	return nil
+}
+
+// SO_REUSEPORT isn't in the syscall package yet
+const soReusePort = 0xf
+
+// The net package doesn't let us set options before bind so
+// build the socket by hand.
+func (srv *Server) reusePortListen(la *net.TCPAddr) (err os.Error) {
+	var sa syscall.Sockaddr
+	family := syscall.AF_INET
+	if la.IP == nil || la.IP.To4() != nil {
+		sa4 := &syscall.SockaddrInet4{Port: la.Port}
+		copy(sa4.Addr[:], la.IP.To4())
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: la.Port}
+		copy(sa6.Addr[:], la.IP)
+		sa = sa6
+	}
+
+	fd, e := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if e != 0 {
+		return os.NewSyscallError("socket", e)
+	}
+	if e = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); e != 0 {
+		syscall.Close(fd)
+		return os.NewSyscallError("setsockopt", e)
+	}
+	if e = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); e != 0 {
+		syscall.Close(fd)
+		return fmt.Errorf("falcore: can't set SO_REUSEPORT, does the kernel support it? %v", os.Errno(e))
+	}
+	if e = syscall.Bind(fd, sa); e != 0 {
+		syscall.Close(fd)
+		return os.NewSyscallError("bind", e)
+	}
+	if e = syscall.Listen(fd, syscall.SOMAXCONN); e != 0 {
+		syscall.Close(fd)
+		return os.NewSyscallError("listen", e)
+	}
+
+	srv.listenerFile = os.NewFile(fd, srv.Addr)
+	if srv.listener, err = net.FileListener(srv.listenerFile); err != nil {
+		return err
+	}
+	if e := syscall.SetNonblock(fd, true); e != 0 {
+		return os.Errno(e)
+	}
+	srv.setAcceptTimeout()
+	return nil
+}
+
+// Implemented by listeners that can limit how long Accept blocks
+type timeoutListener interface {
+	SetTimeout(nsec int64) os.Error
+}
+
+// Wake up the accept loop periodically so it notices StopAccepting.
+func (srv *Server) setAcceptTimeout() {
+	if l, ok := srv.listener.(timeoutListener); ok && srv.AcceptTimeout > 0 {
+		l.SetTimeout(srv.AcceptTimeout)
+	}
+}
+
+// Checks the Server configuration before we start listening
+func (srv *Server) validate() os.Error {
+	if srv.ReadBufferSize < 0 {
+		return os.NewError("falcore: ReadBufferSize can't be negative")
+	}
+	if srv.WriteBufferSize < 0 {
+		return os.NewError("falcore: WriteBufferSize can't be negative")
+	}
+	if srv.Pipeline == nil {
+		return os.NewError("falcore: Server has no Pipeline")
+	}
+	srv.trustedNets = nil
+	for _, cidr := range srv.TrustedProxies {
+		n, err := ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		srv.trustedNets = append(srv.trustedNets, n)
+	}
+	if srv.Pipeline.Upstream == nil || srv.Pipeline.Downstream == nil {
+		return os.NewError("falcore: Pipeline is missing its filter lists, create it with NewPipeline")
+	}
+	if srv.Pipeline.Upstream.Len() == 0 && srv.Pipeline.NotFoundHandler == nil {
+		srv.log().Warn("%s Pipeline has no Upstream filters, every request will get a 404", srv.serverLogPrefix())
+	}
 	return nil
 }
 
 func (srv *Server) ListenAndServe() os.Error {
+	if err := srv.listen(); err != nil {
+		return err
+	}
+	return srv.serve()
+}
+
+// Everything ListenAndServe does before serving
+func (srv *Server) listen() os.Error {
 	if srv.Addr == "" {
 		srv.Addr = ":http"
 	}
+	if err := srv.validate(); err != nil {
+		return err
+	}
 	if srv.listener == nil {
 		if err := srv.socketListen(); err != nil {
 			return err
 		}
 	}
+	srv.proxyProtocolListen()
+	return nil
+}
+
+// Serve connections from l instead of opening a socket, like a listener
+// wrapped to count connections or one from a test harness.  Accept
+// timeouts (see AcceptTimeout) are set if l supports them.  Without
+// them StopAccepting takes effect when the next connection arrives.
+// Restart needs a socket opened by the server itself.
+func (srv *Server) Serve(l net.Listener) os.Error {
+	if err := srv.validate(); err != nil {
+		return err
+	}
+	srv.listener = l
+	if srv.Addr == "" {
+		srv.Addr = l.Addr().String()
+	}
+	srv.setAcceptTimeout()
+	srv.proxyProtocolListen()
+	return srv.serve()
+}
+
+// Serve on a unix domain socket at path.  The socket file is created with the
+// given permissions and removed once the server stops.  A listener that's
+// already set, like one inherited with FdListen on a restart, is used as is
+// and its file is left for the process that made it.  If the listener
+// doesn't support accept timeouts, StopAccepting takes effect when the next
+// connection arrives.
+func (srv *Server) ListenAndServeUnix(path string, mode uint32) os.Error {
+	if err := srv.validate(); err != nil {
+		return err
+	}
+	if srv.listener == nil {
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path)
+		srv.listener = l
+		srv.Addr = path
+		if err = os.Chmod(path, mode); err != nil {
+			l.Close()
+			return err
+		}
+		srv.setAcceptTimeout()
+	}
+	srv.proxyProtocolListen()
 	return srv.serve()
 }
 
@@ -90,18 +443,21 @@ func (srv *Server) SocketFd() int {
 }
 
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) os.Error {
+	if err := srv.listenTLS(certFile, keyFile); err != nil {
+		return err
+	}
+	return srv.serve()
+}
+
+// Everything ListenAndServeTLS does before serving
+func (srv *Server) listenTLS(certFile, keyFile string) os.Error {
 	if srv.Addr == "" {
 		srv.Addr = ":https"
 	}
-	config := &tls.Config{
-		Rand:       rand.Reader,
-		Time:       time.Seconds,
-		NextProtos: []string{"http/1.1"},
+	if err := srv.validate(); err != nil {
+		return err
 	}
-
-	var err os.Error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	config, err := srv.tlsConfig(certFile, keyFile)
 	if err != nil {
 		return err
 	}
@@ -112,13 +468,246 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) os.Error {
 		}
 	}
 
-	srv.listener = tls.NewListener(srv.listener, config)
+	srv.proxyProtocolListen()
+	srv.setTLSConfig(config)
+	srv.listener = &tlsListener{srv.listener, srv}
+	return nil
+}
 
-	return srv.serve()
+// Loads a new cert and key for a server started with ListenAndServeTLS,
+// like after a renewal, without a restart.  Connections accepted from
+// then on get the new certificate.  Open connections are left alone.
+// Like ListenAndServeTLS, the cert is added to the ones in TLSConfig.
+// On error the old certificate stays.
+func (srv *Server) ReloadCertificate(certFile, keyFile string) os.Error {
+	srv.connMutex.Lock()
+	serving := srv.tlsCurrent != nil
+	srv.connMutex.Unlock()
+	if !serving {
+		return os.NewError("falcore: ReloadCertificate on a server that isn't serving TLS")
+	}
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv.setTLSConfig(config)
+	srv.log().Info("%s Reloaded TLS certificate from %v", srv.serverLogPrefix(), certFile)
+	return nil
+}
+
+func (srv *Server) setTLSConfig(config *tls.Config) {
+	srv.connMutex.Lock()
+	srv.tlsCurrent = config
+	srv.connMutex.Unlock()
+}
+
+// Like tls.NewListener but each connection gets the tls.Config current
+// when it's accepted, so ReloadCertificate can swap it.  The handshake
+// happens on the first read or write (see Server.handshake).
+type tlsListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l *tlsListener) Accept() (net.Conn, os.Error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.srv.connMutex.Lock()
+	config := l.srv.tlsCurrent
+	l.srv.connMutex.Unlock()
+	l.srv.setTCPKeepAlive(c)
+	return tls.Server(c, config), nil
+}
+
+// Turns on TCP keep-alive probes if TCPKeepAlive is set.  Connections
+// that aren't TCP underneath, like unix sockets, are left alone.
+func (srv *Server) setTCPKeepAlive(c net.Conn) {
+	if srv.TCPKeepAlive <= 0 {
+		return
+	}
+	if pc, ok := c.(*proxyConn); ok {
+		c = pc.Conn
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		srv.log().Debug("%s %v Can't set TCP keep-alive: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+		return
+	}
+	// the net package can't set the period so use a copy of the fd
+	f, err := tc.File()
+	if err != nil {
+		srv.log().Debug("%s %v Can't set TCP keep-alive period: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+		return
+	}
+	defer f.Close()
+	fd := f.Fd()
+	secs := int((srv.TCPKeepAlive + 1e9 - 1) / 1e9)
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs)
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+	// File puts the socket in blocking mode, which would break timeouts
+	syscall.SetNonblock(fd, true)
+}
+
+// Builds the tls.Config from TLSConfig (if set) and the cert files
+func (srv *Server) tlsConfig(certFile, keyFile string) (*tls.Config, os.Error) {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		*config = *srv.TLSConfig
+		config.Certificates = append([]tls.Certificate(nil), srv.TLSConfig.Certificates...)
+	}
+	if config.Rand == nil {
+		config.Rand = rand.Reader
+	}
+	if config.Time == nil {
+		config.Time = time.Seconds
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	var protos []string
+	for proto := range srv.TLSNextProto {
+		if !hasString(config.NextProtos, proto) {
+			protos = append(protos, proto)
+		}
+	}
+	if len(protos) > 0 {
+		sort.Strings(protos)
+		config.NextProtos = append(protos, config.NextProtos...)
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 {
+		return nil, os.NewError("falcore: no TLS certificates configured")
+	}
+	if len(config.Certificates) > 1 && config.NameToCertificate == nil {
+		config.BuildNameToCertificate()
+	}
+	return config, nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Hands TLS connections to the TLSNextProto handler for the
+// negotiated protocol if there is one.
+// Returns false if the connection should be served as HTTP.
+func (srv *Server) nextProto(c net.Conn) bool {
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok || len(srv.TLSNextProto) == 0 {
+		return false
+	}
+	state := tlsConn.ConnectionState()
+	handler, ok := srv.TLSNextProto[state.NegotiatedProtocol]
+	if !ok {
+		return false
+	}
+	srv.log().Debug("%s %v Handing off %v connection", srv.serverLogPrefix(), c.RemoteAddr(), state.NegotiatedProtocol)
+	c.SetTimeout(0)
+	handler(srv, tlsConn)
+	return true
 }
 
+// Finishes the TLS handshake on TLS connections within
+// TLSHandshakeTimeout.  False if the connection should be dropped.
+func (srv *Server) handshake(c net.Conn) bool {
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	timeout := srv.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = srv.ReadTimeout
+	}
+	c.SetTimeout(timeout)
+	if err := tlsConn.Handshake(); err != nil {
+		srv.log().Debug("%s %v TLS handshake failed: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+		return false
+	}
+	c.SetTimeout(0)
+	return true
+}
+
+// Stops the accept loop and waits for it to notice (see
+// AcceptTimeout).  It can be called any number of times from any
+// goroutine.  If the server isn't serving it returns right away.
 func (srv *Server) StopAccepting() {
-	srv.stopAccepting <- 1
+	srv.stopOnce.Do(func() { close(srv.stopAccepting) })
+	srv.connMutex.Lock()
+	done := srv.acceptDone
+	srv.connMutex.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Stops accepting and waits up to timeout nanoseconds for open
+// connections to finish.  Idle keep-alive connections are closed right
+// away and busy ones are closed once their current request is done.
+// Connections still open when the timeout expires are closed forcibly
+// and an error is returned.
+func (srv *Server) Shutdown(timeout int64) os.Error {
+	deadline := time.Nanoseconds() + timeout
+
+	srv.connMutex.Lock()
+	srv.shuttingDown = true
+	for c, idle := range srv.connections {
+		if idle {
+			c.Close()
+		}
+	}
+	srv.connMutex.Unlock()
+
+	srv.StopAccepting()
+	done := make(chan int)
+	go func() {
+		srv.handlerWaitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(deadline - time.Nanoseconds()):
+	}
+
+	srv.connMutex.Lock()
+	active := len(srv.connections)
+	for c := range srv.connections {
+		c.Close()
+	}
+	srv.connMutex.Unlock()
+	return fmt.Errorf("falcore: shutdown timed out with %v connections still active", active)
+}
+
+func (srv *Server) isShuttingDown() bool {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	return srv.shuttingDown
+}
+
+// Marks a connection as idle (waiting for a request) or busy.  Returns
+// false if a keep-alive connection should not wait for another request.
+func (srv *Server) setConnectionIdle(c net.Conn, idle bool, reqCount int) bool {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	srv.connections[c] = idle
+	return !(idle && srv.shuttingDown && reqCount > 0)
 }
 
 func (srv *Server) Port() int {
@@ -134,22 +723,64 @@ func (srv *Server) Port() int {
 
 func (srv *Server) serve() (e os.Error) {
 	var accept = true
+	srv.connMutex.Lock()
+	srv.acceptDone = make(chan int)
+	srv.connMutex.Unlock()
+	if srv.MaxConnections > 0 {
+		srv.connSlots = make(chan int, srv.MaxConnections)
+	}
 	srv.AcceptReady <- 1
+	// how long to wait after a temporary accept error, like running
+	// out of file descriptors.  retrying right away just spins.
+	var tempDelay int64
 	for accept {
+		// with OverflowBlock wait for a slot before accepting so the
+		// waiting connections sit in the listen backlog, not with us
+		held := false
+		if srv.connSlots != nil && srv.OverflowPolicy == OverflowBlock {
+			if held = srv.waitForConnectionSlot(); !held {
+				break
+			}
+		}
 		var c net.Conn
 		c, e = srv.listener.Accept()
+		if e != nil && held {
+			<-srv.connSlots
+		}
+		if ne, ok := e.(net.Error); ok && ne.Temporary() && !ne.Timeout() {
+			if tempDelay == 0 {
+				tempDelay = minAcceptDelay
+				srv.log().Error("%s SERVER Accept Error: %v; retrying in %vms", srv.serverLogPrefix(), e, tempDelay/1e6)
+			} else {
+				if tempDelay *= 2; tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				srv.log().Debug("%s SERVER Accept Error: %v; retrying in %vms", srv.serverLogPrefix(), e, tempDelay/1e6)
+			}
+			select {
+			case <-srv.stopAccepting:
+				accept = false
+			case <-time.After(tempDelay):
+			}
+			continue
+		}
+		tempDelay = 0
 		if e != nil {
 			if ope, ok := e.(*net.OpError); ok {
 				if !(ope.Timeout() && ope.Temporary()) {
-					Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), ope)
+					srv.log().Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), ope)
 				}
 			} else {
-				Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), e)
+				srv.log().Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), e)
 			}
-		} else {
+		} else if held || srv.acquireConnectionSlot() {
 			//Trace("Handling!")
+			atomic.AddInt64(&srv.counters.ConnectionsAccepted, 1)
+			atomic.AddInt64(&srv.counters.ActiveConnections, 1)
 			srv.handlerWaitGroup.Add(1)
 			go srv.handler(c)
+		} else {
+			srv.rejectConnection(c)
 		}
 		select {
 		case <-srv.stopAccepting:
@@ -157,32 +788,143 @@ func (srv *Server) serve() (e os.Error) {
 		default:
 		}
 	}
-	Trace("Stopped accepting, waiting for handlers")
+	close(srv.acceptDone)
+	srv.log().Trace("Stopped accepting, waiting for handlers")
 	// wait for handlers
 	srv.handlerWaitGroup.Wait()
 	return nil
 }
 
+// Backoff limits after temporary accept errors (nanoseconds)
+const (
+	minAcceptDelay = 5e6
+	maxAcceptDelay = 1e9
+)
+
+// Blocks until there's a connection slot or StopAccepting is called.
+// False if it's time to stop.
+func (srv *Server) waitForConnectionSlot() bool {
+	select {
+	case srv.connSlots <- 1:
+		return true
+	case <-srv.stopAccepting:
+	}
+	return false
+}
+
+// Returns false when we're at MaxConnections
+func (srv *Server) acquireConnectionSlot() bool {
+	if srv.connSlots == nil {
+		return true
+	}
+	select {
+	case srv.connSlots <- 1:
+		return true
+	default:
+	}
+	return false
+}
+
+const serviceUnavailable = "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+func (srv *Server) rejectConnection(c net.Conn) {
+	srv.log().Debug("%s %v Rejecting connection over MaxConnections", srv.serverLogPrefix(), c.RemoteAddr())
+	if srv.OverflowPolicy == OverflowServiceUnavailable {
+		// don't let a slow client hold up the accept loop
+		c.SetWriteTimeout(1e9)
+		io.WriteString(c, serviceUnavailable)
+	}
+	c.Close()
+}
+
 func (srv *Server) handler(c net.Conn) {
-	startTime := time.Nanoseconds()
 	defer srv.connectionFinished(c)
-	buf, err := bufio.NewReaderSize(c, 8192)
+	// TLS connections got theirs in tlsListener.Accept
+	srv.setTCPKeepAlive(c)
+	if !srv.handshake(c) || srv.nextProto(c) {
+		return
+	}
+	startTime := time.Nanoseconds()
+	connStart := startTime
+	rsize := srv.ReadBufferSize
+	if rsize == 0 {
+		rsize = 8192
+	}
+	// count what goes over the wire for Request.BytesIn and BytesOut
+	in, out := &countingReader{r: c}, &countingWriter{w: c}
+	lr := &headerLimitReader{r: in, remaining: -1}
+	buf, err := bufio.NewReaderSize(lr, rsize)
 	if err != nil {
-		Error("%s Read buffer fail: %v", srv.serverLogPrefix(), err)
+		srv.log().Error("%s Read buffer fail: %v", srv.serverLogPrefix(), err)
 		return
 	}
+	var wbuf *bufio.Writer
+	if srv.WriteBufferSize > 0 {
+		if wbuf, err = bufio.NewWriterSize(out, srv.WriteBufferSize); err != nil {
+			srv.log().Error("%s Write buffer fail: %v", srv.serverLogPrefix(), err)
+			return
+		}
+	} else {
+		wbuf = bufio.NewWriter(out)
+	}
 	var req *http.Request
-	// no keepalive (for now)
 	reqCount := 0
+	defer func() { srv.countConnectionRequests(reqCount) }()
 	keepAlive := true
+	// a response went out on a connection we're closing
+	linger := false
 	for err == nil && keepAlive {
-		if req, err = http.ReadRequest(buf); err == nil {
-			if req.Header.Get("Connection") != "Keep-Alive" {
-				keepAlive = false
+		if !srv.setConnectionIdle(c, true, reqCount) {
+			break
+		}
+		// what's already buffered belongs to this request
+		inStart, outStart := in.n-int64(buf.Buffered()), out.n
+		if reqCount > 0 && srv.IdleTimeout > 0 {
+			c.SetReadTimeout(srv.IdleTimeout)
+		} else {
+			c.SetReadTimeout(srv.ReadTimeout)
+		}
+		// leave room for what the bufio.Reader reads ahead
+		lr.limit(int64(srv.maxHeaderBytes() + rsize))
+		req, err = http.ReadRequest(buf)
+		lr.limit(-1)
+		if err == nil {
+			srv.setConnectionIdle(c, false, reqCount)
+			// restore the request timeout for reading the body
+			c.SetReadTimeout(srv.ReadTimeout)
+			if reqCount > 0 {
+				// don't charge the idle time between requests to this one
+				startTime = time.Nanoseconds()
 			}
+			keepAlive = srv.KeepAlive && wantsKeepAlive(req)
 			request := newRequest(req, c, startTime)
+			request.fromTrustedProxy = srv.trustedProxy(req.RemoteAddr)
+			request.proxies = srv.trustedNets
+			request.logger = srv.Logger
+			request.listenerName = srv.Name
+			if srv.RequestTimeout > 0 {
+				if limit := startTime + srv.RequestTimeout; request.Deadline == 0 || request.Deadline > limit {
+					request.Deadline = limit
+				}
+			}
+			if srv.RequestIDHeader != "" {
+				request.adoptID(req.Header.Get(srv.RequestIDHeader))
+			}
 			reqCount++
 			var res *http.Response
+			var cont *continueReader
+			expectFailed := false
+			timedOut := false
+			if expect := req.Header.Get("Expect"); expect != "" && srv.ExpectContinue && req.ProtoAtLeast(1, 1) {
+				if strings.ToLower(expect) == "100-continue" {
+					if req.ContentLength != 0 {
+						cont = &continueReader{body: req.Body, w: wbuf}
+						req.Body = cont
+					}
+				} else {
+					expectFailed = true
+				}
+			}
 
 			pssInit := new(PipelineStageStat)
 			pssInit.Name = "server.Init"
@@ -190,29 +932,429 @@ func (srv *Server) handler(c net.Conn) {
 			pssInit.EndTime = time.Nanoseconds()
 			request.appendPipelineStage(pssInit)
 			// execute the pipeline
-			if res = srv.Pipeline.execute(request); res == nil {
+			if expectFailed {
+				res = SimpleResponse(req, 417, nil, "Expectation Failed\n")
+				keepAlive = false
+			} else if res, timedOut = srv.executeWithDeadline(request); res == nil {
 				res = SimpleResponse(req, 404, nil, "Not Found")
 			}
+			if timedOut {
+				// the pipeline may still be reading the body.  make sure
+				// it can't send a 100 Continue after our response.
+				if cont != nil {
+					cont.abandon()
+				}
+				keepAlive = false
+			} else if _, ok := res.Body.(*hijackBody); ok {
+				srv.hijack(request, res, c, bufio.NewReadWriter(buf, wbuf))
+				return
+			} else if _, ok := res.Body.(*abortBody); ok {
+				srv.abort(request, res, c)
+				return
+			} else if cont != nil && !cont.sent {
+				// the client is still holding on to the body
+				keepAlive = false
+			}
+			if srv.MaxResponseHeaderBytes > 0 {
+				res = srv.checkResponseHeaders(request, res)
+			}
+			setResponseLength(req, res)
+			keepAlive = keepAlive && responseKeepAlive(res) && !srv.isShuttingDown() && !srv.keepAliveExpired(reqCount, connStart)
+			if res.Header == nil {
+				res.Header = make(http.Header)
+			}
+			if !keepAlive {
+				res.Close = true
+			} else if !req.ProtoAtLeast(1, 1) {
+				// HTTP/1.0 clients need to be told we're keeping it open
+				res.Header.Set("Connection", "keep-alive")
+			}
+			if srv.DebugTrace {
+				res.Header.Set("X-Falcore-Trace", request.traceHeader())
+			}
 			// cleanup
 			request.startPipelineStage("server.ResponseWrite")
-			req.Body.Close()
-			wbuf := bufio.NewWriter(c)
-			res.Write(wbuf)
-			wbuf.Flush()
+			if !timedOut {
+				req.Body.Close()
+			}
+			c.SetWriteTimeout(srv.WriteTimeout)
+			if body, ok := res.Body.(*StreamingBody); ok {
+				res.Body = &flushingBody{body, wbuf}
+			}
+			if err = res.Write(wbuf); err == nil {
+				err = wbuf.Flush()
+			}
+			if err != nil {
+				srv.log().Error("%s %v ERROR writing response: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+			}
 			if res.Body != nil {
 				res.Body.Close()
 			}
+			request.ResponseStatus = res.StatusCode
+			request.ResponseLength = res.ContentLength
+			request.bytesIn = in.n - int64(buf.Buffered()) - inStart
+			request.bytesOut = out.n - outStart
 			request.finishPipelineStage()
 			request.finishRequest()
 			srv.requestFinished(request)
-		} else {
+			linger = err == nil && !keepAlive
+		} else if lr.exceeded {
+			srv.log().Debug("%s %v Request headers over MaxHeaderBytes", srv.serverLogPrefix(), c.RemoteAddr())
+			c.SetWriteTimeout(srv.WriteTimeout)
+			io.WriteString(wbuf, headerTooLarge)
+			wbuf.Flush()
+			linger = true
+		} else if srv.isShuttingDown() {
+			srv.log().Debug("%s %v Connection closed for shutdown", srv.serverLogPrefix(), c.RemoteAddr())
+		} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if reqCount > 0 {
+				srv.log().Debug("%s %v Closing idle connection", srv.serverLogPrefix(), c.RemoteAddr())
+			} else {
+				srv.log().Error("%s %v Timeout reading request: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+			}
+		} else if err != io.ErrUnexpectedEOF && err != os.EOF {
 			// EOF is socket closed
-			if err != io.ErrUnexpectedEOF {
-				Error("%s %v ERROR reading request: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+			if _, ok := err.(net.Error); ok {
+				srv.log().Error("%s %v ERROR reading request: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+			} else {
+				// they sent something that isn't HTTP.  let them know
+				srv.log().Warn("%s %v Malformed request: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+				c.SetWriteTimeout(srv.WriteTimeout)
+				io.WriteString(wbuf, badRequest)
+				wbuf.Flush()
+				linger = true
+			}
+		}
+	}
+	srv.log().Debug("%s Processed %v requests on connection %v", srv.serverLogPrefix(), reqCount, c.RemoteAddr())
+	if linger {
+		srv.linger(c)
+	}
+}
+
+// Reads and discards until the client closes the connection or
+// LingerTimeout runs out.  Shutdown waits for lingering connections
+// like busy ones.  The deferred connectionFinished closes it
+// afterwards.
+func (srv *Server) linger(c net.Conn) {
+	if srv.LingerTimeout <= 0 {
+		return
+	}
+	deadline := time.Nanoseconds() + srv.LingerTimeout
+	discard := make([]byte, 4096)
+	for {
+		left := deadline - time.Nanoseconds()
+		if left <= 0 {
+			break
+		}
+		c.SetReadTimeout(left)
+		if _, err := c.Read(discard); err != nil {
+			break
+		}
+	}
+}
+
+const badRequest = "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+const headerTooLarge = "HTTP/1.1 431 Request Header Fields Too Large\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+func (srv *Server) maxHeaderBytes() int {
+	if srv.MaxHeaderBytes > 0 {
+		return srv.MaxHeaderBytes
+	}
+	return 1 << 20
+}
+
+// Limits how much can be read from the connection while reading
+// request headers.  A negative limit means no limit.
+type headerLimitReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (lr *headerLimitReader) limit(n int64) {
+	lr.remaining = n
+	lr.exceeded = false
+}
+
+func (lr *headerLimitReader) Read(p []byte) (int, os.Error) {
+	if lr.remaining < 0 {
+		return lr.r.Read(p)
+	}
+	if lr.remaining == 0 {
+		lr.exceeded = true
+		return 0, os.EOF
+	}
+	if int64(len(p)) > lr.remaining {
+		p = p[0:lr.remaining]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, os.Error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, os.Error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Wraps the body of an 'Expect: 100-continue' request and sends the
+// '100 Continue' the first time it's read.
+type continueReader struct {
+	body  io.ReadCloser
+	w     *bufio.Writer
+	sent  bool
+	err   os.Error
+	mutex sync.Mutex
+	// see abandon
+	abandoned bool
+}
+
+func (cr *continueReader) Read(p []byte) (int, os.Error) {
+	cr.mutex.Lock()
+	if cr.abandoned && cr.err == nil {
+		cr.err = os.EOF
+	}
+	if !cr.sent && cr.err == nil {
+		cr.sent = true
+		if _, cr.err = io.WriteString(cr.w, "HTTP/1.1 100 Continue\r\n\r\n"); cr.err == nil {
+			cr.err = cr.w.Flush()
+		}
+	}
+	err := cr.err
+	cr.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return cr.body.Read(p)
+}
+
+// Stops the 100 Continue from ever being sent.  For when the server
+// has given up on a request the pipeline is still working on.
+func (cr *continueReader) abandon() {
+	cr.mutex.Lock()
+	cr.abandoned = true
+	cr.mutex.Unlock()
+}
+
+func (cr *continueReader) Close() os.Error {
+	if !cr.sent {
+		// draining would wait on a client that's waiting on us
+		return nil
+	}
+	return cr.body.Close()
+}
+
+// True once a connection has used up MaxKeepAliveRequests or KeepAliveTimeout
+func (srv *Server) keepAliveExpired(reqCount int, connStart int64) bool {
+	if srv.MaxKeepAliveRequests > 0 && reqCount >= srv.MaxKeepAliveRequests {
+		return true
+	}
+	return srv.KeepAliveTimeout > 0 && time.Nanoseconds()-connStart >= srv.KeepAliveTimeout
+}
+
+// HTTP/1.1 connections are persistent unless the client says otherwise.
+// HTTP/1.0 clients have to ask for it.
+func wantsKeepAlive(req *http.Request) bool {
+	if req.Close || headerHasToken(req.Header, "Connection", "close") {
+		return false
+	}
+	if req.ProtoAtLeast(1, 1) {
+		return true
+	}
+	return headerHasToken(req.Header, "Connection", "keep-alive")
+}
+
+// The connection can only be reused if the response doesn't ask to close it
+// and the client can find the end of the body without waiting for EOF.
+func responseKeepAlive(res *http.Response) bool {
+	if res.Close || headerHasToken(res.Header, "Connection", "close") {
+		return false
+	}
+	if res.ContentLength < 0 && !isChunked(res.TransferEncoding) {
+		return false
+	}
+	return true
+}
+
+// Swaps res for a 500 if its headers are over MaxResponseHeaderBytes
+func (srv *Server) checkResponseHeaders(request *Request, res *http.Response) *http.Response {
+	size := responseHeaderSize(res)
+	if size <= srv.MaxResponseHeaderBytes {
+		return res
+	}
+	srv.log().Error("%s %s Response headers are %v bytes, over MaxResponseHeaderBytes.  Sending a 500 instead", srv.serverLogPrefix(), request.ID, size)
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	return SimpleResponse(request.HttpRequest, 500, nil, "Internal Server Error\n")
+}
+
+// Roughly how many bytes res's header lines take on the wire
+func responseHeaderSize(res *http.Response) int {
+	size := 0
+	for name, values := range res.Header {
+		for _, v := range values {
+			size += len(name) + len(v) + 4 // ": " and CRLF
+		}
+	}
+	return size
+}
+
+// Fills in the length for responses that have a body but no length.
+// Bodies with a known size get a Content-Length.  The rest are chunked
+// for HTTP/1.1 clients or ended by closing the connection.
+func setResponseLength(req *http.Request, res *http.Response) {
+	if !req.ProtoAtLeast(1, 1) && isChunked(res.TransferEncoding) {
+		// HTTP/1.0 clients can't parse chunks (or trailers).  the end
+		// of the body is marked by closing the connection instead.
+		res.TransferEncoding = nil
+		res.Trailer = nil
+		res.ContentLength = -1
+	}
+	if res.Body == nil || res.ContentLength > 0 || isChunked(res.TransferEncoding) {
+		return
+	}
+	if req.Method == "HEAD" || res.StatusCode < 200 || res.StatusCode == 204 || res.StatusCode == 304 {
+		// no body gets sent
+		return
+	}
+	if n, ok := bodyLength(res); ok {
+		res.ContentLength = n
+		return
+	}
+	res.ContentLength = -1
+	if req.ProtoAtLeast(1, 1) {
+		res.TransferEncoding = []string{"chunked"}
+	}
+}
+
+// The length of the response body if it can be known without reading it
+func bodyLength(res *http.Response) (int64, bool) {
+	if v := res.Header.Get("Content-Length"); v != "" {
+		if n, err := strconv.Atoi64(v); err == nil && n >= 0 {
+			return n, true
+		}
+	}
+	switch body := res.Body.(type) {
+	case *fixedResBody:
+		return int64((*strings.Reader)(body).Len()), true
+	case *StringBody:
+		if body.BodyBuffer != nil {
+			return int64(body.BodyBuffer.Len()), true
+		}
+	case interface {
+		Len() int
+	}:
+		// bytes.Buffer, strings.Reader and friends
+		return int64(body.Len()), true
+	}
+	return 0, false
+}
+
+func isChunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+// Checks for a token in a comma separated header like Connection
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h[key] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.ToLower(strings.TrimSpace(t)) == token {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Runs the pipeline.  If the request's Deadline passes first the
+// request is cancelled and a 504 is returned right away.  The late
+// response is thrown away whenever the pipeline gets to it.
+//
+// The pipeline runs on a snapshot of the request so one that's given
+// up on can't touch the request the server finishes with.  The
+// RequestDoneCallback waits for an abandoned pipeline to return and
+// sees the Context values its filters set.
+func (srv *Server) executeWithDeadline(request *Request) (*http.Response, bool) {
+	remaining, ok := request.Remaining()
+	if !ok {
+		return srv.executePipeline(request), false
+	}
+	if remaining > 0 {
+		run := request.snapshot()
+		done := make(chan *http.Response, 1)
+		go func() {
+			defer close(run.finished)
+			done <- srv.executePipeline(run)
+		}()
+		select {
+		case res := <-done:
+			request.merge(run)
+			return res, false
+		case <-time.After(remaining):
+		}
+		request.abandon(run)
+		go func() {
+			if late := <-done; late != nil && late.Body != nil {
+				late.Body.Close()
+			}
+		}()
+	}
+	request.Cancel()
+	srv.log().Warn("%s %s Request deadline passed, sending 504", srv.serverLogPrefix(), request.ID)
+	return SimpleResponse(request.HttpRequest, 504, nil, "Gateway Timeout\n"), true
+}
+
+// Runs the pipeline, turning a panic in any filter into an error response
+func (srv *Server) executePipeline(request *Request) (res *http.Response) {
+	atomic.AddInt64(&srv.counters.RequestsInFlight, 1)
+	defer func() {
+		atomic.AddInt64(&srv.counters.RequestsInFlight, -1)
+		atomic.AddInt64(&srv.counters.RequestsServed, 1)
+	}()
+	defer func() {
+		if x := recover(); x != nil {
+			srv.log().Error("%s %s PANIC in pipeline: %v\n%s", srv.serverLogPrefix(), request.ID, x, debug.Stack())
+			// the stages the panic went through never finished
+			request.openStages = nil
+			res = nil
+			if srv.PanicHandler != nil {
+				res = srv.PanicHandler(request, x)
 			}
+			if res == nil {
+				res = SimpleResponse(request.HttpRequest, 500, nil, "Internal Server Error\n")
+			}
+			// who knows what state the filters left things in
+			res.Close = true
 		}
+	}()
+	return srv.Pipeline.execute(request)
+}
+
+func (srv *Server) log() Logger {
+	if srv.Logger != nil {
+		return srv.Logger
 	}
-	//Debug("%s Processed %v requests on connection %v", srv.serverLogPrefix(), reqCount, c.RemoteAddr())
+	return logger
 }
 
 func (srv *Server) serverLogPrefix() string {
@@ -222,11 +1364,47 @@ func (srv *Server) serverLogPrefix() string {
 func (srv *Server) requestFinished(request *Request) {
 	if srv.Pipeline.RequestDoneCallback != nil {
 		// Don't block the connecion for this
-		go srv.Pipeline.RequestDoneCallback.FilterRequest(request)
+		go func() {
+			request.finishAbandoned()
+			srv.Pipeline.RequestDoneCallback.FilterRequest(request)
+			request.Context = nil
+		}()
+	} else {
+		request.Context = nil
 	}
 }
 
 func (srv *Server) connectionFinished(c net.Conn) {
+	srv.connMutex.Lock()
+	srv.connections[c] = false, false
+	srv.connMutex.Unlock()
 	c.Close()
+	if srv.connSlots != nil {
+		<-srv.connSlots
+	}
+	atomic.AddInt64(&srv.counters.ActiveConnections, -1)
 	srv.handlerWaitGroup.Done()
 }
+
+// A snapshot of the server's counters.  Each counter is read on its
+// own so they can be off from each other by a request or two.
+func (srv *Server) Stats() ServerStats {
+	stats := ServerStats{
+		ConnectionsAccepted: atomic.AddInt64(&srv.counters.ConnectionsAccepted, 0),
+		ActiveConnections:   atomic.AddInt64(&srv.counters.ActiveConnections, 0),
+		RequestsServed:      atomic.AddInt64(&srv.counters.RequestsServed, 0),
+		RequestsInFlight:    atomic.AddInt64(&srv.counters.RequestsInFlight, 0),
+	}
+	for i := range stats.RequestsPerConnection {
+		stats.RequestsPerConnection[i] = atomic.AddInt64(&srv.counters.RequestsPerConnection[i], 0)
+	}
+	return stats
+}
+
+func (srv *Server) countConnectionRequests(n int) {
+	i := 0
+	for i < len(RequestsPerConnectionBuckets) && n > RequestsPerConnectionBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&srv.counters.RequestsPerConnection[i], 1)
+}
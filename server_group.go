@@ -0,0 +1,101 @@
+package falcore
+
+import (
+	"os"
+)
+
+// Several Servers sharing one Pipeline, like a TLS port for the world
+// and a plaintext port for internal health checks, started and shut
+// down together.
+//
+// Add the servers and adjust their settings, then call Start and
+// Wait.  The group takes each server's AcceptReady signal, so don't
+// read those yourself.
+type ServerGroup struct {
+	Pipeline *Pipeline
+	Servers  []*Server
+	// Gets a value once every server is accepting
+	AcceptReady chan int
+	listeners   []func() os.Error
+	done        chan os.Error
+}
+
+func NewServerGroup(pipeline *Pipeline) *ServerGroup {
+	return &ServerGroup{Pipeline: pipeline, AcceptReady: make(chan int, 1)}
+}
+
+// Adds a plaintext server on addr
+func (g *ServerGroup) Add(addr string) *Server {
+	srv := NewServerWithAddr(addr, g.Pipeline)
+	srv.Name = addr
+	g.Servers = append(g.Servers, srv)
+	g.listeners = append(g.listeners, srv.listen)
+	return srv
+}
+
+// Adds a TLS server on addr.  See ListenAndServeTLS for the files.
+func (g *ServerGroup) AddTLS(addr, certFile, keyFile string) *Server {
+	srv := NewServerWithAddr(addr, g.Pipeline)
+	srv.Name = addr
+	g.Servers = append(g.Servers, srv)
+	g.listeners = append(g.listeners, func() os.Error {
+		return srv.listenTLS(certFile, keyFile)
+	})
+	return srv
+}
+
+// Opens every server's socket and starts serving.  If any of them
+// can't listen, the sockets already opened are closed and the error
+// is returned without serving anything.
+func (g *ServerGroup) Start() os.Error {
+	for i, listen := range g.listeners {
+		if err := listen(); err != nil {
+			for _, srv := range g.Servers[0:i] {
+				srv.listener.Close()
+			}
+			return err
+		}
+	}
+	g.done = make(chan os.Error, len(g.Servers))
+	for _, srv := range g.Servers {
+		go func(srv *Server) {
+			g.done <- srv.serve()
+		}(srv)
+	}
+	go func() {
+		for _, srv := range g.Servers {
+			<-srv.AcceptReady
+		}
+		g.AcceptReady <- 1
+	}()
+	return nil
+}
+
+// Blocks until every server has stopped.  Returns the first error.
+func (g *ServerGroup) Wait() os.Error {
+	var err os.Error
+	for _ = range g.Servers {
+		if e := <-g.done; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Shuts all the servers down at once so they share the one timeout.
+// See Server.Shutdown.  Returns the first error.
+func (g *ServerGroup) Shutdown(timeout int64) os.Error {
+	results := make(chan os.Error, len(g.Servers))
+	for _, srv := range g.Servers {
+		go func(srv *Server) {
+			results <- srv.Shutdown(timeout)
+		}(srv)
+	}
+	var err os.Error
+	for _ = range g.Servers {
+		if e := <-results; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package falcore
+
+import (
+	"http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerGroup(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	}))
+	g := NewServerGroup(pipeline)
+	g.Add("127.0.0.1:0")
+	g.Add("127.0.0.1:0").KeepAlive = false
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	select {
+	case <-g.AcceptReady:
+	case <-time.After(2e9):
+		t.Fatalf("Group never became ready")
+	}
+
+	for _, srv := range g.Servers {
+		conn, buf := dialTestServer(t, srv)
+		res, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		conn.Close()
+		if err != nil || res.StatusCode != 200 || !strings.HasPrefix(body, "hello") {
+			t.Errorf("Server on %v didn't answer: %v %v", srv.Port(), res, err)
+		}
+	}
+
+	if err := g.Shutdown(1e9); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := g.Wait(); err != nil {
+		t.Errorf("Wait returned %v", err)
+	}
+}
+
+func TestServerGroupStartFailure(t *testing.T) {
+	g := NewServerGroup(NewPipeline())
+	first := g.Add("127.0.0.1:0")
+	g.Add("no-such-host.invalid:http")
+	if err := g.Start(); err == nil {
+		t.Fatalf("Start should fail when a server can't listen")
+	}
+	if _, err := first.listener.Accept(); err == nil {
+		t.Errorf("Sockets already opened should be closed")
+	}
+}
@@ -0,0 +1,1403 @@
+package falcore
+
+import (
+	"testing"
+	"http"
+	"net"
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+func startTestServer(srv *Server) {
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			panic(fmt.Sprintf("Could not start falcore: %v", err))
+		}
+	}()
+	for srv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+}
+
+func helloServer() *Server {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	return srv
+}
+
+func dialTestServer(t *testing.T, srv *Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+	if err != nil {
+		t.Fatalf("Can't connect to test server: %v", err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+// Writes raw request text to the connection and reads back the response
+func rawRequest(conn net.Conn, buf *bufio.Reader, raw string) (*http.Response, string, os.Error) {
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		return nil, "", err
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	res, err := http.ReadResponse(buf, req)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body), err
+}
+
+var keepAliveTests = []struct {
+	name      string
+	request   string
+	keepAlive bool
+}{
+	{
+		"HTTP/1.1 default",
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		true,
+	},
+	{
+		"HTTP/1.1 close",
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+		false,
+	},
+	{
+		"HTTP/1.0 default",
+		"GET / HTTP/1.0\r\n\r\n",
+		false,
+	},
+	{
+		"HTTP/1.0 keep-alive",
+		"GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+		true,
+	},
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv := helloServer()
+	for _, test := range keepAliveTests {
+		conn, buf := dialTestServer(t, srv)
+		for i := 0; i < 2; i++ {
+			res, body, err := rawRequest(conn, buf, test.request)
+			if i == 1 && !test.keepAlive {
+				if err == nil {
+					t.Errorf("%v Connection should have been closed", test.name)
+				}
+				break
+			}
+			if err != nil {
+				t.Errorf("%v Request %v failed: %v", test.name, i, err)
+				break
+			}
+			if res.StatusCode != 200 || body != "hello" {
+				t.Errorf("%v Bad response %v %q", test.name, res.StatusCode, body)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestPlaintextTLSState(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, fmt.Sprintf("%v", req.TLS() != nil))
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	if _, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || body != "false" {
+		t.Errorf("Plaintext request shouldn't have TLS state: %v %v", body, err)
+	}
+}
+
+func TestLargeHeaders(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, fmt.Sprintf("%v", len(req.HttpRequest.Header.Get("Cookie"))))
+	}))
+	srv := NewServer(0, pipeline)
+	srv.ReadBufferSize = 32768
+	startTestServer(srv)
+
+	cookie := make([]byte, 12000)
+	for i := range cookie {
+		cookie[i] = 'a'
+	}
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	res, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\nCookie: "+string(cookie)+"\r\n\r\n")
+	if err != nil {
+		t.Fatalf("Request with large headers failed: %v", err)
+	}
+	if res.StatusCode != 200 || body != "12000" {
+		t.Errorf("Bad response to large headers: %v %q", res.StatusCode, body)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	srv := helloServer()
+	srv.MaxHeaderBytes = 1024
+	defer srv.StopAccepting()
+
+	// exactly what the server will read (limit plus read buffer) so
+	// nothing is left unread when it closes
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	for len(raw) < 1024+8192 {
+		raw += "X-Pad: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\r\n"
+	}
+	raw = raw[0 : 1024+8192]
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	res, _, err := rawRequest(conn, buf, raw)
+	if err != nil {
+		t.Fatalf("Expected a response, got %v", err)
+	}
+	if res.StatusCode != 431 {
+		t.Errorf("Expected status 431, got %v", res.StatusCode)
+	}
+
+	// normal requests are fine
+	conn2, buf2 := dialTestServer(t, srv)
+	defer conn2.Close()
+	if res, _, err = rawRequest(conn2, buf2, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || res.StatusCode != 200 {
+		t.Errorf("Small request failed: %v %v", res, err)
+	}
+}
+
+func TestMalformedRequest(t *testing.T) {
+	srv := helloServer()
+	defer srv.StopAccepting()
+
+	for _, raw := range []string{
+		"GARBAGE\r\n\r\n",
+		"GET /\r\n\r\n",
+		"GET / HTTP/1.1\r\nNo colon here\r\n\r\n",
+	} {
+		conn, buf := dialTestServer(t, srv)
+		conn.SetReadTimeout(2e9)
+		res, _, err := rawRequest(conn, buf, raw)
+		if err != nil {
+			t.Errorf("%q Expected a response, got %v", raw, err)
+		} else if res.StatusCode != 400 {
+			t.Errorf("%q Expected status 400, got %v", raw, res.StatusCode)
+		}
+		conn.Close()
+	}
+}
+
+func TestLingerTimeout(t *testing.T) {
+	srv := helloServer()
+	defer srv.StopAccepting()
+	srv.LingerTimeout = 2e8
+
+	// the body is never read so it's still coming in when the server
+	// closes the connection
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	raw := "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: 65536\r\n\r\n"
+	raw += strings.Repeat("x", 65536)
+	res, body, err := rawRequest(conn, buf, raw)
+	if err != nil {
+		t.Fatalf("Expected a response, got %v", err)
+	}
+	if res.StatusCode != 200 || body != "hello" {
+		t.Errorf("Expected the full response, got %v %q", res.StatusCode, body)
+	}
+
+	start := time.Nanoseconds()
+	if _, err = buf.ReadByte(); err != os.EOF {
+		t.Errorf("Expected the connection to close, got %v", err)
+	}
+	if took := time.Nanoseconds() - start; took < 1e8 || took > 1e9 {
+		t.Errorf("Expected the server to linger for about 200ms, took %vms", took/1e6)
+	}
+}
+
+// Fails every Accept like a process out of file descriptors
+type exhaustedListener struct {
+	accepts chan int64
+}
+
+func (l *exhaustedListener) Accept() (net.Conn, os.Error) {
+	l.accepts <- time.Nanoseconds()
+	return nil, &net.OpError{Op: "accept", Net: "tcp", Error: os.Errno(syscall.EMFILE)}
+}
+
+func (l *exhaustedListener) Close() os.Error {
+	return nil
+}
+
+func (l *exhaustedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	l := &exhaustedListener{make(chan int64, 100)}
+	srv := NewServer(0, NewPipeline())
+	srv.listener = l
+	startTestServer(srv)
+
+	var times []int64
+	timeout := time.After(5e9)
+	for len(times) < 6 {
+		select {
+		case at := <-l.accepts:
+			times = append(times, at)
+		case <-timeout:
+			t.Fatalf("Accept stopped being retried")
+		}
+	}
+	srv.StopAccepting()
+
+	last := int64(0)
+	for i := 1; i < len(times); i++ {
+		gap := times[i] - times[i-1]
+		if gap < minAcceptDelay || gap < last {
+			t.Errorf("Expected a growing delay between accepts, got %vns after %vns", gap, last)
+		}
+		last = gap
+	}
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	srv.AcceptTimeout = 5e7
+	done := make(chan os.Error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+	for srv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+	start := time.Nanoseconds()
+	srv.StopAccepting()
+	select {
+	case <-done:
+	case <-time.After(2e9):
+		t.Fatalf("Server didn't stop")
+	}
+	if took := time.Nanoseconds() - start; took > 1e9 {
+		t.Errorf("StopAccepting took %vms with a 50ms AcceptTimeout", took/1e6)
+	}
+}
+
+func TestStopAcceptingTwice(t *testing.T) {
+	done := make(chan int)
+	go func() {
+		// never started
+		NewServer(0, NewPipeline()).StopAccepting()
+
+		srv := NewServer(0, NewPipeline())
+		srv.AcceptTimeout = 5e7
+		startTestServer(srv)
+		stopped := make(chan int)
+		for i := 0; i < 3; i++ {
+			go func() {
+				srv.StopAccepting()
+				stopped <- 1
+			}()
+		}
+		for i := 0; i < 3; i++ {
+			<-stopped
+		}
+		srv.StopAccepting()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2e9):
+		t.Fatalf("StopAccepting blocked")
+	}
+}
+
+// Counts the connections it hands out
+type countingListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (l *countingListener) Accept() (net.Conn, os.Error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func TestServe(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	l := &countingListener{Listener: inner}
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	}))
+	srv := NewServerWithAddr("", pipeline)
+	go srv.Serve(l)
+	<-srv.AcceptReady
+
+	conn, buf := dialTestServer(t, srv)
+	res, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.Close()
+	if err != nil || res.StatusCode != 200 || !strings.HasPrefix(body, "hello") {
+		t.Errorf("Expected a 200 through the custom listener, got %v %v", res, err)
+	}
+	if n := atomic.AddInt64(&l.accepted, 0); n != 1 {
+		t.Errorf("Expected 1 connection through the listener, got %v", n)
+	}
+	if srv.Addr != inner.Addr().String() {
+		t.Errorf("Addr should come from the listener, got %v", srv.Addr)
+	}
+}
+
+func TestNegativeBufferSize(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	srv.ReadBufferSize = -1
+	if err := srv.ListenAndServe(); err == nil {
+		t.Errorf("Negative ReadBufferSize should be rejected")
+	}
+	srv = NewServer(0, NewPipeline())
+	srv.WriteBufferSize = -1
+	if err := srv.ListenAndServe(); err == nil {
+		t.Errorf("Negative WriteBufferSize should be rejected")
+	}
+}
+
+func TestNilPipeline(t *testing.T) {
+	srv := NewServer(0, nil)
+	if err := srv.ListenAndServe(); err == nil {
+		t.Errorf("Server without a Pipeline should be rejected")
+	}
+	if srv.listener != nil {
+		t.Errorf("Shouldn't listen before validating")
+	}
+	srv = NewServer(0, &Pipeline{})
+	if err := srv.ListenAndServeTLS("", ""); err == nil {
+		t.Errorf("Pipeline without filter lists should be rejected")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	pipeline := NewPipeline()
+	srv := NewServer(0, pipeline)
+	srv.ReadTimeout = 1e8 // 100ms
+	startTestServer(srv)
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	// send a partial request and stall
+	conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	conn.SetReadTimeout(2e9)
+	start := time.Nanoseconds()
+	if _, err := buf.ReadByte(); err == nil {
+		t.Errorf("Expected the server to close the connection")
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Errorf("Server didn't time out the stalled request")
+	}
+	if time.Nanoseconds()-start > 1e9 {
+		t.Errorf("Server took too long to time out the request")
+	}
+}
+
+func slowServer(delay int64) *Server {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		time.Sleep(delay)
+		return SimpleResponse(req.HttpRequest, 200, nil, "slow")
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	return srv
+}
+
+func TestShutdownDrains(t *testing.T) {
+	srv := slowServer(5e8)
+	// an idle keep-alive connection shouldn't hold up shutdown
+	idle, idleBuf := dialTestServer(t, srv)
+	defer idle.Close()
+	rawRequest(idle, idleBuf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	result := make(chan *http.Response, 1)
+	go func() {
+		res, _, _ := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		result <- res
+	}()
+	time.Sleep(1e8)
+	if err := srv.Shutdown(10e9); err != nil {
+		t.Errorf("Shutdown failed to drain: %v", err)
+	}
+	res := <-result
+	if res == nil || res.StatusCode != 200 {
+		t.Fatalf("In-flight request didn't complete during shutdown")
+	}
+	if !res.Close {
+		t.Errorf("Response during shutdown should close the connection")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	srv := slowServer(10e9)
+	conn, _ := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	time.Sleep(1e8)
+	if err := srv.Shutdown(1e8); err == nil {
+		t.Errorf("Shutdown should report connections it had to close")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	srv := helloServer()
+	srv.DrainDelay = 3e8
+	if srv.Draining() {
+		t.Fatalf("New server shouldn't be draining")
+	}
+	done := make(chan os.Error, 1)
+	go func() { done <- srv.Drain() }()
+	time.Sleep(1e8)
+	if !srv.Draining() {
+		t.Errorf("Server should be draining")
+	}
+	// still serving during DrainDelay
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	if res, _, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || res.StatusCode != 200 {
+		t.Errorf("Expected a 200 during the drain delay, got %v %v", res, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Drain failed: %v", err)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/panic" {
+			panic("oh noes")
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "fine")
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+
+	conn, buf := dialTestServer(t, srv)
+	res, _, err := rawRequest(conn, buf, "GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.Close()
+	if err != nil {
+		t.Fatalf("No response after panic: %v", err)
+	}
+	if res.StatusCode != 500 {
+		t.Errorf("Expected 500 after panic, got %v", res.StatusCode)
+	}
+
+	// still serving
+	conn, buf = dialTestServer(t, srv)
+	res, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.Close()
+	if err != nil || res.StatusCode != 200 || body != "fine" {
+		t.Errorf("Server not serving after panic: %v", err)
+	}
+
+	// custom response
+	srv.PanicHandler = func(req *Request, x interface{}) *http.Response {
+		return SimpleResponse(req.HttpRequest, 503, nil, fmt.Sprintf("%v", x))
+	}
+	conn, buf = dialTestServer(t, srv)
+	res, body, err = rawRequest(conn, buf, "GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.Close()
+	if err != nil || res.StatusCode != 503 || body != "oh noes" {
+		t.Errorf("PanicHandler response not used: %v %v", err, body)
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	path := fmt.Sprintf("/tmp/falcore_test_%v.sock", os.Getpid())
+	os.Remove(path)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "unix")
+	}))
+	srv := NewServer(0, pipeline)
+	go srv.ListenAndServeUnix(path, 0660)
+	<-srv.AcceptReady
+
+	if stat, err := os.Stat(path); err != nil {
+		t.Fatalf("Socket file not created: %v", err)
+	} else if stat.Permission() != 0660 {
+		t.Errorf("Socket permissions wrong: %o expected %o", stat.Permission(), 0660)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Can't connect to unix socket: %v", err)
+	}
+	defer conn.Close()
+	res, body, err := rawRequest(conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || res.StatusCode != 200 || body != "unix" {
+		t.Errorf("Bad response over unix socket: %v %q", err, body)
+	}
+}
+
+func TestListenAndServeUnixInherited(t *testing.T) {
+	path := fmt.Sprintf("/tmp/falcore_test_inherited_%v.sock", os.Getpid())
+	os.Remove(path)
+	defer os.Remove(path)
+	// like a listener inherited from the parent on a restart
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Can't listen on %v: %v", path, err)
+	}
+	srv := NewServer(0, NewPipeline())
+	srv.listener = l
+	errs := make(chan os.Error, 1)
+	go func() { errs <- srv.ListenAndServeUnix(path, 0660) }()
+	<-srv.AcceptReady
+
+	go srv.StopAccepting()
+	// wake up the accept loop
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+	}
+	select {
+	case <-errs:
+	case <-time.After(2e9):
+		t.Fatalf("Server didn't stop")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("The inherited socket's file should be left alone: %v", err)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	srv1 := NewServer(0, NewPipeline())
+	srv1.ReusePort = true
+	startTestServer(srv1)
+
+	srv2 := NewServer(srv1.Port(), NewPipeline())
+	srv2.ReusePort = true
+	if err := srv2.socketListen(); err != nil {
+		t.Errorf("Second listener on port %v failed: %v", srv1.Port(), err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowServiceUnavailable, OverflowClose} {
+		pipeline := NewPipeline()
+		pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+			return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+		}))
+		srv := NewServer(0, pipeline)
+		srv.MaxConnections = 2
+		srv.OverflowPolicy = policy
+		startTestServer(srv)
+
+		// hold both slots with keep-alive connections
+		for i := 0; i < srv.MaxConnections; i++ {
+			conn, buf := dialTestServer(t, srv)
+			defer conn.Close()
+			if res, _, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || res.StatusCode != 200 {
+				t.Fatalf("Connection %v under the limit failed: %v", i, err)
+			}
+		}
+
+		for i := 0; i < 2; i++ {
+			conn, buf := dialTestServer(t, srv)
+			// the server answers without waiting for a request
+			req, _ := http.NewRequest("GET", "/", nil)
+			res, err := http.ReadResponse(buf, req)
+			conn.Close()
+			switch policy {
+			case OverflowServiceUnavailable:
+				if err != nil || res.StatusCode != 503 {
+					t.Errorf("Expected a 503 for connection over the limit: %v", err)
+				}
+			case OverflowClose:
+				if err == nil {
+					t.Errorf("Expected connection over the limit to be closed, got %v", res.StatusCode)
+				}
+			}
+		}
+	}
+}
+
+func TestMaxConnectionsBlock(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	srv := NewServer(0, pipeline)
+	srv.MaxConnections = 1
+	srv.OverflowPolicy = OverflowBlock
+	startTestServer(srv)
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	if res, _, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || res.StatusCode != 200 {
+		t.Fatalf("Connection under the limit failed: %v", err)
+	}
+
+	// waits in the backlog until a slot frees up
+	waiting, waitingBuf := dialTestServer(t, srv)
+	defer waiting.Close()
+	waiting.SetReadTimeout(2e8)
+	if _, _, err := rawRequest(waiting, waitingBuf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err == nil {
+		t.Errorf("Connection over the limit shouldn't be served yet")
+	}
+
+	stopped := make(chan int)
+	go func() {
+		srv.StopAccepting()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2e9):
+		t.Errorf("StopAccepting should work while blocked at MaxConnections")
+	}
+}
+
+// Logger that records the formats of the error lines it gets
+type recordingLogger struct {
+	StdLibLogger
+	errors chan string
+}
+
+func (l *recordingLogger) Error(arg0 interface{}, args ...interface{}) os.Error {
+	l.errors <- fmt.Sprintf("%v", arg0)
+	return nil
+}
+
+func TestServerLogger(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		panic("log me")
+	}))
+	srv := NewServer(0, pipeline)
+	l := &recordingLogger{errors: make(chan string, 10)}
+	srv.Logger = l
+	startTestServer(srv)
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	select {
+	case <-l.errors:
+	case <-time.After(1e9):
+		t.Errorf("Server didn't log through its own Logger")
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/reject" {
+			if req.ExpectsContinue() {
+				return SimpleResponse(req.HttpRequest, 417, nil, "")
+			}
+			return SimpleResponse(req.HttpRequest, 413, nil, "")
+		}
+		body, _ := ioutil.ReadAll(req.HttpRequest.Body)
+		return SimpleResponse(req.HttpRequest, 200, nil, string(body))
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	// the body is only sent after the 100
+	conn, buf := dialTestServer(t, srv)
+	conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	conn.SetReadTimeout(1e9)
+	if line, err := buf.ReadString('\n'); err != nil || line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("Expected a 100 Continue, got %q %v", line, err)
+	}
+	buf.ReadString('\n')
+	res, body, err := rawRequest(conn, buf, "hello")
+	if err != nil || res.StatusCode != 200 || body != "hello" {
+		t.Errorf("Expected the body to be echoed back, got %v %q", err, body)
+	}
+	conn.Close()
+
+	// rejected without reading the body
+	conn, buf = dialTestServer(t, srv)
+	conn.SetReadTimeout(1e9)
+	res, _, err = rawRequest(conn, buf, "POST /reject HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	if err != nil || res.StatusCode != 417 {
+		t.Fatalf("Expected a 417, got %v %v", res, err)
+	}
+	if !res.Close {
+		t.Errorf("Connection should be closed when the body was never read")
+	}
+	conn.Close()
+
+	// expectations we don't know about
+	conn, buf = dialTestServer(t, srv)
+	conn.SetReadTimeout(1e9)
+	res, _, err = rawRequest(conn, buf, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: something-else\r\n\r\nhello")
+	if err != nil || res.StatusCode != 417 {
+		t.Errorf("Expected a 417 for an unknown expectation, got %v %v", res, err)
+	}
+	conn.Close()
+}
+
+func TestTLSConfig(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	if _, err := srv.tlsConfig("", ""); err == nil {
+		t.Errorf("Expected an error without any certificates")
+	}
+	if _, err := srv.tlsConfig("missing.crt", "missing.key"); err == nil {
+		t.Errorf("Expected an error for missing cert files")
+	}
+
+	base := &tls.Config{
+		Certificates: []tls.Certificate{tls.Certificate{}},
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA},
+	}
+	srv.TLSConfig = base
+	config, err := srv.tlsConfig("", "")
+	if err != nil {
+		t.Fatalf("Couldn't build config: %v", err)
+	}
+	if config == base {
+		t.Errorf("TLSConfig should be copied")
+	}
+	if len(config.CipherSuites) != 1 || len(config.Certificates) != 1 {
+		t.Errorf("TLSConfig settings weren't kept")
+	}
+	if config.Rand == nil || config.Time == nil || len(config.NextProtos) != 1 || config.NextProtos[0] != "http/1.1" {
+		t.Errorf("Defaults weren't filled in")
+	}
+	if base.Rand != nil || base.NextProtos != nil {
+		t.Errorf("TLSConfig was modified")
+	}
+
+	// handler protocols are advertised first
+	srv.TLSNextProto = map[string]func(*Server, *tls.Conn){
+		"spdy/2":   func(*Server, *tls.Conn) {},
+		"http/1.1": func(*Server, *tls.Conn) {},
+	}
+	if config, err = srv.tlsConfig("", ""); err != nil {
+		t.Fatalf("Couldn't build config: %v", err)
+	}
+	if len(config.NextProtos) != 2 || config.NextProtos[0] != "spdy/2" || config.NextProtos[1] != "http/1.1" {
+		t.Errorf("Expected [spdy/2 http/1.1], got %v", config.NextProtos)
+	}
+}
+
+// Writes a throwaway self-signed cert and key and returns the file
+// names and the cert
+func writeTestCert(t *testing.T, serial byte) (certFile, keyFile string, der []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Can't make a key: %v", err)
+	}
+	now := time.Seconds()
+	template := &x509.Certificate{
+		SerialNumber: []byte{serial},
+		Subject:      x509.Name{CommonName: "localhost"},
+		NotBefore:    time.SecondsToUTC(now - 3600),
+		NotAfter:     time.SecondsToUTC(now + 3600),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	if der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); err != nil {
+		t.Fatalf("Can't make a cert: %v", err)
+	}
+	certFile = fmt.Sprintf("%v/falcore-test-%d-%d.crt", os.TempDir(), os.Getpid(), serial)
+	keyFile = fmt.Sprintf("%v/falcore-test-%d-%d.key", os.TempDir(), os.Getpid(), serial)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err = ioutil.WriteFile(certFile, certPEM, 0600); err == nil {
+		err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	}
+	if err != nil {
+		t.Fatalf("Can't write cert files: %v", err)
+	}
+	return
+}
+
+func TestReloadCertificate(t *testing.T) {
+	cert1, key1, der1 := writeTestCert(t, 1)
+	cert2, key2, der2 := writeTestCert(t, 2)
+	defer func() {
+		for _, f := range []string{cert1, key1, cert2, key2} {
+			os.Remove(f)
+		}
+	}()
+
+	srv := NewServer(0, NewPipeline())
+	if err := srv.ReloadCertificate(cert2, key2); err == nil {
+		t.Errorf("Expected an error before the server is serving TLS")
+	}
+	go srv.ListenAndServeTLS(cert1, key1)
+	for srv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+	defer srv.StopAccepting()
+
+	served := func() []byte {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()), &tls.Config{})
+		if err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		defer conn.Close()
+		return conn.PeerCertificates()[0].Raw
+	}
+	if !bytes.Equal(served(), der1) {
+		t.Errorf("Expected the first cert before reloading")
+	}
+	if err := srv.ReloadCertificate("missing.crt", "missing.key"); err == nil {
+		t.Errorf("Expected an error for missing cert files")
+	}
+	if !bytes.Equal(served(), der1) {
+		t.Errorf("A failed reload should keep the old cert")
+	}
+	if err := srv.ReloadCertificate(cert2, key2); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if !bytes.Equal(served(), der2) {
+		t.Errorf("Expected new handshakes to get the reloaded cert")
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{tls.Certificate{}}}
+	srv.TLSHandshakeTimeout = 1e8
+	go srv.ListenAndServeTLS("", "")
+	for srv.Port() == 0 {
+		time.Sleep(1e7)
+	}
+	defer srv.StopAccepting()
+
+	// connect and never send a ClientHello
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	start := time.Nanoseconds()
+	if _, err := buf.ReadByte(); err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+	if took := time.Nanoseconds() - start; took > 1e9 {
+		t.Errorf("Connection without a handshake stayed open for %vms", took/1e6)
+	}
+}
+
+func TestDebugTrace(t *testing.T) {
+	srv := helloServer()
+	defer srv.StopAccepting()
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	res, _, _ := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if _, ok := res.Header["X-Falcore-Trace"]; ok {
+		t.Errorf("Trace shouldn't be sent unless DebugTrace is on")
+	}
+
+	srv.DebugTrace = true
+	res, _, _ = rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	trace := res.Header.Get("X-Falcore-Trace")
+	if !strings.HasPrefix(trace, "server.Init;s=0;dur=") || !strings.Contains(trace, "*falcore.genericRequestFilter;s=0;dur=") {
+		t.Errorf("Unexpected trace %q", trace)
+	}
+}
+
+func TestRequestTrailer(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		body, err := ioutil.ReadAll(req.HttpRequest.Body)
+		if err != nil {
+			return SimpleResponse(req.HttpRequest, 500, nil, err.String())
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, string(body)+"|"+req.HttpRequest.Trailer.Get("X-Checksum"))
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	raw := "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+		"5\r\nhello\r\n0\r\nX-Checksum: abc123\r\n\r\n"
+	res, body, err := rawRequest(conn, buf, raw)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("Chunked request failed: %v %v", res, err)
+	}
+	if body != "hello|abc123" {
+		t.Errorf("Expected the body and trailer, got %q", body)
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		h := http.Header{"X-Big": {strings.Repeat("x", 2000)}}
+		if req.HttpRequest.URL.Path == "/small" {
+			h = nil
+		}
+		return SimpleResponse(req.HttpRequest, 200, h, "hello")
+	}))
+	srv := NewServer(0, pipeline)
+	srv.MaxResponseHeaderBytes = 1024
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	res, _, err := rawRequest(conn, buf, "GET /big HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || res.StatusCode != 500 || res.Header.Get("X-Big") != "" {
+		t.Errorf("Expected a 500 without the big header, got %v %v", res, err)
+	}
+	res, body, err := rawRequest(conn, buf, "GET /small HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || res.StatusCode != 200 || body != "hello" {
+		t.Errorf("Small headers should go through, got %v %q %v", res, body, err)
+	}
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	srv := helloServer()
+	defer srv.StopAccepting()
+	srv.TCPKeepAlive = 30e9
+	srv.IdleTimeout = 1e8
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	if _, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || body != "hello" {
+		t.Fatalf("Expected a response, got %q %v", body, err)
+	}
+	// timeouts still work after the socket options are set
+	start := time.Nanoseconds()
+	if _, err := buf.ReadByte(); err != os.EOF {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+	if took := time.Nanoseconds() - start; took > 1e9 {
+		t.Errorf("Idle connection stayed open for %vms", took/1e6)
+	}
+}
+
+func TestListenerName(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, req.ListenerName())
+	}))
+	for _, name := range []string{"public", "internal"} {
+		srv := NewServer(0, pipeline)
+		srv.Name = name
+		startTestServer(srv)
+		conn, buf := dialTestServer(t, srv)
+		_, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if err != nil || body != name {
+			t.Errorf("Expected ListenerName %v, got %q %v", name, body, err)
+		}
+		conn.Close()
+		srv.StopAccepting()
+	}
+}
+
+func TestRequestConn(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		c := req.Conn()
+		return SimpleResponse(req.HttpRequest, 200, nil, c.LocalAddr().String()+" "+c.RemoteAddr().String())
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+
+	_, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	expected := conn.RemoteAddr().String() + " " + conn.LocalAddr().String()
+	if err != nil || body != expected {
+		t.Errorf("Expected Conn addresses %q, got %q %v", expected, body, err)
+	}
+
+	if req := newRequest(validGetRequest().HttpRequest, nil, 0); req.Conn() != nil {
+		t.Errorf("Expected no Conn without a server")
+	}
+}
+
+func TestNewServerWithAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		srv := NewServerWithAddr(addr, NewPipeline())
+		errs := make(chan os.Error, 1)
+		go func() {
+			errs <- srv.ListenAndServe()
+		}()
+		select {
+		case err := <-errs:
+			if addr == "[::1]:0" {
+				t.Logf("Skipping IPv6, can't listen: %v", err)
+				continue
+			}
+			t.Fatalf("Couldn't listen on %v: %v", addr, err)
+		case <-srv.AcceptReady:
+		}
+		if srv.Port() == 0 {
+			t.Errorf("No port for %v", addr)
+		}
+		host, _, _ := net.SplitHostPort(srv.listener.Addr().String())
+		if host != "127.0.0.1" && host != "::1" {
+			t.Errorf("%v isn't bound to loopback: %v", addr, host)
+		}
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprintf("%v", srv.Port())))
+		if err != nil {
+			t.Errorf("Can't connect to %v: %v", addr, err)
+		} else {
+			conn.Close()
+		}
+		srv.StopAccepting()
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var deadline int64
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewTimeoutFilter(NewRequestFilter(func(req *Request) *http.Response {
+		deadline = req.Deadline - req.StartTime
+		select {
+		case <-req.Cancelled():
+		case <-time.After(5e9):
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "too late")
+	}), 0))
+	srv := NewServer(0, pipeline)
+	srv.RequestTimeout = 1e8
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	// asking for more than the server allows gets the server's limit
+	res, _, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-Timeout-Ms: 60000\r\n\r\n")
+	if err != nil {
+		t.Fatalf("Expected a response, got %v", err)
+	}
+	if res.StatusCode != 504 {
+		t.Errorf("Expected status 504, got %v", res.StatusCode)
+	}
+	if deadline != 1e8 {
+		t.Errorf("Expected the deadline capped at RequestTimeout, got %v", deadline)
+	}
+}
+
+func TestRequestTimeoutSnapshot(t *testing.T) {
+	release := make(chan int)
+	finished := make(chan string, 1)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		req.Context["early"] = true
+		<-release
+		// long after the 504
+		req.Context["late"] = true
+		req.startPipelineStage("late")
+		req.finishPipelineStage()
+		return nil
+	}))
+	pipeline.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		names := make([]string, 0)
+		for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+			names = append(names, e.Value.(*PipelineStageStat).Name)
+		}
+		_, early := req.Context["early"]
+		_, late := req.Context["late"]
+		finished <- fmt.Sprintf("%v %v %v %v", req.ResponseStatus, strings.Join(names, ","), early, late)
+		return nil
+	})
+	srv := NewServer(0, pipeline)
+	srv.RequestTimeout = 1e8
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	if res, _, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil || res.StatusCode != 504 {
+		t.Fatalf("Expected a 504, got %v %v", res, err)
+	}
+	select {
+	case got := <-finished:
+		t.Fatalf("The done callback shouldn't run before the pipeline returns, got %v", got)
+	case <-time.After(5e7):
+	}
+	close(release)
+	// the stages stay the server's, the Context gets what filters set
+	if got := <-finished; got != "504 server.Init,server.ResponseWrite true true" {
+		t.Errorf("Unexpected finished request: %v", got)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	entered := make(chan int)
+	release := make(chan int)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/panic" {
+			panic("boom")
+		}
+		entered <- 1
+		<-release
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	done := make(chan int)
+	go func() {
+		rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		done <- 1
+	}()
+	<-entered
+	if stats := srv.Stats(); stats.ActiveConnections != 1 || stats.RequestsInFlight != 1 || stats.ConnectionsAccepted != 1 {
+		t.Errorf("Bad stats during the request: %+v", stats)
+	}
+	release <- 1
+	<-done
+
+	// panics still count
+	rawRequest(conn, buf, "GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.Close()
+
+	var stats ServerStats
+	for i := 0; i < 100; i++ {
+		if stats = srv.Stats(); stats.ActiveConnections == 0 {
+			break
+		}
+		time.Sleep(1e7)
+	}
+	if stats.ActiveConnections != 0 || stats.RequestsInFlight != 0 || stats.RequestsServed != 2 || stats.ConnectionsAccepted != 1 {
+		t.Errorf("Bad stats after the requests: %+v", stats)
+	}
+	// the 2 bucket
+	if stats.RequestsPerConnection[2] != 1 || stats.NewConnectionRatio() != 0.5 {
+		t.Errorf("Expected one connection with 2 requests, got %v", stats.RequestsPerConnection)
+	}
+}
+
+// Bodies that do and don't know their length
+type bufferBody struct {
+	*bytes.Buffer
+}
+
+func (b *bufferBody) Close() os.Error {
+	return nil
+}
+
+type opaqueBody struct {
+	io.Reader
+}
+
+func (b *opaqueBody) Close() os.Error {
+	return nil
+}
+
+func TestResponseLength(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		// neither sets a ContentLength
+		res := SimpleResponse(req.HttpRequest, 200, nil, "")
+		if req.HttpRequest.URL.Path == "/buffer" {
+			res.Body = &bufferBody{bytes.NewBufferString("hello")}
+		} else {
+			res.Body = &opaqueBody{strings.NewReader("hello")}
+		}
+		return res
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	tests := []struct {
+		raw       string
+		length    int64
+		chunked   bool
+		keepAlive bool
+	}{
+		{"GET /buffer HTTP/1.1\r\nHost: localhost\r\n\r\n", 5, false, true},
+		{"GET /opaque HTTP/1.1\r\nHost: localhost\r\n\r\n", -1, true, true},
+		{"GET /opaque HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", -1, false, false},
+	}
+	for _, test := range tests {
+		conn, buf := dialTestServer(t, srv)
+		conn.SetReadTimeout(2e9)
+		res, body, err := rawRequest(conn, buf, test.raw)
+		conn.Close()
+		if err != nil {
+			t.Errorf("%q Expected a response, got %v", test.raw, err)
+			continue
+		}
+		if body != "hello" {
+			t.Errorf("%q Expected the body, got %q", test.raw, body)
+		}
+		if res.ContentLength != test.length || isChunked(res.TransferEncoding) != test.chunked {
+			t.Errorf("%q Expected length %v chunked %v, got %v %v", test.raw, test.length, test.chunked, res.ContentLength, res.TransferEncoding)
+		}
+		if res.Close == test.keepAlive {
+			t.Errorf("%q Expected keep-alive %v", test.raw, test.keepAlive)
+		}
+	}
+}
+
+func TestHTTP10Response(t *testing.T) {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		// like a chunked response passed through from a backend
+		res := SimpleResponse(req.HttpRequest, 200, nil, "")
+		res.Body = &opaqueBody{strings.NewReader("hello")}
+		res.ContentLength = -1
+		res.TransferEncoding = []string{"chunked"}
+		return res
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	conn.Write([]byte("GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	raw, err := ioutil.ReadAll(buf)
+	if err != nil {
+		t.Fatalf("Expected the connection to close after the response: %v", err)
+	}
+	head := string(raw)
+	if i := strings.Index(head, "\r\n\r\n"); i < 0 || head[i+4:] != "hello" {
+		t.Errorf("Expected the plain body, got %q", raw)
+	} else if strings.Contains(strings.ToLower(head[0:i]), "chunked") {
+		t.Errorf("HTTP/1.0 response was chunked: %q", head[0:i])
+	}
+}
+
+func TestByteCounts(t *testing.T) {
+	type counts struct{ in, out int64 }
+	done := make(chan counts, 2)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	}))
+	pipeline.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		done <- counts{req.BytesIn(), req.BytesOut()}
+		return nil
+	})
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	first := "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody"
+	second := "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	// pipelined so the second request is read ahead with the first
+	conn.Write([]byte(first + second))
+	raw, _ := ioutil.ReadAll(buf)
+
+	a, b := <-done, <-done
+	if a.in == int64(len(second)) {
+		// the callbacks can finish in either order
+		a, b = b, a
+	}
+	if a.in != int64(len(first)) || b.in != int64(len(second)) {
+		t.Errorf("Expected %v and %v bytes in, got %v and %v", len(first), len(second), a.in, b.in)
+	}
+	if a.out+b.out != int64(len(raw)) || a.out == 0 || b.out == 0 {
+		t.Errorf("Expected %v bytes out in total, got %v and %v", len(raw), a.out, b.out)
+	}
+}
+
+func TestKeepAliveLimits(t *testing.T) {
+	srv := helloServer()
+	defer srv.StopAccepting()
+	srv.MaxKeepAliveRequests = 2
+
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	for i := 1; i <= 2; i++ {
+		res, _, err := rawRequest(conn, buf, raw)
+		if err != nil {
+			t.Fatalf("Request %v failed: %v", i, err)
+		}
+		if res.Close != (i == 2) {
+			t.Errorf("Request %v: expected Close %v", i, i == 2)
+		}
+	}
+
+	srv.MaxKeepAliveRequests = 0
+	srv.KeepAliveTimeout = 5e7
+	conn2, buf2 := dialTestServer(t, srv)
+	defer conn2.Close()
+	conn2.SetReadTimeout(2e9)
+	if res, _, err := rawRequest(conn2, buf2, raw); err != nil || res.Close {
+		t.Fatalf("First request should keep the connection: %v %v", res, err)
+	}
+	time.Sleep(1e8)
+	if res, _, err := rawRequest(conn2, buf2, raw); err != nil || !res.Close {
+		t.Errorf("Connection past KeepAliveTimeout should be closed: %v %v", res, err)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	cancelled := make(chan int, 1)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		select {
+		case <-req.Cancelled():
+			cancelled <- 1
+		case <-time.After(5e9):
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "too late")
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	start := time.Nanoseconds()
+	res, _, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-Timeout-Ms: 100\r\n\r\n")
+	if err != nil {
+		t.Fatalf("Expected a response, got %v", err)
+	}
+	if res.StatusCode != 504 || !res.Close {
+		t.Errorf("Expected a 504 and a closed connection, got %v %v", res.StatusCode, res.Close)
+	}
+	if elapsed := time.Nanoseconds() - start; elapsed > 1e9 {
+		t.Errorf("Client waited past the deadline: %vns", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(1e9):
+		t.Errorf("Pipeline wasn't cancelled")
+	}
+}
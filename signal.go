@@ -0,0 +1,66 @@
+package falcore
+
+import (
+	"os"
+	"os/signal"
+	"time"
+)
+
+var defaultDrainSignals = []os.UnixSignal{os.SIGTERM, os.SIGINT}
+
+// Drains the server when one of DrainSignals arrives, the way process
+// managers like systemd and Kubernetes ask a server to go away.  Run
+// it before ListenAndServe, which returns once the drain is done.
+//
+// This reads signal.Incoming, so don't read it anywhere else.  Other
+// signals are ignored.
+func (srv *Server) HandleSignals() {
+	signals := srv.DrainSignals
+	if len(signals) == 0 {
+		signals = defaultDrainSignals
+	}
+	go func() {
+		for sig := range signal.Incoming {
+			if usig, ok := sig.(os.UnixSignal); ok && hasSignal(signals, usig) {
+				srv.log().Info("%s Received %v, draining", srv.serverLogPrefix(), sig)
+				if err := srv.Drain(); err != nil {
+					srv.log().Warn("%s %v", srv.serverLogPrefix(), err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Marks the server as draining, keeps serving for DrainDelay and then
+// calls Shutdown with DrainTimeout.
+func (srv *Server) Drain() os.Error {
+	srv.connMutex.Lock()
+	srv.draining = true
+	srv.connMutex.Unlock()
+	if srv.DrainDelay > 0 {
+		time.Sleep(srv.DrainDelay)
+	}
+	timeout := srv.DrainTimeout
+	if timeout <= 0 {
+		timeout = 30e9
+	}
+	return srv.Shutdown(timeout)
+}
+
+// True once Drain or Shutdown has been called.  Readiness checks
+// should fail from then on.  See health.Filter.
+func (srv *Server) Draining() bool {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	return srv.draining || srv.shuttingDown
+}
+
+func hasSignal(list []os.UnixSignal, sig os.UnixSignal) bool {
+	for _, s := range list {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
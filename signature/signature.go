@@ -0,0 +1,87 @@
+package signature
+
+import (
+	"http"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"falcore"
+)
+
+// falcore/signature.Filter checks an HMAC-SHA256 signature over the
+// request body, for webhook receivers.  Requests with a missing or
+// wrong signature get a 401.  Bodies over MaxBodyBytes get a 413.
+//
+// A body cut off by falcore/body_limit also gets a 413.
+//
+// The Header (X-Signature by default) holds the hex encoded HMAC,
+// after Prefix if that's set.  For GitHub's X-Hub-Signature-256 set
+// Prefix to "sha256=".  The body is buffered (see
+// Request.BufferBody) so the filters after this one can still read it.
+//
+// The signed message is each of the SignedHeaders as lower cased
+// "name:value\n", in order, then the raw body.  With no SignedHeaders
+// it's just the body.
+type Filter struct {
+	Secret        []byte
+	Header        string
+	Prefix        string
+	SignedHeaders []string
+	// Defaults to 1MB
+	MaxBodyBytes int
+}
+
+func NewFilter(secret []byte) *Filter {
+	f := new(Filter)
+	f.Secret = secret
+	f.Header = "X-Signature"
+	f.MaxBodyBytes = 1 << 20
+	return f
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	if err := request.BufferBody(f.MaxBodyBytes); err != nil {
+		request.CurrentStage.Status = 2 // Fail
+		if err == falcore.ErrBodyTooLarge {
+			return falcore.SimpleResponse(req, 413, nil, "Request Entity Too Large\n")
+		}
+		return falcore.SimpleResponse(req, 400, nil, "Bad Request\n")
+	}
+	if !f.Valid(request) {
+		falcore.Debug("%s Bad signature", request.ID)
+		request.CurrentStage.Status = 2 // Fail
+		return falcore.SimpleResponse(req, 401, nil, "Invalid signature\n")
+	}
+	return nil
+}
+
+// Checks the signature of a request whose body has been buffered
+func (f *Filter) Valid(request *falcore.Request) bool {
+	req := request.HttpRequest
+	value := req.Header.Get(f.Header)
+	if !strings.HasPrefix(value, f.Prefix) {
+		return false
+	}
+	given, err := hex.DecodeString(strings.TrimSpace(value[len(f.Prefix):]))
+	if err != nil {
+		return false
+	}
+	body, ok := req.Body.(*falcore.BufferedBody)
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare(f.Sign(req.Header, body.Bytes()), given) == 1
+}
+
+// The HMAC for header and body
+func (f *Filter) Sign(header http.Header, body []byte) []byte {
+	mac := hmac.New(sha256.New, f.Secret)
+	for _, name := range f.SignedHeaders {
+		mac.Write([]byte(strings.ToLower(name) + ":" + header.Get(name) + "\n"))
+	}
+	mac.Write(body)
+	return mac.Sum()
+}
@@ -0,0 +1,68 @@
+package signature
+
+import (
+	"encoding/hex"
+	"falcore"
+	"falcore/body_limit"
+	"http"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func signedRequest(body, signature, timestamp string) *falcore.Request {
+	tmp, _ := http.NewRequest("POST", "/hook", strings.NewReader(body))
+	tmp.ContentLength = int64(len(body))
+	tmp.Header.Set("X-Hub-Signature-256", signature)
+	tmp.Header.Set("X-Timestamp", timestamp)
+	return &falcore.Request{HttpRequest: tmp, CurrentStage: falcore.NewPiplineStage("test")}
+}
+
+func TestSignature(t *testing.T) {
+	f := NewFilter([]byte("secret"))
+	f.Header = "X-Hub-Signature-256"
+	f.Prefix = "sha256="
+	f.SignedHeaders = []string{"X-Timestamp"}
+	h := http.Header{"X-Timestamp": {"1000"}}
+	good := "sha256=" + hex.EncodeToString(f.Sign(h, []byte(`{"a":1}`)))
+
+	req := signedRequest(`{"a":1}`, good, "1000")
+	if res := f.FilterRequest(req); res != nil {
+		t.Fatalf("Valid signature was rejected: %v", res.StatusCode)
+	}
+	if body, _ := ioutil.ReadAll(req.HttpRequest.Body); string(body) != `{"a":1}` {
+		t.Errorf("Body should still be readable, got %q", body)
+	}
+
+	for name, bad := range map[string]*falcore.Request{
+		"changed body":   signedRequest(`{"a":2}`, good, "1000"),
+		"changed header": signedRequest(`{"a":1}`, good, "1001"),
+		"no prefix":      signedRequest(`{"a":1}`, good[7:], "1000"),
+		"missing":        signedRequest(`{"a":1}`, "", "1000"),
+	} {
+		if res := f.FilterRequest(bad); res == nil || res.StatusCode != 401 {
+			t.Errorf("%v Expected a 401, got %v", name, res)
+		}
+	}
+
+	f.MaxBodyBytes = 3
+	if res := f.FilterRequest(signedRequest(`{"a":1}`, good, "1000")); res == nil || res.StatusCode != 413 {
+		t.Errorf("Expected a 413 for a body over the limit, got %v", res)
+	}
+}
+
+func TestSignatureBehindBodyLimit(t *testing.T) {
+	f := NewFilter([]byte("secret"))
+	good := hex.EncodeToString(f.Sign(http.Header{}, []byte("0123456789")))
+	req := signedRequest("0123456789", good, "")
+	// a chunked body, so body_limit can't reject it up front
+	req.HttpRequest.ContentLength = -1
+	req.HttpRequest.Header.Set("X-Signature", good)
+
+	if res := body_limit.NewFilter(5).FilterRequest(req); res != nil {
+		t.Fatalf("body_limit shouldn't answer a chunked body, got %v", res.StatusCode)
+	}
+	if res := f.FilterRequest(req); res == nil || res.StatusCode != 413 {
+		t.Errorf("Expected a 413 for a body cut off by body_limit, got %v", res)
+	}
+}
@@ -0,0 +1,129 @@
+package falcore
+
+import (
+	"http"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Collapses identical GET and HEAD requests that arrive while one is
+// already running Filter into that one call, so a cache miss on a busy
+// URL (see cache.Filter) doesn't send every client to the backend.
+//
+// Requests are the same if they have the same method, host, URL and
+// values for the headers named in Vary.  The first one runs Filter and
+// the rest wait and get copies of its response.  Bodies up to
+// MaxBodyBytes are buffered to hand out the copies.  If the response
+// is bigger, or Filter panics, the waiters run Filter themselves.  A
+// waiter whose request is cancelled (see Request.Cancelled) stops
+// waiting and gets a '504 Gateway Timeout' rather than going on to
+// the filters the flight was protecting.
+type SingleFlightFilter struct {
+	Filter       RequestFilter
+	Vary         []string
+	MaxBodyBytes int
+	mutex        sync.Mutex
+	flights      map[string]*flight
+}
+
+// A call in progress
+type flight struct {
+	done   chan int
+	shared bool
+	res    *http.Response
+	body   []byte
+}
+
+// Shares responses up to 1MB
+func NewSingleFlightFilter(filter RequestFilter, vary ...string) *SingleFlightFilter {
+	return &SingleFlightFilter{
+		Filter:       filter,
+		Vary:         vary,
+		MaxBodyBytes: 1 << 20,
+		flights:      make(map[string]*flight),
+	}
+}
+
+func (f *SingleFlightFilter) FilterRequest(request *Request) *http.Response {
+	req := request.HttpRequest
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return f.Filter.FilterRequest(request)
+	}
+	key := f.key(req)
+
+	f.mutex.Lock()
+	if f.flights == nil {
+		f.flights = make(map[string]*flight)
+	}
+	if fl, ok := f.flights[key]; ok {
+		f.mutex.Unlock()
+		select {
+		case <-fl.done:
+		case <-request.Cancelled():
+			request.CurrentStage.Status = 2 // Fail
+			return SimpleResponse(req, 504, nil, "Gateway Timeout\n")
+		}
+		if !fl.shared {
+			return f.Filter.FilterRequest(request)
+		}
+		request.CurrentStage.Status = 1 // Skip
+		return fl.response(req)
+	}
+	fl := &flight{done: make(chan int)}
+	f.flights[key] = fl
+	f.mutex.Unlock()
+
+	// let the waiters go even if Filter panics
+	defer func() {
+		f.mutex.Lock()
+		f.flights[key] = nil, false
+		f.mutex.Unlock()
+		close(fl.done)
+	}()
+	res := f.Filter.FilterRequest(request)
+	if res == nil {
+		fl.shared = true
+		return nil
+	}
+	if res.Body == nil {
+		fl.res, fl.shared = res, true
+		return fl.response(req)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(f.MaxBodyBytes)+1))
+	if err != nil || len(body) > f.MaxBodyBytes {
+		// too big to share.  send what we read and the rest
+		res.Body = &partialBody{io.MultiReader(bytes.NewBuffer(body), res.Body), res.Body}
+		return res
+	}
+	res.Body.Close()
+	fl.res, fl.body, fl.shared = res, body, true
+	return fl.response(req)
+}
+
+func (f *SingleFlightFilter) key(req *http.Request) string {
+	key := req.Method + " " + req.Host + " " + req.RawURL
+	for _, name := range f.Vary {
+		key += "\n" + name + ": " + req.Header.Get(name)
+	}
+	return key
+}
+
+// A copy of the shared response for req.  nil if the first request
+// continued on to the next filter.
+func (fl *flight) response(req *http.Request) *http.Response {
+	if fl.res == nil {
+		return nil
+	}
+	res := new(http.Response)
+	*res = *fl.res
+	res.Request = req
+	res.Header = cloneHeader(fl.res.Header)
+	if fl.res.Body != nil {
+		res.Body = &BufferedBody{fl.body, bytes.NewBuffer(fl.body)}
+		res.ContentLength = int64(len(fl.body))
+		res.TransferEncoding = nil
+	}
+	return res
+}
@@ -0,0 +1,119 @@
+package falcore
+
+import (
+	"http"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func flightRequest(url string) *Request {
+	tmp, _ := http.NewRequest("GET", url, nil)
+	req := newRequest(tmp, nil, 0)
+	req.CurrentStage = NewPiplineStage("test")
+	return req
+}
+
+func TestSingleFlightFilter(t *testing.T) {
+	var calls int64
+	started := make(chan int, 10)
+	release := make(chan int)
+	f := NewSingleFlightFilter(NewRequestFilter(func(req *Request) *http.Response {
+		atomic.AddInt64(&calls, 1)
+		started <- 1
+		<-release
+		return SimpleResponse(req.HttpRequest, 200, http.Header{"X-Backend": {"yes"}}, "expensive")
+	}))
+
+	bodies := make(chan string, 10)
+	get := func(url string) {
+		res := f.FilterRequest(flightRequest(url))
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.Header.Get("X-Backend") != "yes" {
+			t.Errorf("Headers weren't copied")
+		}
+		bodies <- string(body)
+	}
+	go get("/report")
+	<-started
+	for i := 0; i < 3; i++ {
+		go get("/report")
+	}
+	// a different URL isn't held up
+	go get("/other")
+	<-started
+	time.Sleep(5e7)
+	close(release)
+
+	for i := 0; i < 5; i++ {
+		if body := <-bodies; body != "expensive" {
+			t.Errorf("Expected the shared body, got %q", body)
+		}
+	}
+	if n := atomic.AddInt64(&calls, 0); n != 2 {
+		t.Errorf("Expected one call per URL, got %v", n)
+	}
+	if len(f.flights) != 0 {
+		t.Errorf("Finished flights should be released")
+	}
+}
+
+func TestSingleFlightPanic(t *testing.T) {
+	var calls int64
+	started := make(chan int, 1)
+	release := make(chan int)
+	f := NewSingleFlightFilter(NewRequestFilter(func(req *Request) *http.Response {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			started <- 1
+			<-release
+			panic("leader failed")
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "second try")
+	}))
+
+	go func() {
+		defer func() { recover() }()
+		f.FilterRequest(flightRequest("/"))
+	}()
+	<-started
+	result := make(chan *http.Response, 1)
+	go func() { result <- f.FilterRequest(flightRequest("/")) }()
+	time.Sleep(5e7)
+	close(release)
+
+	res := <-result
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "second try" {
+		t.Errorf("Waiter should run the filter itself after a panic, got %q", body)
+	}
+	if len(f.flights) != 0 {
+		t.Errorf("Flight should be released after a panic")
+	}
+}
+
+func TestSingleFlightCancelled(t *testing.T) {
+	var calls int64
+	started := make(chan int, 1)
+	release := make(chan int)
+	f := NewSingleFlightFilter(NewRequestFilter(func(req *Request) *http.Response {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			started <- 1
+			<-release
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "expensive")
+	}))
+	defer close(release)
+
+	go f.FilterRequest(flightRequest("/"))
+	<-started
+	waiter := flightRequest("/")
+	waiter.Cancel()
+	res := f.FilterRequest(waiter)
+	if res == nil || res.StatusCode != 504 {
+		t.Errorf("Expected a 504 for a cancelled waiter, got %v", res)
+	}
+	if n := atomic.AddInt64(&calls, 0); n != 1 {
+		t.Errorf("A cancelled waiter shouldn't run the filter, got %v calls", n)
+	}
+}
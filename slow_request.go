@@ -0,0 +1,45 @@
+package falcore
+
+import (
+	"fmt"
+	"http"
+	"strings"
+)
+
+// A RequestDoneCallback that logs only the requests that took longer
+// than Threshold (nanoseconds) from the first byte to the last, with
+// the time spent in every pipeline stage so the slow part stands out.
+// Normal requests log nothing.  Lines go through Request.Logf at Level,
+// WARNING by default.
+type SlowRequestFilter struct {
+	Threshold int64
+	Level     level
+}
+
+func NewSlowRequestFilter(threshold int64) *SlowRequestFilter {
+	return &SlowRequestFilter{Threshold: threshold, Level: WARNING}
+}
+
+func (f *SlowRequestFilter) FilterRequest(request *Request) *http.Response {
+	if request.EndTime-request.StartTime <= f.Threshold {
+		return nil
+	}
+	request.Logf(f.Level, "%s", f.describe(request))
+	return nil
+}
+
+// One line like Request.Trace's, with the stages after the total
+func (f *SlowRequestFilter) describe(request *Request) string {
+	req := request.HttpRequest
+	reqTime := TimeDiff(request.StartTime, request.EndTime)
+	stages := make([]string, 0, request.PipelineStageStats.Len()+1)
+	for e := request.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		pss, _ := e.Value.(*PipelineStageStat)
+		dur := TimeDiff(pss.StartTime, pss.EndTime)
+		stages = append(stages, fmt.Sprintf("%s S=%d Tot=%.4f %%=%.2f", pss.Name, pss.Status, dur, dur/reqTime*100.0))
+	}
+	overhead := float32(request.Overhead) / 1.0e9
+	stages = append(stages, fmt.Sprintf("Overhead Tot=%.4f %%=%.2f", overhead, overhead/reqTime*100.0))
+	return fmt.Sprintf("Slow request [%s] %s%s Status=%d Tot=%.4f: %s",
+		req.Method, req.Host, req.RawURL, request.ResponseStatus, reqTime, strings.Join(stages, ", "))
+}
@@ -0,0 +1,48 @@
+package falcore
+
+import (
+	"fmt"
+	"http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Logger that records its warnings with the arguments filled in
+type warningLogger struct {
+	StdLibLogger
+	warnings []string
+}
+
+func (l *warningLogger) Warn(arg0 interface{}, args ...interface{}) os.Error {
+	l.warnings = append(l.warnings, fmt.Sprintf(arg0.(string), args...))
+	return nil
+}
+
+func TestSlowRequestFilter(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/slow" {
+			time.Sleep(5e7)
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "done")
+	}))
+	f := NewSlowRequestFilter(2e7)
+	l := &warningLogger{}
+
+	for _, path := range []string{"/fast", "/slow"} {
+		tmp, _ := http.NewRequest("GET", path, nil)
+		tmp.RawURL = path
+		req, _ := p.TestWithRequest(tmp)
+		req.logger = l
+		f.FilterRequest(req)
+	}
+	if len(l.warnings) != 1 {
+		t.Fatalf("Expected only the slow request logged, got %q", l.warnings)
+	}
+	line := l.warnings[0]
+	if !strings.Contains(line, "[GET] /slow") || !strings.Contains(line, "*falcore.genericRequestFilter S=0") || !strings.Contains(line, "Overhead") {
+		t.Errorf("Expected the request and its stages, got %q", line)
+	}
+}
@@ -3,24 +3,43 @@ package static_file
 import (
 	"http"
 	"falcore"
-	"path/filepath"
+	"path"
 	"os"
+	"io"
+	"fmt"
 	"mime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // A falcore RequestFilter for serving static files
 // from the filesystem.
+//
+// Responses carry Last-Modified and ETag headers and conditional
+// requests (If-None-Match, If-Modified-Since) get a 304.  A single
+// byte range can be requested with the Range header.  Multiple ranges
+// aren't supported and get the whole file.  So does a range with an
+// If-Range that doesn't match the file's ETag or Last-Modified time.
+//
+// Files come from FileSystem, which defaults to the directory at
+// BasePath.  Use a MemoryFS or your own FileSystem to serve assets
+// that aren't on disk.  Ranges and conditional requests work the same
+// for any FileSystem.
 type Filter struct {
 	// File system base path for serving files
 	BasePath string
 	// Prefix in URL path
 	PathPrefix string
+	// File to serve for directory requests.  Directories 404 if empty.
+	IndexFile string
+	// Where files come from.  Dir(BasePath) if nil.
+	FileSystem FileSystem
 }
 
 func (f *Filter) FilterRequest(req *falcore.Request) (res *http.Response) {
 	// Clean asset path
-	asset_path := filepath.Clean(filepath.FromSlash(req.HttpRequest.URL.Path))
+	asset_path := path.Clean("/" + req.HttpRequest.URL.Path)
 
 	// Resolve PathPrefix
 	if strings.HasPrefix(asset_path, f.PathPrefix) {
@@ -32,44 +51,163 @@ func (f *Filter) FilterRequest(req *falcore.Request) (res *http.Response) {
 	}
 
 	// Resolve FSBase
-	if f.BasePath != "" {
-		asset_path = filepath.Join(f.BasePath, asset_path)
-	} else {
-		falcore.Error("file_filter requires a BasePath")
-		return falcore.SimpleResponse(req.HttpRequest, 500, nil, "Server Error\n")
+	fs := f.FileSystem
+	if fs == nil {
+		if f.BasePath == "" {
+			falcore.Error("file_filter requires a BasePath or FileSystem")
+			return falcore.SimpleResponse(req.HttpRequest, 500, nil, "Server Error\n")
+		}
+		fs = Dir(f.BasePath)
 	}
 
-	var fileSize int64
-	if stat, err := os.Stat(asset_path); err == nil {
-		fileSize = stat.Size
-	} else {
-		falcore.Debug("Can't stat %v: %v", asset_path, err)
+	file, info, err := fs.Open(asset_path)
+	if err == nil && info.IsDirectory && f.IndexFile != "" {
+		asset_path = path.Join("/"+asset_path, f.IndexFile)
+		file, info, err = fs.Open(asset_path)
+	}
+	if err != nil {
+		falcore.Debug("Can't open %v: %v", asset_path, err)
+		return falcore.SimpleResponse(req.HttpRequest, 404, nil, "File not found\n")
+	}
+	if info.IsDirectory {
 		return falcore.SimpleResponse(req.HttpRequest, 404, nil, "File not found\n")
 	}
 
-	// Open File
-	if file, err := os.Open(asset_path); err == nil {
-		// Make sure it's an actual file
-		if stat, err := file.Stat(); err == nil && stat.IsRegular() {
-			res = &http.Response{
-				Request:       req.HttpRequest,
-				StatusCode:    200,
-				Proto:         "HTTP/1.1",
-				Body:          file,
-				Header:        make(http.Header),
-				ContentLength: fileSize,
-			}
-			if ct := mime.TypeByExtension(filepath.Ext(asset_path)); ct != "" {
-				res.Header.Set("Content-Type", ct)
-			}
-		} else {
+	res = &http.Response{
+		Request:       req.HttpRequest,
+		StatusCode:    200,
+		Proto:         "HTTP/1.1",
+		Body:          file,
+		Header:        make(http.Header),
+		ContentLength: info.Size,
+	}
+	if ct := mime.TypeByExtension(path.Ext(asset_path)); ct != "" {
+		res.Header.Set("Content-Type", ct)
+	}
+	res.Header.Set("Last-Modified", time.SecondsToUTC(info.Mtime/1e9).Format(http.TimeFormat))
+	res.Header.Set("Etag", fmt.Sprintf("\"%x-%x\"", info.Mtime, info.Size))
+	res.Header.Set("Accept-Ranges", "bytes")
+
+	if notModified(req.HttpRequest, res.Header.Get("Etag"), info.Mtime/1e9) {
+		file.Close()
+		res.StatusCode = 304
+		res.Body = nil
+		res.ContentLength = 0
+		res.Header.Del("Content-Type")
+		return
+	}
+	if r := req.HttpRequest.Header.Get("Range"); r != "" && ifRange(req.HttpRequest, res.Header.Get("Etag"), info.Mtime/1e9) {
+		start, length, ok := parseRange(r, info.Size)
+		if !ok {
 			file.Close()
-			return falcore.SimpleResponse(req.HttpRequest, 404, nil, "File not found\n")
+			return falcore.SimpleResponse(req.HttpRequest, 416, http.Header{
+				"Content-Range": {fmt.Sprintf("bytes */%v", info.Size)},
+			}, "Requested range not satisfiable\n")
+		}
+		if length >= 0 {
+			if _, err := file.Seek(start, 0); err != nil {
+				file.Close()
+				falcore.Error("Can't seek %v: %v", asset_path, err)
+				return falcore.SimpleResponse(req.HttpRequest, 500, nil, "Server Error\n")
+			}
+			res.StatusCode = 206
+			res.ContentLength = length
+			res.Body = &rangeBody{io.LimitReader(file, length), file}
+			res.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, start+length-1, info.Size))
 		}
-	} else {
-		falcore.Debug("Can't open %v: %v", asset_path, err)
-		res = falcore.SimpleResponse(req.HttpRequest, 404, nil, "File not found\n")
 	}
 
 	return
 }
+
+type rangeBody struct {
+	io.Reader
+	file io.Closer
+}
+
+func (b *rangeBody) Close() os.Error {
+	return b.file.Close()
+}
+
+// If-None-Match wins over If-Modified-Since when both are sent
+func notModified(req *http.Request, etag string, mtime int64) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := time.Parse(http.TimeFormat, ims); err == nil {
+			return mtime <= t.Seconds()
+		}
+	}
+	return false
+}
+
+// False if If-Range says the client's copy is out of date, so it gets
+// the whole file instead of a piece of a different version.  An ETag
+// has to match exactly and a date has to be the Last-Modified time.
+func ifRange(req *http.Request, etag string, mtime int64) bool {
+	ir := strings.TrimSpace(req.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, "\"") || strings.HasPrefix(ir, "W/") {
+		// weak tags never match
+		return ir == etag
+	}
+	t, err := time.Parse(http.TimeFormat, ir)
+	return err == nil && t.Seconds() == mtime
+}
+
+// Parses a Range header value for a file of size bytes.  A length of
+// -1 means the header should be ignored and the whole file sent.  ok is
+// false if the range can't be satisfied.
+func parseRange(r string, size int64) (start, length int64, ok bool) {
+	if !strings.HasPrefix(r, "bytes=") || strings.Contains(r, ",") {
+		return 0, -1, true
+	}
+	spec := strings.TrimSpace(r[len("bytes="):])
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, -1, true
+	}
+	first, last := strings.TrimSpace(spec[0:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" {
+		// suffix range: the last n bytes
+		n, err := strconv.Atoi64(last)
+		if err != nil {
+			return 0, -1, true
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	start, err := strconv.Atoi64(first)
+	if err != nil || start < 0 {
+		return 0, -1, true
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.Atoi64(last); err != nil || end < start {
+			return 0, -1, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
@@ -157,3 +157,188 @@ func TestBasicFiles(t *testing.T) {
 		}
 	}
 }
+
+func getWithHeader(p string, key, value string) (r *http.Response, err os.Error) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%v", fmt.Sprintf("localhost:%v/", port())), nil)
+	req.URL.Path = p
+	req.Header.Set(key, value)
+	r, err = http.DefaultTransport.RoundTrip(req)
+	return
+}
+
+func TestConditionalGet(t *testing.T) {
+	r, err := get("/hello/world.txt")
+	if err != nil {
+		t.Fatalf("Error getting file: %v", err)
+	}
+	r.Body.Close()
+	etag := r.Header.Get("Etag")
+	lastModified := r.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("Missing validators. Etag: '%v' Last-Modified: '%v'", etag, lastModified)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		value  string
+		status int
+	}{
+		{"matching etag", "If-None-Match", etag, 304},
+		{"etag list", "If-None-Match", "\"nope\", " + etag, 304},
+		{"stale etag", "If-None-Match", "\"nope\"", 200},
+		{"not modified since", "If-Modified-Since", lastModified, 304},
+		{"modified since", "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", 200},
+	}
+	for _, test := range tests {
+		r, err := getWithHeader("/hello/world.txt", test.key, test.value)
+		if err != nil {
+			t.Errorf("%v Error getting file: %v", test.name, err)
+			continue
+		}
+		r.Body.Close()
+		if r.StatusCode != test.status {
+			t.Errorf("%v Expected status %v, got %v", test.name, test.status, r.StatusCode)
+		}
+	}
+}
+
+var rangeTests = []struct {
+	name   string
+	value  string
+	status int
+	body   string
+	cr     string
+}{
+	{"first bytes", "bytes=0-4", 206, "Hello", "bytes 0-4/12"},
+	{"open ended", "bytes=6-", 206, "world!", "bytes 6-11/12"},
+	{"suffix", "bytes=-6", 206, "world!", "bytes 6-11/12"},
+	{"past the end", "bytes=6-100", 206, "world!", "bytes 6-11/12"},
+	{"unsatisfiable", "bytes=100-", 416, "", "bytes */12"},
+	{"multiple ranges", "bytes=0-1,4-5", 200, "Hello world!", ""},
+}
+
+func TestRange(t *testing.T) {
+	rbody := new(bytes.Buffer)
+	for _, test := range rangeTests {
+		r, err := getWithHeader("/hello/world.txt", "Range", test.value)
+		if err != nil {
+			t.Errorf("%v Error getting file: %v", test.name, err)
+			continue
+		}
+		rbody.Reset()
+		io.Copy(rbody, r.Body)
+		r.Body.Close()
+		if r.StatusCode != test.status {
+			t.Errorf("%v Expected status %v, got %v", test.name, test.status, r.StatusCode)
+			continue
+		}
+		if cr := r.Header.Get("Content-Range"); cr != test.cr {
+			t.Errorf("%v Expected Content-Range '%v', got '%v'", test.name, test.cr, cr)
+		}
+		if test.status != 416 && rbody.String() != test.body {
+			t.Errorf("%v Expected body '%v', got '%v'", test.name, test.body, rbody.String())
+		}
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	f := &Filter{
+		PathPrefix: "/",
+		BasePath:   "../test/",
+		IndexFile:  "world.txt",
+	}
+	req, _ := http.NewRequest("GET", "/hello", nil)
+	res := f.FilterRequest(&falcore.Request{HttpRequest: req})
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %v", res.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "Hello world!" {
+		t.Errorf("Expected index file body, got '%v'", string(body))
+	}
+}
+
+func TestMemoryFS(t *testing.T) {
+	f := &Filter{
+		PathPrefix: "/",
+		IndexFile:  "index.html",
+		FileSystem: MemoryFS{
+			"/index.html": {[]byte("<p>index</p>"), 1e9},
+			"/app.json":   {[]byte(`{"hello":"world"}`), 2e18},
+		},
+	}
+	run := func(p string, header http.Header) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", p, nil)
+		if header != nil {
+			req.Header = header
+		}
+		res := f.FilterRequest(&falcore.Request{HttpRequest: req})
+		if res.Body == nil {
+			return res, ""
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(body)
+	}
+
+	res, body := run("/app.json", nil)
+	if res.StatusCode != 200 || body != `{"hello":"world"}` {
+		t.Errorf("Expected the file, got %v '%v'", res.StatusCode, body)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected application/json, got '%v'", ct)
+	}
+	etag := res.Header.Get("Etag")
+
+	if res, body = run("/", nil); res.StatusCode != 200 || body != "<p>index</p>" {
+		t.Errorf("Expected the index file, got %v '%v'", res.StatusCode, body)
+	}
+	if res, _ = run("/missing", nil); res.StatusCode != 404 {
+		t.Errorf("Expected 404, got %v", res.StatusCode)
+	}
+	if res, _ = run("/app.json", http.Header{"If-None-Match": {etag}}); res.StatusCode != 304 {
+		t.Errorf("Expected 304, got %v", res.StatusCode)
+	}
+	res, body = run("/app.json", http.Header{"Range": {"bytes=2-6"}})
+	if res.StatusCode != 206 || body != "hello" {
+		t.Errorf("Expected 206 'hello', got %v '%v'", res.StatusCode, body)
+	}
+	if cr := res.Header.Get("Content-Range"); cr != "bytes 2-6/17" {
+		t.Errorf("Expected Content-Range bytes 2-6/17, got '%v'", cr)
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	mtime := int64(1300000000e9)
+	f := &Filter{PathPrefix: "/", FileSystem: MemoryFS{"/data.txt": {[]byte("0123456789"), mtime}}}
+	etag := fmt.Sprintf("\"%x-%x\"", mtime, 10)
+	modified := time.SecondsToUTC(mtime / 1e9).Format(http.TimeFormat)
+	stale := time.SecondsToUTC(mtime/1e9 - 60).Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		ifRange string
+		status  int
+		body    string
+	}{
+		{"matching etag", etag, 206, "234"},
+		{"stale etag", "\"1-1\"", 200, "0123456789"},
+		{"weak etag", "W/" + etag, 200, "0123456789"},
+		{"matching date", modified, 206, "234"},
+		{"stale date", stale, 200, "0123456789"},
+		{"garbage", "yesterday", 200, "0123456789"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/data.txt", nil)
+		req.Header.Set("Range", "bytes=2-4")
+		req.Header.Set("If-Range", test.ifRange)
+		res := f.FilterRequest(&falcore.Request{HttpRequest: req})
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.status || string(body) != test.body {
+			t.Errorf("%v Expected %v '%v', got %v '%v'", test.name, test.status, test.body, res.StatusCode, string(body))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package static_file
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A file opened from a FileSystem
+type File interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Size and modification time (nanoseconds) of a File
+type FileInfo struct {
+	Size        int64
+	Mtime       int64
+	IsDirectory bool
+}
+
+// Where a Filter's files come from.  Names are slash separated and
+// start with "/".  For directories Open returns a nil File and a
+// FileInfo with IsDirectory set.
+type FileSystem interface {
+	Open(name string) (File, *FileInfo, os.Error)
+}
+
+// A FileSystem serving the files under a directory on disk
+type Dir string
+
+func (d Dir) Open(name string) (File, *FileInfo, os.Error) {
+	base := filepath.Clean(string(d))
+	p := filepath.Join(base, filepath.FromSlash(path.Clean("/"+name)))
+	// Don't let anything escape the directory
+	if p != base && !strings.HasPrefix(p, base+string(filepath.Separator)) {
+		return nil, nil, os.ENOENT
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if stat.IsDirectory() {
+		file.Close()
+		return nil, &FileInfo{IsDirectory: true}, nil
+	}
+	if !stat.IsRegular() {
+		file.Close()
+		return nil, nil, os.NewError("not a regular file: " + p)
+	}
+	return file, &FileInfo{Size: stat.Size, Mtime: stat.Mtime_ns}, nil
+}
+
+// A file held in memory for a MemoryFS
+type MemoryFile struct {
+	Data  []byte
+	Mtime int64
+}
+
+// A FileSystem backed by a map, for assets compiled into the binary.
+// Keys are the full names like "/css/site.css".  Directories aren't
+// listed so IndexFile only works for "/".
+type MemoryFS map[string]*MemoryFile
+
+func (fs MemoryFS) Open(name string) (File, *FileInfo, os.Error) {
+	name = path.Clean("/" + name)
+	f, ok := fs[name]
+	if !ok {
+		if name == "/" {
+			return nil, &FileInfo{IsDirectory: true}, nil
+		}
+		return nil, nil, os.ENOENT
+	}
+	return &memoryReader{data: f.Data}, &FileInfo{Size: int64(len(f.Data)), Mtime: f.Mtime}, nil
+}
+
+type memoryReader struct {
+	data []byte
+	pos  int64
+}
+
+func (r *memoryReader) Read(p []byte) (int, os.Error) {
+	if r.pos >= int64(len(r.data)) {
+		return 0, os.EOF
+	}
+	n := copy(p, r.data[r.pos:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *memoryReader) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case 1:
+		offset += r.pos
+	case 2:
+		offset += int64(len(r.data))
+	}
+	if offset < 0 {
+		return r.pos, os.EINVAL
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *memoryReader) Close() os.Error {
+	return nil
+}
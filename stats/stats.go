@@ -0,0 +1,119 @@
+package stats
+
+import (
+	"http"
+	"json"
+	"sort"
+	"sync"
+	"falcore"
+)
+
+// Name used for the whole request time
+const TotalStage = "Total"
+
+// falcore/stats.Accumulator collects PipelineStageStats across requests.
+// Use it as (or call it from) the Pipeline's RequestDoneCallback.
+//
+// For each stage name it keeps a count, the mean and p50/p95/p99
+// latency in seconds.  Percentiles come from the last SampleSize
+// samples of each stage.  The whole request is reported as TotalStage.
+//
+// Handler returns a RequestFilter that serves the stats as JSON.
+type Accumulator struct {
+	SampleSize int
+	stages     map[string]*stageStats
+	mutex      *sync.Mutex
+}
+
+type stageStats struct {
+	count   int64
+	total   float64
+	samples []float64
+	next    int
+}
+
+func NewAccumulator() *Accumulator {
+	a := new(Accumulator)
+	a.SampleSize = 1000
+	a.stages = make(map[string]*stageStats)
+	a.mutex = new(sync.Mutex)
+	return a
+}
+
+func (a *Accumulator) FilterRequest(request *falcore.Request) *http.Response {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for e := request.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		pss, _ := e.Value.(*falcore.PipelineStageStat)
+		a.add(pss.Name, falcore.TimeDiff(pss.StartTime, pss.EndTime))
+	}
+	a.add(TotalStage, falcore.TimeDiff(request.StartTime, request.EndTime))
+	return nil
+}
+
+func (a *Accumulator) add(name string, dur float32) {
+	s := a.stages[name]
+	if s == nil {
+		s = new(stageStats)
+		a.stages[name] = s
+	}
+	s.count++
+	s.total += float64(dur)
+	if len(s.samples) < a.SampleSize {
+		s.samples = append(s.samples, float64(dur))
+	} else if a.SampleSize > 0 {
+		s.samples[s.next%len(s.samples)] = float64(dur)
+	}
+	s.next++
+}
+
+// A snapshot of the stats keyed by stage name
+func (a *Accumulator) Stats() map[string]map[string]interface{} {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	all := make(map[string]map[string]interface{})
+	for name, s := range a.stages {
+		sorted := make([]float64, len(s.samples))
+		copy(sorted, s.samples)
+		sort.Float64s(sorted)
+		all[name] = map[string]interface{}{
+			"count": s.count,
+			"mean":  s.total / float64(s.count),
+			"p50":   percentile(sorted, 50),
+			"p95":   percentile(sorted, 95),
+			"p99":   percentile(sorted, 99),
+		}
+	}
+	return all
+}
+
+// Nearest rank on already sorted samples
+func percentile(sorted []float64, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Clears everything collected so far
+func (a *Accumulator) Reset() {
+	a.mutex.Lock()
+	a.stages = make(map[string]*stageStats)
+	a.mutex.Unlock()
+}
+
+// A RequestFilter serving the stats as JSON
+func (a *Accumulator) Handler() falcore.RequestFilter {
+	return falcore.NewRequestFilter(func(request *falcore.Request) *http.Response {
+		body, err := json.Marshal(a.Stats())
+		if err != nil {
+			falcore.Error("%s Can't encode stats: %v", request.ID, err)
+			return falcore.SimpleResponse(request.HttpRequest, 500, nil, "Server Error\n")
+		}
+		return falcore.SimpleResponse(request.HttpRequest, 200, http.Header{"Content-Type": {"application/json"}}, string(body))
+	})
+}
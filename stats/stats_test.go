@@ -0,0 +1,84 @@
+package stats
+
+import (
+	"falcore"
+	"http"
+	"json"
+	"testing"
+	"container/list"
+	"io/ioutil"
+)
+
+// A finished request with one stage per duration (in ms)
+func finishedRequest(stage string, ms int64) *falcore.Request {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	req := &falcore.Request{HttpRequest: tmp, PipelineStageStats: list.New()}
+	req.StartTime = 1e12
+	req.EndTime = req.StartTime + ms*1e6
+	req.PipelineStageStats.PushBack(&falcore.PipelineStageStat{
+		Name:      stage,
+		StartTime: req.StartTime,
+		EndTime:   req.EndTime,
+	})
+	return req
+}
+
+func TestAccumulator(t *testing.T) {
+	a := NewAccumulator()
+	for i := int64(1); i <= 100; i++ {
+		a.FilterRequest(finishedRequest("filter", i))
+	}
+
+	stats := a.Stats()
+	s := stats["filter"]
+	if s == nil {
+		t.Fatalf("No stats for stage: %v", stats)
+	}
+	if s["count"].(int64) != 100 {
+		t.Errorf("Expected count 100, got %v", s["count"])
+	}
+	expect := map[string]float64{"mean": 0.0505, "p50": 0.050, "p95": 0.095, "p99": 0.099}
+	for k, v := range expect {
+		if got := s[k].(float64); got < v-0.0001 || got > v+0.0001 {
+			t.Errorf("Expected %v %v, got %v", k, v, got)
+		}
+	}
+	if stats[TotalStage]["count"].(int64) != 100 {
+		t.Errorf("Missing total request stats")
+	}
+}
+
+func TestSampleSize(t *testing.T) {
+	a := NewAccumulator()
+	a.SampleSize = 10
+	for i := int64(1); i <= 100; i++ {
+		a.FilterRequest(finishedRequest("filter", i))
+	}
+	s := a.Stats()["filter"]
+	// only the last 10 samples are kept for percentiles
+	if p50 := s["p50"].(float64); p50 < 0.095-0.0001 || p50 > 0.095+0.0001 {
+		t.Errorf("Expected p50 from recent samples, got %v", p50)
+	}
+	if s["count"].(int64) != 100 {
+		t.Errorf("Count should include every request, got %v", s["count"])
+	}
+}
+
+func TestHandler(t *testing.T) {
+	a := NewAccumulator()
+	a.FilterRequest(finishedRequest("filter", 5))
+
+	tmp, _ := http.NewRequest("GET", "/stats", nil)
+	res := a.Handler().FilterRequest(&falcore.Request{HttpRequest: tmp})
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Bad stats response: %v %v", res.StatusCode, res.Header)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	var decoded map[string]map[string]float64
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("Couldn't decode stats: %v", err)
+	}
+	if decoded["filter"]["count"] != 1 {
+		t.Errorf("Wrong stats served: %v", string(body))
+	}
+}
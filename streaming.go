@@ -0,0 +1,145 @@
+package falcore
+
+import (
+	"http"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A response body written by a filter while the server is sending it.
+// Usually the filter hands the writer off to a goroutine and returns
+// the response right away.  The server flushes each write to the
+// client instead of buffering it, as long as no Downstream filter has
+// replaced the body.
+type StreamingBody struct {
+	*io.PipeReader
+}
+
+// Returns a body and the writer that feeds it.  Close the writer to
+// end the response.  Writes fail once the client has gone away.
+func NewStreamingBody() (*StreamingBody, *io.PipeWriter) {
+	r, w := io.Pipe()
+	return &StreamingBody{r}, w
+}
+
+// A response with a StreamingBody.  HTTP/1.1 clients get it chunked so
+// the connection can be reused once the writer is closed.  HTTP/1.0
+// connections are closed at the end instead.
+func StreamingResponse(req *http.Request, status int, headers http.Header) (*http.Response, *io.PipeWriter) {
+	body, w := NewStreamingBody()
+	res := SimpleResponse(req, status, headers, "")
+	res.Body = body
+	res.ContentLength = -1
+	if req.ProtoAtLeast(1, 1) {
+		res.TransferEncoding = []string{"chunked"}
+	}
+	return res, w
+}
+
+// A response whose body is written through a StreamWriter.  Nothing
+// reaches the client until the first Flush, so a filter can produce a
+// large response in pieces (a report, say) and decide how often the
+// client sees progress.  The status line and headers go out with the
+// first flushed piece.  Close the writer to end the response.
+func StreamResponse(req *http.Request, status int, headers http.Header) (*http.Response, *StreamWriter) {
+	res, w := StreamingResponse(req, status, headers)
+	return res, NewStreamWriter(w)
+}
+
+// Buffers writes to a streaming body until Flush
+type StreamWriter struct {
+	pw  *io.PipeWriter
+	buf *bufio.Writer
+}
+
+func NewStreamWriter(w *io.PipeWriter) *StreamWriter {
+	return &StreamWriter{w, bufio.NewWriter(w)}
+}
+
+func (sw *StreamWriter) Write(p []byte) (int, os.Error) {
+	return sw.buf.Write(p)
+}
+
+// Sends everything written so far to the client.  Blocks until the
+// server has taken it.
+func (sw *StreamWriter) Flush() os.Error {
+	return sw.buf.Flush()
+}
+
+// Flushes and ends the response.  Chunked responses get their final
+// chunk so the connection can be reused.
+func (sw *StreamWriter) Close() os.Error {
+	err := sw.buf.Flush()
+	if cerr := sw.pw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Ends the response without the final chunk so the client can tell it
+// was cut short.  The server closes the connection.
+func (sw *StreamWriter) CloseWithError(err os.Error) os.Error {
+	return sw.pw.CloseWithError(err)
+}
+
+// A Server-Sent Events response.  Send events with the EventWriter
+// and Close it to end the stream.
+func SSEResponse(req *http.Request) (*http.Response, *EventWriter) {
+	h := make(http.Header)
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// ask proxies like nginx not to buffer either
+	h.Set("X-Accel-Buffering", "no")
+	res, w := StreamingResponse(req, 200, h)
+	return res, &EventWriter{w}
+}
+
+// Writes events in the text/event-stream format
+type EventWriter struct {
+	w *io.PipeWriter
+}
+
+// Sends an event.  event can be empty for the default "message" type.
+// Multi-line data is split into several data fields.
+func (ew *EventWriter) Send(event, data string) os.Error {
+	msg := ""
+	if event != "" {
+		msg = "event: " + event + "\n"
+	}
+	for _, line := range strings.Split(data, "\n") {
+		msg += "data: " + line + "\n"
+	}
+	_, err := io.WriteString(ew.w, msg+"\n")
+	return err
+}
+
+// Sends a comment line.  Handy as a keep-alive ping.
+func (ew *EventWriter) Comment(text string) os.Error {
+	_, err := fmt.Fprintf(ew.w, ": %s\n\n", text)
+	return err
+}
+
+func (ew *EventWriter) Close() os.Error {
+	return ew.w.Close()
+}
+
+// Flushes whatever has been written so far before waiting on the next
+// piece of a streaming body.
+type flushingBody struct {
+	body io.ReadCloser
+	w    *bufio.Writer
+}
+
+func (fb *flushingBody) Read(p []byte) (int, os.Error) {
+	if err := fb.w.Flush(); err != nil {
+		return 0, err
+	}
+	return fb.body.Read(p)
+}
+
+func (fb *flushingBody) Close() os.Error {
+	return fb.body.Close()
+}
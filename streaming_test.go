@@ -0,0 +1,119 @@
+package falcore
+
+import (
+	"http"
+	"strings"
+	"testing"
+)
+
+func TestSSEResponse(t *testing.T) {
+	next := make(chan int)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path != "/events" {
+			return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+		}
+		res, events := SSEResponse(req.HttpRequest)
+		go func() {
+			events.Send("", "one")
+			<-next
+			events.Send("update", "two\nlines")
+			events.Close()
+		}()
+		return res
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	req, _ := http.NewRequest("GET", "/events", nil)
+	res, err := http.ReadResponse(buf, req)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Wrong Content-Type: %v", res.Header.Get("Content-Type"))
+	}
+
+	// the first event has to arrive before the second is sent
+	p := make([]byte, 64)
+	n, err := res.Body.Read(p)
+	if err != nil || string(p[0:n]) != "data: one\n\n" {
+		t.Fatalf("Expected the first event on its own, got %q %v", p[0:n], err)
+	}
+	next <- 1
+
+	rest := ""
+	for err == nil {
+		n, err = res.Body.Read(p)
+		rest += string(p[0:n])
+	}
+	if rest != "event: update\ndata: two\ndata: lines\n\n" {
+		t.Errorf("Wrong second event: %q", rest)
+	}
+
+	// the stream ended cleanly so the connection still works
+	res, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || !strings.HasPrefix(body, "hello") {
+		t.Errorf("Connection not reusable after the stream: %v %q", err, body)
+	}
+}
+
+func TestStreamResponse(t *testing.T) {
+	next := make(chan int)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path != "/report" {
+			return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+		}
+		res, w := StreamResponse(req.HttpRequest, 200, nil)
+		go func() {
+			w.Write([]byte("line 1\n"))
+			w.Write([]byte("line 2\n"))
+			w.Flush()
+			<-next
+			w.Write([]byte("done\n"))
+			w.Close()
+		}()
+		return res
+	}))
+	srv := NewServer(0, pipeline)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	conn, buf := dialTestServer(t, srv)
+	defer conn.Close()
+	conn.SetReadTimeout(2e9)
+	conn.Write([]byte("GET /report HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	req, _ := http.NewRequest("GET", "/report", nil)
+	res, err := http.ReadResponse(buf, req)
+	if err != nil {
+		t.Fatalf("Couldn't read response: %v", err)
+	}
+
+	// both writes arrive together with the flush
+	p := make([]byte, 64)
+	n, err := res.Body.Read(p)
+	if err != nil || string(p[0:n]) != "line 1\nline 2\n" {
+		t.Fatalf("Expected the flushed writes, got %q %v", p[0:n], err)
+	}
+	next <- 1
+
+	rest := ""
+	for err == nil {
+		n, err = res.Body.Read(p)
+		rest += string(p[0:n])
+	}
+	if rest != "done\n" {
+		t.Errorf("Expected the rest on Close, got %q", rest)
+	}
+
+	res, body, err := rawRequest(conn, buf, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil || !strings.HasPrefix(body, "hello") {
+		t.Errorf("Connection not reusable after the stream: %v %q", err, body)
+	}
+}
@@ -0,0 +1,87 @@
+package falcore
+
+import (
+	"http"
+	"time"
+)
+
+// Runs Filter with a time limit.  If it hasn't returned after Timeout
+// nanoseconds the request is cancelled (see Request.Cancelled) and a
+// '504 Gateway Timeout' is returned instead.
+//
+// The request's Deadline is also enforced if it comes sooner.  With a
+// Timeout of 0 only the Deadline applies and requests without one
+// aren't limited at all.
+//
+// The wrapped filter runs in its own goroutine on a snapshot of the
+// Request, so it can be a Pipeline or Router with stages of its own.
+// If it returns in time the snapshot's stages and Context become the
+// request's.  After a timeout it keeps running until it returns, but
+// on its copy, and whatever it returns is thrown away so it never
+// reaches the connection.  The RequestDoneCallback waits for it and
+// gets the Context values it set.  The HttpRequest is still shared, so
+// the filter should stop using it once it's been cancelled.
+type TimeoutFilter struct {
+	Filter  RequestFilter
+	Timeout int64
+}
+
+func NewTimeoutFilter(filter RequestFilter, timeout int64) *TimeoutFilter {
+	return &TimeoutFilter{Filter: filter, Timeout: timeout}
+}
+
+type filterResult struct {
+	res   *http.Response
+	panic interface{}
+}
+
+func (f *TimeoutFilter) FilterRequest(request *Request) *http.Response {
+	timeout := f.Timeout
+	if remaining, ok := request.Remaining(); ok && (timeout <= 0 || remaining < timeout) {
+		if timeout = remaining; timeout <= 0 {
+			// already out of time
+			return f.timedOut(request, 0)
+		}
+	}
+	if timeout <= 0 {
+		return f.Filter.FilterRequest(request)
+	}
+
+	run := request.snapshot()
+	done := make(chan filterResult, 1)
+	go func() {
+		defer close(run.finished)
+		defer func() {
+			if x := recover(); x != nil {
+				done <- filterResult{panic: x}
+			}
+		}()
+		done <- filterResult{res: f.Filter.FilterRequest(run)}
+	}()
+
+	select {
+	case result := <-done:
+		request.merge(run)
+		if result.panic != nil {
+			// let the server deal with it like any other panic
+			panic(result.panic)
+		}
+		return result.res
+	case <-time.After(timeout):
+	}
+
+	request.abandon(run)
+	go func() {
+		if result := <-done; result.res != nil && result.res.Body != nil {
+			result.res.Body.Close()
+		}
+	}()
+	return f.timedOut(request, timeout)
+}
+
+func (f *TimeoutFilter) timedOut(request *Request, timeout int64) *http.Response {
+	request.Cancel()
+	request.CurrentStage.Status = 2 // Fail
+	Warn("%s %v timed out after %.4f", request.ID, filterName(f.Filter), float32(timeout)/1e9)
+	return SimpleResponse(request.HttpRequest, 504, nil, "Gateway Timeout\n")
+}
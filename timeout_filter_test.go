@@ -0,0 +1,145 @@
+package falcore
+
+import (
+	"http"
+	"testing"
+	"time"
+)
+
+func TestTimeoutFilter(t *testing.T) {
+	stopped := make(chan int, 1)
+	slow := NewRequestFilter(func(req *Request) *http.Response {
+		select {
+		case <-req.Cancelled():
+			stopped <- 1
+		case <-time.After(5e9):
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "too late")
+	})
+
+	p := NewPipeline()
+	p.Upstream.PushBack(NewTimeoutFilter(slow, 5e7))
+	res := p.execute(validGetRequest())
+	if res.StatusCode != 504 {
+		t.Errorf("Expected status 504, got %v", res.StatusCode)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(1e9):
+		t.Errorf("Filter wasn't told about the cancellation")
+	}
+}
+
+func TestTimeoutFilterInTime(t *testing.T) {
+	fast := NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	})
+	p := NewPipeline()
+	p.Upstream.PushBack(NewTimeoutFilter(fast, 1e9))
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 200 {
+		t.Errorf("Expected status 200, got %v", res.StatusCode)
+	}
+	select {
+	case <-req.Cancelled():
+		t.Errorf("Request shouldn't be cancelled")
+	default:
+	}
+}
+
+func TestTimeoutFilterPanic(t *testing.T) {
+	defer func() {
+		if x := recover(); x != "boom" {
+			t.Errorf("Expected the panic to be passed on, got %v", x)
+		}
+	}()
+	f := NewTimeoutFilter(NewRequestFilter(func(req *Request) *http.Response {
+		panic("boom")
+	}), 1e9)
+	f.FilterRequest(validGetRequest())
+}
+
+func TestTimeoutFilterDeadline(t *testing.T) {
+	slow := NewRequestFilter(func(req *Request) *http.Response {
+		select {
+		case <-req.Cancelled():
+		case <-time.After(5e9):
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "too late")
+	})
+
+	// the client's deadline comes before the filter's Timeout
+	tmp, _ := http.NewRequest("GET", "/hello", nil)
+	tmp.Header.Set("X-Request-Timeout-Ms", "50")
+	req := newRequest(tmp, nil, time.Nanoseconds())
+	start := time.Nanoseconds()
+	if res := NewTimeoutFilter(slow, 5e9).FilterRequest(req); res.StatusCode != 504 {
+		t.Errorf("Expected status 504, got %v", res.StatusCode)
+	}
+	if elapsed := time.Nanoseconds() - start; elapsed > 1e9 {
+		t.Errorf("Deadline wasn't enforced, took %vns", elapsed)
+	}
+
+	// already past the deadline
+	req = validGetRequest()
+	req.Deadline = time.Nanoseconds() - 1
+	if res := NewTimeoutFilter(slow, 0).FilterRequest(req); res.StatusCode != 504 {
+		t.Errorf("Expected status 504 past the deadline, got %v", res.StatusCode)
+	}
+}
+
+func TestTimeoutFilterPipeline(t *testing.T) {
+	release := make(chan int)
+	stopped := make(chan int)
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		<-release
+		return nil
+	}))
+	// runs after the timeout, on the abandoned copy
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		req.Context["late"] = true
+		close(stopped)
+		return SimpleResponse(req.HttpRequest, 200, nil, "too late")
+	}))
+
+	p := NewPipeline()
+	p.Upstream.PushBack(NewTimeoutFilter(inner, 5e7))
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 504 {
+		t.Errorf("Expected status 504, got %v", res.StatusCode)
+	}
+	stages := req.PipelineStageStats.Len()
+	signature := req.Signature()
+	close(release)
+	<-stopped
+	if req.PipelineStageStats.Len() != stages || req.Signature() != signature || len(req.openStages) != 0 {
+		t.Errorf("The abandoned pipeline changed the request's stages")
+	}
+
+	req.finishAbandoned()
+	if _, ok := req.Context["late"]; !ok {
+		t.Errorf("Expected the abandoned filter's Context value after it finished")
+	}
+}
+
+func TestTimeoutFilterPipelineInTime(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		req.Context["inner"] = true
+		return SimpleResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	p := NewPipeline()
+	p.Upstream.PushBack(NewTimeoutFilter(inner, 1e9))
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 200 {
+		t.Errorf("Expected status 200, got %v", res.StatusCode)
+	}
+	if _, ok := req.Context["inner"]; !ok {
+		t.Errorf("Context from the wrapped filter should be kept")
+	}
+	// the TimeoutFilter's stage and the inner pipeline's filter
+	if req.PipelineStageStats.Len() != 2 || len(req.openStages) != 0 {
+		t.Errorf("Expected the inner pipeline's stages to be merged, got %v", req.PipelineStageStats.Len())
+	}
+}
@@ -5,10 +5,24 @@ import (
 	"os"
 	"net"
 	"fmt"
+	"strings"
 	"time"
 	"falcore"
 )
 
+// Headers that only apply to a single connection and must not be
+// forwarded by a proxy (RFC 2616 section 13.5.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
 type Upstream struct {
 	// The upstream host to connect to
 	Host string
@@ -16,6 +30,8 @@ type Upstream struct {
 	Port int
 	// Default 60 seconds
 	Timeout int64
+	// Max time to wait for a connection to the upstream.  Default 10 seconds
+	DialTimeout int64
 	// Will ignore https on the incoming request and always upstream http
 	ForceHttp bool
 	// Ping URL Path-only for checking upness
@@ -47,18 +63,20 @@ func NewUpstream(host string, port int, forceHttp bool) *Upstream {
 		falcore.Warn("Can't get IP addr for %v: %v", host, err)
 	}
 	u.Timeout = 60e9
+	u.DialTimeout = 10e9
 	u.host = fmt.Sprintf("%v:%v", u.Host, u.Port)
 
 	u.transport = new(http.Transport)
 	u.transport.Dial = func(n, addr string) (c net.Conn, err os.Error) {
 		falcore.Fine("Dialing connection to %v", u.tcpaddr)
 		var ctcp *net.TCPConn
-		ctcp, err = net.DialTCP("tcp4", nil, u.tcpaddr)
+		ctcp, err = u.dial()
 		if ctcp != nil {
 			ctcp.SetTimeout(u.Timeout)
 		}
 		if err != nil {
 			falcore.Error("Dial Failed: %v", err)
+			return nil, err
 		}
 		return ctcp, err
 	}
@@ -66,6 +84,93 @@ func NewUpstream(host string, port int, forceHttp bool) *Upstream {
 	return u
 }
 
+type dialResult struct {
+	conn *net.TCPConn
+	err  os.Error
+}
+
+// DialTCP with DialTimeout applied.  A connection that shows up after
+// we've given up is closed.
+func (u *Upstream) dial() (*net.TCPConn, os.Error) {
+	if u.DialTimeout <= 0 {
+		return net.DialTCP("tcp4", nil, u.tcpaddr)
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		c, err := net.DialTCP("tcp4", nil, u.tcpaddr)
+		done <- dialResult{c, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(u.DialTimeout):
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+	}
+	return nil, dialTimeoutError(u.host)
+}
+
+type dialTimeoutError string
+
+func (e dialTimeoutError) String() string {
+	return "dial " + string(e) + ": timeout"
+}
+
+func (e dialTimeoutError) Timeout() bool   { return true }
+func (e dialTimeoutError) Temporary() bool { return true }
+
+// Removes hop-by-hop headers, including any named in the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// Add the client's address to X-Forwarded-For and set X-Forwarded-Proto
+func setForwardedHeaders(req *http.Request) {
+	if client, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			client = prior + ", " + client
+		}
+		req.Header.Set("X-Forwarded-For", client)
+	}
+	if req.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+}
+
+// Request bodies are streamed to the backend as they're read from the
+// client, so uploads of any size go through without being held in
+// memory.  Bodies of unknown length, like chunked uploads or ones
+// body_limit is cutting off, go out chunked.  If a body over the limit
+// is cut off the backend request fails, and the body_limit Filter in
+// the Downstream list turns the 502 into a 413.  Only bodies a filter
+// has buffered (see Request.BufferBody, which RetryFilter uses) are
+// sent with a Content-Length.
+func prepareBody(req *http.Request) {
+	if req.Body == nil {
+		return
+	}
+	if body, ok := req.Body.(*falcore.BufferedBody); ok {
+		req.ContentLength = int64(len(body.Bytes()))
+		req.TransferEncoding = nil
+	} else if req.ContentLength < 0 {
+		req.TransferEncoding = []string{"chunked"}
+	}
+}
+
 // Alter the number of connections to multiplex with
 func (u *Upstream) SetPoolSize(size int) {
 	u.transport.MaxIdleConnsPerHost = size
@@ -81,8 +186,14 @@ func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response)
 		req.URL.Host = req.Host
 	}
 	before := time.Nanoseconds()
+	removeHopHeaders(req.Header)
+	setForwardedHeaders(req)
 	req.Header.Set("Connection", "Keep-Alive")
+	prepareBody(req)
 	res, err = u.transport.RoundTrip(req)
+	if err == nil {
+		removeHopHeaders(res.Header)
+	}
 	diff := falcore.TimeDiff(before, time.Nanoseconds())
 	if err != nil {
 		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"testing"
+	"falcore"
+	"http"
+	"fmt"
+	"io/ioutil"
+	"time"
+	"log"
+	"os"
+	"strings"
+)
+
+var backend *falcore.Server
+
+func init() {
+	// Silence log output
+	log.SetOutput(nil)
+
+	go func() {
+		pipeline := falcore.NewPipeline()
+		pipeline.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+			if req.HttpRequest.URL.Path == "/slow" {
+				time.Sleep(5e8)
+			}
+			if req.HttpRequest.URL.Path == "/upload" {
+				body, _ := ioutil.ReadAll(req.HttpRequest.Body)
+				return falcore.SimpleResponse(req.HttpRequest, 200, nil,
+					fmt.Sprintf("%v|%v|%v", req.HttpRequest.TransferEncoding, req.HttpRequest.ContentLength, len(body)))
+			}
+			// echo back what the backend saw
+			h := req.HttpRequest.Header
+			body := fmt.Sprintf("%v|%v|%v|%v",
+				h.Get("X-Forwarded-For"),
+				h.Get("X-Forwarded-Proto"),
+				h.Get("Keep-Alive"),
+				h.Get("X-Hop"),
+			)
+			res := falcore.SimpleResponse(req.HttpRequest, 200, nil, body)
+			res.Header.Set("Keep-Alive", "timeout=5")
+			res.Header.Set("Connection", "X-Backend-Hop")
+			res.Header.Set("X-Backend-Hop", "1")
+			res.Header.Set("X-Backend", "1")
+			return res
+		}))
+		backend = falcore.NewServer(0, pipeline)
+		if err := backend.ListenAndServe(); err != nil {
+			panic(fmt.Sprintf("Could not start falcore: %v", err))
+		}
+	}()
+}
+
+func port() int {
+	for backend.Port() == 0 {
+		time.Sleep(1e7)
+	}
+	return backend.Port()
+}
+
+func proxyRequest(u *Upstream, path string) (*falcore.Request, *http.Response) {
+	req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	req.Header.Set("Keep-Alive", "300")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "hop")
+	request := &falcore.Request{HttpRequest: req, CurrentStage: falcore.NewPiplineStage("test")}
+	return request, u.FilterRequest(request)
+}
+
+func TestUpstreamHeaders(t *testing.T) {
+	u := NewUpstream("localhost", port(), false)
+	_, res := proxyRequest(u, "/")
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %v", res.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if expected := "192.168.1.1, 10.0.0.1|http||"; string(body) != expected {
+		t.Errorf("Backend got the wrong headers.  Expected '%v', got '%v'", expected, string(body))
+	}
+	if res.Header.Get("X-Backend") != "1" {
+		t.Errorf("End to end response header was dropped")
+	}
+	for _, name := range []string{"Keep-Alive", "Connection", "X-Backend-Hop"} {
+		if res.Header.Get(name) != "" {
+			t.Errorf("Hop-by-hop response header %v wasn't removed", name)
+		}
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	u := NewUpstream("localhost", port(), false)
+	u.Timeout = 1e8
+	request, res := proxyRequest(u, "/slow")
+	if res.StatusCode != 504 {
+		t.Errorf("Expected status 504, got %v", res.StatusCode)
+	}
+	if request.CurrentStage.Status != 2 {
+		t.Errorf("Expected stage to be marked as failed")
+	}
+}
+
+func TestUpstreamDialFailure(t *testing.T) {
+	// nothing should be listening on this one
+	u := NewUpstream("localhost", 1, false)
+	request, res := proxyRequest(u, "/")
+	if res.StatusCode != 502 {
+		t.Errorf("Expected status 502, got %v", res.StatusCode)
+	}
+	if request.CurrentStage.Status != 2 {
+		t.Errorf("Expected stage to be marked as failed")
+	}
+}
+
+// Hands out the body a little at a time like a slow client
+type trickleReader struct {
+	remaining int
+}
+
+func (r *trickleReader) Read(p []byte) (int, os.Error) {
+	if r.remaining == 0 {
+		return 0, os.EOF
+	}
+	if len(p) > 1000 {
+		p = p[0:1000]
+	}
+	if len(p) > r.remaining {
+		p = p[0:r.remaining]
+	}
+	r.remaining -= len(p)
+	return copy(p, strings.Repeat("x", len(p))), nil
+}
+
+func (r *trickleReader) Close() os.Error {
+	return nil
+}
+
+func upload(u *Upstream, buffer bool) string {
+	req, _ := http.NewRequest("POST", "http://localhost/upload", nil)
+	req.Body = &trickleReader{100000}
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	req.RemoteAddr = "10.0.0.1:1234"
+	request := &falcore.Request{HttpRequest: req, CurrentStage: falcore.NewPiplineStage("test")}
+	if buffer {
+		request.BufferBody(1 << 20)
+	}
+	res := u.FilterRequest(request)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return string(body)
+}
+
+func TestUpstreamStreamsBody(t *testing.T) {
+	u := NewUpstream("localhost", port(), false)
+	if body := upload(u, false); body != "[chunked]|-1|100000" {
+		t.Errorf("Expected the body to be passed on chunked, backend saw %v", body)
+	}
+	if body := upload(u, true); body != "[]|100000|100000" {
+		t.Errorf("Expected a buffered body to go with its length, backend saw %v", body)
+	}
+}